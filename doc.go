@@ -0,0 +1,22 @@
+// Package walrog implements a simple Write-Ahead Log (WAL).
+//
+// Records are appended with Wal.Write, buffered in memory and dumped into
+// segment files inside Options.DirName. After a crash, the records that made
+// it to disk can be read back with Recover or with a Reader.
+//
+// # Compatibility
+//
+// This package is the only supported entry point of the module. Everything
+// under internal/ (core, faultfs, file_handler, record and utils) is an
+// implementation detail and may change at any time without notice.
+//
+// walrog follows semantic versioning. Until v1.0.0 is tagged, a minor release
+// may still change the exported API of this package; such changes will be
+// listed in the release notes. From v1.0.0 on, exported identifiers of this
+// package will not be removed or changed in an incompatible way within the
+// same major version. New fields may be added to Options at any time, so
+// always build it from DefaultOptions or with keyed fields.
+//
+// The on-disk format is versioned independently: a release will always be
+// able to recover the files written by previous releases.
+package walrog
@@ -0,0 +1,94 @@
+package core
+
+import (
+	"fmt"
+)
+
+// Batch accumulates entries to be written all-or-nothing with WriteBatch.
+// The zero value is an empty batch ready to use.
+type Batch struct {
+	entries [][]byte
+}
+
+// Add appends an entry to the batch. The data is copied, so it can be reused right away.
+//
+// Parameters:
+//   - data: A slice of bytes to be written to the WAL.
+func (b *Batch) Add(data []byte) {
+	b.entries = append(b.entries, append([]byte{}, data...))
+}
+
+// Len returns the number of entries in the batch.
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Reset empties the batch, so it can be filled again.
+func (b *Batch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+// WriteBatch writes every entry of the batch to the WAL, with contiguous LSNs.
+// Every record of the batch but the ones of its last entry carries the batch flag, so recovery
+// only returns the entries of a batch once its last record is read: a batch torn by a crash,
+// even across a buffer flush or a segment rotation, is dropped as a whole.
+// Entries are synced like the ones written with WriteBuffer (see SyncMode).
+//
+// Parameters:
+//   - b: A pointer to the Batch to be written. It is left untouched.
+//
+// Returns:
+//   - The LSN assigned to the first entry of the batch.
+//   - An error if the batch is empty or cannot be written. If part of the batch was already
+//     buffered, the Wal fails: every later write returns the error, and it must be opened again,
+//     which drops the part of the batch written.
+func (w *Wal) WriteBatch(b *Batch) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.writable()
+	if err != nil {
+		return 0, err
+	}
+	if b.Len() == 0 {
+		return 0, fmt.Errorf("cannot write an empty batch")
+	}
+
+	// Build every record first, so a batch that cannot be written leaves nothing behind
+	var records [][]byte
+	for i, data := range b.entries {
+		var flags byte
+		if i < b.Len()-1 {
+			flags = recordFlagBatch
+		}
+		entryRecords, err := w.encodeEntry(w.lsn+uint64(i), flags, data)
+		if err != nil {
+			return 0, err
+		}
+		records = append(records, entryRecords...)
+	}
+
+	first := w.lsn
+	for i, record := range records {
+		err := w.manageWriteFlow(record)
+		if err != nil {
+			if i == 0 {
+				return 0, err
+			}
+			// Part of the batch is buffered or already written: an entry written after it
+			// would make it look complete, so nothing can be written anymore
+			w.lsn += uint64(b.Len())
+			return first, w.fail(err)
+		}
+	}
+	w.lsn += uint64(b.Len())
+
+	if w.Options.SyncMode == SyncOnWrite || w.syncIntervalElapsed() {
+		err := w.flushBuffer()
+		if err != nil {
+			return first, err
+		}
+	}
+
+	return first, nil
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/casteloig/walrog/internal/faultfs"
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+func TestWriteBatch(t *testing.T) {
+	w, options := newTestWal(t, 1)
+
+	var batch Batch
+	data := []byte("batch-0")
+	batch.Add(data)
+	data[6] = '1' // Add copies the data
+	batch.Add(data)
+	batch.Add([]byte("batch-2"))
+
+	lsn, err := w.WriteBatch(&batch)
+	if err != nil {
+		t.Fatalf("WriteBatch() failed: %v", err)
+	}
+	if lsn != 2 {
+		t.Errorf("Expected first LSN 2, got %d", lsn)
+	}
+
+	lsn, err = w.WriteBuffer([]byte("after"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 5 {
+		t.Errorf("Expected LSN 5 after the batch, got %d", lsn)
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	expected := []string{"0123456789", "batch-0", "batch-1", "batch-2", "after"}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.LSN != uint64(i+1) || string(entry.Data) != expected[i] {
+			t.Errorf("Expected entry %d %q, got %d %q", i+1, expected[i], entry.LSN, entry.Data)
+		}
+	}
+}
+
+func TestWriteEmptyBatch(t *testing.T) {
+	w, _ := newTestWal(t, 0)
+	defer w.Close()
+
+	var batch Batch
+	_, err := w.WriteBatch(&batch)
+	if err == nil {
+		t.Fatalf("Expected WriteBatch() to fail with an empty batch")
+	}
+
+	// Nothing was written
+	if w.Buffer.Buffered() != 0 || w.lsn != firstLSN {
+		t.Errorf("Expected nothing written, got %d bytes buffered and next LSN %d", w.Buffer.Buffered(), w.lsn)
+	}
+}
+
+func TestTornBatch(t *testing.T) {
+	w, options := newTestWal(t, 2)
+
+	// 6 entries of 4 per segment: the batch spans two segments
+	var batch Batch
+	for i := 0; i < 6; i++ {
+		batch.Add([]byte("0123456789"))
+	}
+	_, err := w.WriteBatch(&batch)
+	if err != nil {
+		t.Fatalf("WriteBatch() failed: %v", err)
+	}
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+
+	// Crash before the last record of the batch reached the disk
+	hotPath := w.HotFile.Name()
+	info, err := w.HotFile.Stat()
+	if err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	crash(w)
+	err = os.Truncate(hotPath, info.Size()-1)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+
+	// None of the batch is recovered
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected the 2 entries before the batch, got %v", entries)
+	}
+
+	// The Wal resumes where the batch started, in the first segment
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	if _, err := os.Stat(hotPath); !os.IsNotExist(err) {
+		t.Errorf("Expected segment holding only the torn batch to be removed")
+	}
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	if len(paths) != 1 || filepath.Base(w.HotFile.Name()) != filepath.Base(paths[0]) {
+		t.Errorf("Expected the first segment to be the hot file, got %v", paths)
+	}
+
+	lsn, err := w.WriteBuffer([]byte("after"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 3 {
+		t.Errorf("Expected LSN 3, got %d", lsn)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err = Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 3 || string(entries[2].Data) != "after" {
+		t.Fatalf("Expected 3 entries ending with the new one, got %v", entries)
+	}
+}
+
+func TestFailedBatch(t *testing.T) {
+	fs := faultfs.New(1)
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fs
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     256,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	_, err = w.WriteBuffer([]byte("before"))
+	if err == nil {
+		err = w.FlushBuffer()
+	}
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// Two entries do not fit in the buffer, so the first one is flushed before the sync fails
+	eio := errors.New("input/output error")
+	fs.SetFault(func(op faultfs.Op, name string) error {
+		if op == faultfs.OpSync {
+			return eio
+		}
+		return nil
+	})
+	var batch Batch
+	for i := 0; i < 3; i++ {
+		batch.Add(bytes.Repeat([]byte{'a' + byte(i)}, 30))
+	}
+	_, err = w.WriteBatch(&batch)
+	if !errors.Is(err, eio) {
+		t.Fatalf("Expected WriteBatch() to fail with the sync error, got %v", err)
+	}
+	fs.SetFault(nil)
+
+	// An entry written now would complete the batch
+	if _, err = w.WriteBuffer([]byte("after")); !errors.Is(err, eio) {
+		t.Errorf("Expected WriteBuffer() to fail with the sync error, got %v", err)
+	}
+	if err = w.FlushBuffer(); !errors.Is(err, eio) {
+		t.Errorf("Expected FlushBuffer() to fail with the sync error, got %v", err)
+	}
+	if err = w.Close(); !errors.Is(err, eio) {
+		t.Errorf("Expected Close() to fail with the sync error, got %v", err)
+	}
+
+	// Opening the Wal again drops the part of the batch written
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	lsn, err := w.WriteBuffer([]byte("after"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 2 {
+		t.Errorf("Expected LSN 2, got %d", lsn)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 2 || string(entries[0].Data) != "before" || string(entries[1].Data) != "after" {
+		t.Fatalf("Expected the entries before and after the batch, got %v", entries)
+	}
+}
+
+func TestTruncateAfterBatch(t *testing.T) {
+	w, _ := newTestWal(t, 1)
+	defer w.Close()
+
+	var batch Batch
+	for i := 0; i < 3; i++ {
+		batch.Add([]byte("0123456789"))
+	}
+	_, err := w.WriteBatch(&batch)
+	if err != nil {
+		t.Fatalf("WriteBatch() failed: %v", err)
+	}
+
+	// Entries 2 to 4 are the batch
+	err = w.TruncateAfter(2)
+	if err == nil {
+		t.Errorf("Expected TruncateAfter() in the middle of a batch to fail")
+	}
+	err = w.TruncateAfter(1)
+	if err != nil {
+		t.Errorf("Expected TruncateAfter() before the batch to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"fmt"
+	"path/filepath"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+	utils "github.com/casteloig/walrog/internal/utils"
+)
+
+// Checkpoint marks the LSN up to which the entries of the WAL are already reflected
+// elsewhere (e.g. in a snapshot), so recovery only has to replay the entries after it.
+//
+// It is stored in the checkpoint file of the Wal folder as:
+//
+//	LSN (8 bytes) | offset (8 bytes) | segment name length (4 bytes) | segment name |
+//	metadata length (4 bytes) | metadata | CRC (4 bytes)
+type Checkpoint struct {
+	LSN      uint64 // LSN of the last entry covered by the checkpoint
+	Segment  string // Name of the segment where the entry after LSN is written
+	Offset   int64  // Offset in Segment where the entry after LSN starts
+	Metadata []byte // Opaque data stored along the checkpoint by the caller
+}
+
+// Checkpoint durably records that the entries up to lsn no longer need to be replayed.
+// The buffer is flushed and synced to find the position of the entry after lsn, and the checkpoint
+// file is replaced atomically, so a crash leaves either the old or the new checkpoint.
+//
+// Parameters:
+//   - lsn: The LSN of the last entry covered by the checkpoint.
+//   - metadata: Opaque data stored along the checkpoint, returned by ReadCheckpoint.
+//
+// Returns:
+//   - An error if lsn has not been assigned yet, or the checkpoint cannot be written.
+func (w *Wal) Checkpoint(lsn uint64, metadata []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	if lsn < firstLSN || lsn >= w.lsn {
+		return fmt.Errorf("cannot checkpoint LSN %d, next LSN is %d", lsn, w.lsn)
+	}
+	opts := *w.Options.FileHandlerOpts
+
+	// OpenWal resumes scanning from the checkpoint, so the entries before it must be on disk
+	err = w.flushBuffer()
+	if err != nil {
+		return err
+	}
+	err = w.syncHotFile()
+	if err != nil {
+		return err
+	}
+
+	paths, err := fh.ListWalFiles(opts)
+	if err != nil {
+		return err
+	}
+
+	// Entries before the previous checkpoint do not need to be scanned again
+	previous, hasPrevious, err := ReadCheckpoint(w.Options)
+	if err != nil {
+		return err
+	}
+	if hasPrevious && previous.LSN <= lsn {
+		for i, p := range paths {
+			if filepath.Base(p) == previous.Segment {
+				paths = paths[i:]
+				break
+			}
+		}
+	}
+
+	segment, offset, _, err := locateAfter(w.Options, paths, lsn)
+	if err != nil {
+		return err
+	}
+
+	checkpoint := Checkpoint{
+		LSN:      lsn,
+		Segment:  filepath.Base(paths[segment]),
+		Offset:   offset,
+		Metadata: metadata,
+	}
+	return fh.WriteFileAtomic(opts, fh.CheckpointFileName, encodeCheckpoint(checkpoint))
+}
+
+// ReadCheckpoint returns the last checkpoint stored in the Wal folder.
+// If a nil argument is passed, it will use the default options.
+//
+// Parameters:
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
+//
+// Returns:
+//   - The last checkpoint.
+//   - false if there is no valid checkpoint: none was written or it is corrupted.
+//   - An error if the checkpoint file cannot be read.
+func ReadCheckpoint(options *WalOptions) (Checkpoint, bool, error) {
+	if options == nil {
+		options = DefaultWalOptions
+	}
+
+	data, err := fh.ReadFile(*options.FileHandlerOpts, fh.CheckpointFileName)
+	if err != nil {
+		return Checkpoint{}, false, err
+	}
+
+	checkpoint, ok := decodeCheckpoint(data)
+	return checkpoint, ok, nil
+}
+
+// encodeCheckpoint serializes a checkpoint in the format of the checkpoint file.
+//
+// Parameters:
+//   - checkpoint: The checkpoint to serialize.
+//
+// Returns:
+//   - A slice of bytes with the content of the checkpoint file.
+func encodeCheckpoint(checkpoint Checkpoint) []byte {
+	var data []byte
+	data = utils.AppendBytesToSlice(data, utils.Uint64ToBytes(checkpoint.LSN))
+	data = utils.AppendBytesToSlice(data, utils.Uint64ToBytes(uint64(checkpoint.Offset)))
+	data = utils.AppendBytesToSlice(data, utils.Uint32ToBytes(uint32(len(checkpoint.Segment))))
+	data = utils.AppendBytesToSlice(data, []byte(checkpoint.Segment))
+	data = utils.AppendBytesToSlice(data, utils.Uint32ToBytes(uint32(len(checkpoint.Metadata))))
+	data = utils.AppendBytesToSlice(data, checkpoint.Metadata)
+	data = utils.AppendBytesToSlice(data, utils.Uint32ToBytes(utils.CalculateCRC(data)))
+	return data
+}
+
+// decodeCheckpoint parses the content of the checkpoint file and validates its CRC.
+//
+// Parameters:
+//   - data: The content of the checkpoint file.
+//
+// Returns:
+//   - The checkpoint stored.
+//   - false if the content is empty, truncated or corrupted.
+func decodeCheckpoint(data []byte) (Checkpoint, bool) {
+	// LSN, offset, both lengths and CRC
+	if len(data) < 28 {
+		return Checkpoint{}, false
+	}
+	content := data[:len(data)-4]
+	if utils.BytesToUint32(data[len(data)-4:]) != utils.CalculateCRC(content) {
+		return Checkpoint{}, false
+	}
+
+	checkpoint := Checkpoint{
+		LSN:    utils.BytesToUint64(content[0:8]),
+		Offset: int64(utils.BytesToUint64(content[8:16])),
+	}
+
+	segmentLength := int(utils.BytesToUint32(content[16:20]))
+	if segmentLength > len(content)-24 {
+		return Checkpoint{}, false
+	}
+	checkpoint.Segment = string(content[20 : 20+segmentLength])
+
+	content = content[20+segmentLength:]
+	metadataLength := int(utils.BytesToUint32(content[0:4]))
+	if metadataLength != len(content)-4 {
+		return Checkpoint{}, false
+	}
+	checkpoint.Metadata = content[4:]
+
+	return checkpoint, true
+}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+func TestEncodeDecodeCheckpoint(t *testing.T) {
+	checkpoint := Checkpoint{
+		LSN:      1 << 40,
+		Segment:  "wal_003.log",
+		Offset:   4096,
+		Metadata: []byte("snapshot-42"),
+	}
+
+	data := encodeCheckpoint(checkpoint)
+	decoded, ok := decodeCheckpoint(data)
+	if !ok {
+		t.Fatalf("decodeCheckpoint() rejected a valid checkpoint")
+	}
+	if decoded.LSN != checkpoint.LSN || decoded.Segment != checkpoint.Segment ||
+		decoded.Offset != checkpoint.Offset || !bytes.Equal(decoded.Metadata, checkpoint.Metadata) {
+		t.Errorf("Expected checkpoint %v, got %v", checkpoint, decoded)
+	}
+
+	// Empty, truncated and corrupted content is rejected
+	corrupted := append([]byte{}, data...)
+	corrupted[3] ^= 0xff
+	for _, invalid := range [][]byte{nil, data[:len(data)-1], corrupted} {
+		if _, ok := decodeCheckpoint(invalid); ok {
+			t.Errorf("Expected decodeCheckpoint() to reject %v", invalid)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	// LSNs 1-4 are in the first segment, 5-8 in the second and 9-10 in the buffer
+	w, options := newTestWal(t, 10)
+	defer w.Close()
+
+	err := w.Checkpoint(6, []byte("snapshot"))
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+
+	checkpoint, ok, err := ReadCheckpoint(options)
+	if err != nil || !ok {
+		t.Fatalf("ReadCheckpoint() failed: %v, %v", ok, err)
+	}
+	if checkpoint.LSN != 6 || string(checkpoint.Metadata) != "snapshot" {
+		t.Errorf("Unexpected checkpoint %v", checkpoint)
+	}
+	if checkpoint.Offset != segmentHeaderSize+2*27 {
+		t.Errorf("Expected checkpoint offset %d, got %d", segmentHeaderSize+2*27, checkpoint.Offset)
+	}
+
+	// Recovery starts after the checkpoint
+	result, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(result) != 4 || result[0].LSN != 7 {
+		t.Fatalf("Expected LSNs 7 to 10, got %v", result)
+	}
+
+	// Older segments are not read anymore
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	err = os.WriteFile(paths[0], []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatalf("Error corrupting first segment: %v", err)
+	}
+	result, err = Recover(options)
+	if err != nil || len(result) != 4 {
+		t.Fatalf("Expected recovery to skip the first segment, got %v, %v", result, err)
+	}
+
+	// Rolling back entries covered by the checkpoint is not allowed
+	err = w.TruncateAfter(5)
+	if err == nil {
+		t.Errorf("Expected TruncateAfter() to fail below the checkpoint")
+	}
+
+	// A checkpoint on the last entry points to the end of the WAL
+	err = w.Checkpoint(10, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	result, err = Recover(options)
+	if err != nil || len(result) != 0 {
+		t.Fatalf("Expected nothing to recover, got %v, %v", result, err)
+	}
+
+	// LSNs not assigned yet cannot be checkpointed
+	err = w.Checkpoint(11, nil)
+	if err == nil {
+		t.Errorf("Expected Checkpoint() to fail beyond the last LSN")
+	}
+}
+
+func TestRecoverCorruptedCheckpoint(t *testing.T) {
+	w, options := newTestWal(t, 10)
+
+	err := w.Checkpoint(6, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// A corrupted checkpoint is ignored and everything is replayed
+	err = os.WriteFile(filepath.Join(options.FileHandlerOpts.DirName, fh.CheckpointFileName), []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatalf("Error corrupting checkpoint: %v", err)
+	}
+	result, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(result) != 10 {
+		t.Fatalf("Expected 10 entries, got %d", len(result))
+	}
+}
+
+func TestInitWalAfterCheckpoint(t *testing.T) {
+	w, options := newTestWal(t, 40)
+	err := w.Checkpoint(40, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// A new Wal starts from LSN 1 again, so the checkpoint would hide its entries
+	w, err = InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	defer w.Close()
+	_, hasCheckpoint, err := ReadCheckpoint(options)
+	if err != nil || hasCheckpoint {
+		t.Errorf("Expected no checkpoint, got %v, %v", hasCheckpoint, err)
+	}
+	for i := 0; i < 5; i++ {
+		_, err = w.WriteBuffer([]byte("0123456789"))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 5 {
+		t.Errorf("Expected 5 entries, got %d", len(entries))
+	}
+}
+
+func TestOpenWalFromCheckpoint(t *testing.T) {
+	w, options := newTestWal(t, 20)
+	err := w.Checkpoint(10, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	crash(w)
+
+	// Corrupt the first segment, which is before the checkpoint
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	data, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatalf("Error reading segment: %v", err)
+	}
+	data[segmentHeaderSize+recordHeaderSize] ^= 0xff
+	err = os.WriteFile(paths[0], data, 0644)
+	if err != nil {
+		t.Fatalf("Error corrupting segment: %v", err)
+	}
+
+	// The scan starts at the checkpoint, so it never reads the corrupted record
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	if w.lsn != 21 {
+		t.Errorf("Expected next LSN 21, got %d", w.lsn)
+	}
+	crash(w)
+
+	// Without a valid checkpoint, every segment is scanned again
+	err = os.WriteFile(filepath.Join(options.FileHandlerOpts.DirName, fh.CheckpointFileName), []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatalf("Error corrupting checkpoint: %v", err)
+	}
+	w, err = OpenWal(options)
+	if err == nil {
+		w.Close()
+		t.Fatalf("Expected OpenWal() to fail on the corrupted segment")
+	}
+}
@@ -2,59 +2,157 @@ package core
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	fh "github.com/casteloig/walrog/internal/file_handler"
-	utils "github.com/casteloig/walrog/internal/utils"
 )
 
 type WalOptions struct {
-	BufferSize      uint32 // Size of the buffer
-	SegmentSize     uint32 // Max size of the file. Must be multiple of BufferSize
-	FileHandlerOpts *fh.Options
+	BufferSize       uint32 // Size of the buffer
+	SegmentSize      uint32 // Max size of the file. Must be multiple of BufferSize
+	FileHandlerOpts  *fh.Options
+	OnRotate         func(RotationEvent) // Called after every segment rotation, if set. It must not use the Wal
+	SyncMode         SyncMode            // When the hot file is synced to disk
+	SyncInterval     time.Duration       // Max time between syncs in SyncInterval mode
+	RecoveryMode     RecoveryMode        // What recovery does with torn or corrupted records
+	OnCorruption     func(Corruption)    // Called for every part of a WAL file dropped by recovery, if set
+	ReadOnly         bool                // OpenWal neither locks nor modifies the Wal folder, and writes fail
+	Preallocate      bool                // New segments take SegmentSize bytes on disk from the start
+	RecycleSegments  int                 // Max segments removed by Truncate kept to be reused by rotations, 0 removes them
+	Retention        RetentionPolicy     // Limits of the old segments kept, none by default
+	OnRetentionError func(error)         // Called when retention fails after a rotation, if set. It must not use the Wal
+}
+
+// RotationEvent describes a rotation of the hot file to a new segment.
+type RotationEvent struct {
+	PreviousFile string // Path of the segment that was closed
+	NewFile      string // Path of the new hot file
+	FirstLSN     uint64 // LSN of the first entry that will be written to the new segment
 }
 
 var DefaultWalOptions = &WalOptions{
 	BufferSize:      4194304,  // 4Mb
 	SegmentSize:     67108864, // 64Mb
 	FileHandlerOpts: fh.DefaultOptions,
+	SyncMode:        SyncOnFlush,
 }
 
+// firstLSN is the LSN assigned to the first entry of an empty Wal.
+// LSN 0 is never assigned, so it can be used to mean "no entry".
+const firstLSN uint64 = 1
+
+// Wal is safe for concurrent use: every exported method holds mu while it runs,
+// so entries are written whole and get increasing LSNs in the order they are written.
 type Wal struct {
-	Options        *WalOptions
-	HotFile        *os.File // File that's being used
-	CheckpointFile *os.File
-	segmentUsed    int
-	Buffer         *bufio.Writer
-	lsn            uint32
+	mu          sync.Mutex
+	Options     *WalOptions
+	HotFile     fh.File // File that's being used
+	segmentUsed int
+	Buffer      *bufio.Writer
+	lsn         uint64 // LSN assigned to the next entry
+	lastSync    time.Time
+	unsynced    bool  // Entries were flushed to the hot file since it was last synced
+	staleEnd    int64 // End of the stale records left in the hot file by the segment it was recycled from
+	closed      bool
+	failed      error                // Why the Wal cannot be written anymore, returned by every later write
+	stopSyncer  chan struct{}        // Closed by Close to stop the background sync of SyncInterval, if running
+	flushed     chan struct{}        // Closed on the next flush, to wake up tail readers
+	lock        io.Closer            // Lock of the Wal folder, nil if read-only
+	readers     map[*Reader]struct{} // Tail readers, whose pins retention respects
 }
 
+// ErrClosed is returned when using a Wal after calling Close.
+var ErrClosed = errors.New("wal is closed")
+
+// ErrReadOnly is returned when writing to a Wal opened with WalOptions.ReadOnly.
+var ErrReadOnly = errors.New("wal is read-only")
+
+// ErrLocked is returned by InitWal and OpenWal when another Wal, in this or another process,
+// is writing to the same Wal folder.
+var ErrLocked = fh.ErrLocked
+
+// ErrLockUnsupported is returned by InitWal and OpenWal on platforms where the Wal folder cannot be locked.
+var ErrLockUnsupported = fh.ErrLockUnsupported
+
+// RecoveredEntry is a record read back from a WAL file.
 type RecoveredEntry struct {
-	lsn  uint32
-	data []byte
+	LSN  uint64
+	Data []byte
+
+	recordType     byte // Record type without flags, the entry may be a fragment
+	batchContinues bool // More entries of the same batch follow this one
 }
 
 // InitWal creates a new Wal instance.
 // If a nil argument is passed, it will use the default options.
 // Always use InitWal after calling Recover and ensure everything is recovered.
-// InitWal will delete all content in the Wal folder.
+// InitWal will delete every WAL file in the Wal folder, along with the low-water mark left by Truncate
+// and the last checkpoint.
 //
 // Parameters:
 //   - options: A pointer to WalOptions containing the configuration for the WAL.
 //
 // Returns:
 //   - A pointer to the initialized Wal instance.
-//   - An error if the initialization fails, or nil if successful.
+//   - ErrLocked if another Wal is writing to the Wal folder, or an error if the initialization fails.
 func InitWal(options *WalOptions) (*Wal, error) {
 	// Get default options if no arg passed to function
 	if options == nil {
 		options = DefaultWalOptions
 	}
+	if options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	return lockWal(options, initWal)
+}
+
+// initWal implements InitWal, once the Wal folder is locked.
+func initWal(options *WalOptions) (*Wal, error) {
+	// Segments left by a previous Wal would be read back as part of this one
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		return nil, err
+	}
+	// and recycled ones hold records with LSNs this one will assign again
+	recycled, err := fh.ListRecycledFiles(*options.FileHandlerOpts)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range append(paths, recycled...) {
+		err = fh.RemoveWalFile(*options.FileHandlerOpts, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A marker left by a previous Wal does not describe this one,
+	// and its low-water mark and checkpoint would hide the entries of this one
+	stale := []string{cleanShutdownFile, lowWaterMarkFile, lowWaterMarkFile + ".tmp",
+		fh.CheckpointFileName, fh.CheckpointFileName + ".tmp"}
+	for _, name := range stale {
+		err = fh.RemoveFile(*options.FileHandlerOpts, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	walFile, err := fh.OpenWal(options.FileHandlerOpts, firstLSN)
+	if err != nil {
+		return nil, err
+	}
 
-	walFile, checkpointFile, err := fh.OpenWal(options.FileHandlerOpts)
+	err = writeSegmentHeader(walFile)
+	if err == nil {
+		err = preallocateSegment(options, walFile)
+	}
 	if err != nil {
+		walFile.Close()
 		return nil, err
 	}
 
@@ -63,127 +161,708 @@ func InitWal(options *WalOptions) (*Wal, error) {
 
 	// Create Wal and return
 	w := &Wal{
-		Options:        options,
-		HotFile:        walFile,
-		CheckpointFile: checkpointFile,
-		Buffer:         writerBuffer,
-		segmentUsed:    0,
-		lsn:            0,
+		Options:     options,
+		HotFile:     walFile,
+		Buffer:      writerBuffer,
+		segmentUsed: segmentHeaderSize,
+		lsn:         firstLSN,
 	}
 
 	return w, nil
 }
 
-// WriteBuffer writes a slice of bytes to the WAL.
-// It first writes to a buffer, which will be dumped into a file when reaching WalOptions.BufferSize.
+// OpenWal opens the Wal stored in the Wal folder and resumes appending to it.
+// If a nil argument is passed, it will use the default options.
+// Unlike InitWal, the existing WAL files are kept: the last one becomes the hot file again,
+// and any torn entry at its tail (e.g. a write interrupted by a crash) is truncated.
+// If the Wal was closed cleanly with Close, the segments are not scanned at all,
+// and otherwise the scan starts at the last checkpoint.
+// If the Wal folder has no WAL files yet, it behaves like InitWal.
+// The Wal folder is locked until Close, so no other Wal can write to it meanwhile.
+// With WalOptions.ReadOnly, the Wal folder is neither locked nor modified, and every write fails.
 //
 // Parameters:
-//   - data: A slice of bytes to be written to the WAL.
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
 //
 // Returns:
-//   - An error if the write operation fails.
-func (w *Wal) WriteBuffer(data []byte) error {
+//   - A pointer to the opened Wal instance.
+//   - ErrLocked if another Wal is writing to the Wal folder,
+//     or an error if any WAL file is corrupted or cannot be opened.
+func OpenWal(options *WalOptions) (*Wal, error) {
+	// Get default options if no arg passed to function
+	if options == nil {
+		options = DefaultWalOptions
+	}
+	if options.ReadOnly {
+		return openReadOnly(options), nil
+	}
 
-	// create temp buffer before flushing any data
-	tmpBuffer, err := w.createTmpBuff(data)
+	return lockWal(options, openWal)
+}
+
+// openWal implements OpenWal, once the Wal folder is locked.
+func openWal(options *WalOptions) (*Wal, error) {
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return initWal(options)
 	}
 
-	// Checks either buffer can be written, must be flushed or the hot file must be rotated first
-	err = w.manageWriteFlow(tmpBuffer)
+	// A clean shutdown leaves the state needed to resume, so the segments do not need to be scanned.
+	// Otherwise, scan the WAL files from the last checkpoint to find the last LSN written.
+	hotSegment := len(paths) - 1
+	nextLSN, validOffset, err := resumeFromShutdownMarker(*options.FileHandlerOpts, paths[hotSegment])
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if validOffset < 0 {
+		nextLSN, hotSegment, validOffset, err = scanWalFiles(options, paths)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
+	// Files only holding a torn batch are removed, from the newest
+	for i := len(paths) - 1; i > hotSegment; i-- {
+		err = fh.RemoveWalFile(*options.FileHandlerOpts, paths[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Truncate may have deleted every entry, but their LSNs must not be reused
+	lowWaterMark, err := readLowWaterMark(*options.FileHandlerOpts)
+	if err != nil {
+		return nil, err
+	}
+	nextLSN = max(nextLSN, lowWaterMark)
+
+	// Reopen the last file as hot file, dropping the torn tail
+	hotFile, err := fh.OpenWalFile(*options.FileHandlerOpts, paths[hotSegment])
+	if err != nil {
+		return nil, err
+	}
+	hotFile, validOffset, err = resumeHotFile(options, hotFile, validOffset, nextLSN)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Wal{
+		Options:     options,
+		HotFile:     hotFile,
+		Buffer:      bufio.NewWriterSize(hotFile, int(options.BufferSize)),
+		segmentUsed: int(validOffset),
+		lsn:         nextLSN,
+	}
+
+	return w, nil
 }
 
-// recoverFile reads entries from a given file and validates their integrity using CRC.
-// If the CRC matches, the entry is stored in a slice of RecoveredEntry.
+// lockWal locks the Wal folder, creating it if needed, and opens the Wal with fn.
+// The lock is kept by the Wal until Close, or released right away if fn fails.
 //
 // Parameters:
-//   - file: A pointer to the file to be recovered.
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
+//   - fn: The function opening the Wal.
 //
 // Returns:
-//   - A slice of RecoveredEntry containing the valid entries.
-//   - An error if any issues occur during recovery.
-func recoverFile(file *os.File) ([]RecoveredEntry, error) {
-	var records []RecoveredEntry
+//   - A pointer to the Wal, holding the lock.
+//   - ErrLocked if another Wal holds the lock, or the error of fn.
+func lockWal(options *WalOptions, fn func(*WalOptions) (*Wal, error)) (*Wal, error) {
+	err := fh.CreateWalFolder(*options.FileHandlerOpts)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := fh.LockDir(*options.FileHandlerOpts)
+	if err != nil {
+		return nil, err
+	}
 
-	reader := bufio.NewReader(file)
-	lsnBytes := make([]byte, 4)
-	lengthBytes := make([]byte, 4)
-	crcBytes := make([]byte, 4)
+	w, err := fn(options)
+	if err != nil {
+		fh.UnlockDir(lock)
+		return nil, err
+	}
+	w.lock = lock
+	w.startSyncer()
+	return w, nil
+}
 
-	for {
-		// Read 4 bytes of LSN
-		_, err := reader.Read(lsnBytes)
+// openReadOnly opens the Wal stored in the Wal folder without locking or modifying it,
+// so it works while another Wal is writing to it. Every write returns ErrReadOnly, so
+// the segments are not scanned: Readers report any invalid record as they read it.
+//
+// Parameters:
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
+//
+// Returns:
+//   - A pointer to the read-only Wal.
+func openReadOnly(options *WalOptions) *Wal {
+	return &Wal{Options: options}
+}
+
+// writable checks that the Wal can be written to. The caller must hold mu.
+//
+// Returns:
+//   - ErrClosed if the Wal is closed, ErrReadOnly if it was opened read-only,
+//     or the error that failed the Wal (see fail).
+func (w *Wal) writable() error {
+	if w.closed {
+		return ErrClosed
+	}
+	if w.Options.ReadOnly {
+		return ErrReadOnly
+	}
+	return w.failed
+}
+
+// fail stops the Wal from being written after an error that left its files in a state
+// later writes cannot build on, e.g. with part of a batch written. Every later write, flush
+// or sync returns err, and Close only releases the files. The caller must hold mu.
+//
+// Parameters:
+//   - err: The error.
+//
+// Returns:
+//   - err, to be returned by the caller.
+func (w *Wal) fail(err error) error {
+	if w.failed == nil {
+		w.failed = err
+	}
+	return err
+}
+
+// resumeFromShutdownMarker returns the state stored by Close if the Wal was closed cleanly
+// and the last WAL file has not changed since then.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name.
+//   - hotPath: The full path to the last WAL file.
+//
+// Returns:
+//   - The LSN assigned to the next entry.
+//   - The offset where the last entry of the hot file ends, or -1 if the segments must be scanned.
+//   - An error if the marker cannot be read.
+func resumeFromShutdownMarker(opts fh.Options, hotPath string) (uint64, int64, error) {
+	marker, clean, err := consumeShutdownMarker(opts)
+	if err != nil || !clean {
+		return 0, -1, err
+	}
+
+	info, err := fh.StatFile(opts, hotPath)
+	if err != nil || !marker.matchesHotFile(hotPath, info.Size()) {
+		return 0, -1, nil
+	}
+	return marker.nextLSN, marker.hotSize, nil
+}
+
+// scanWalFiles reads the WAL files to find where the Wal must resume, from the last checkpoint
+// if there is a valid one (see checkpointStart), or from the first WAL file otherwise.
+// What happens with invalid records depends on WalOptions.RecoveryMode: by default only
+// the last file may have a torn tail, and errors in older files are real corruption.
+// The bytes dropped are reported to WalOptions.OnCorruption.
+// A batch or a fragmented entry left incomplete by a crash is discarded, so the Wal resumes
+// where it started, which may be in an older file if it spans several files.
+//
+// Parameters:
+//   - options: A pointer to WalOptions with the recovery mode.
+//   - paths: The paths of the WAL files, in creation order.
+//
+// Returns:
+//   - The LSN assigned to the next entry.
+//   - The index in paths of the file where the Wal resumes. Later files must be removed.
+//   - The offset in that file where the last valid entry ends.
+//   - An error if an invalid record cannot be dropped in the recovery mode, or a file cannot be opened.
+func scanWalFiles(options *WalOptions, paths []string) (uint64, int, int64, error) {
+	start, from, nextLSN, err := checkpointStart(options, paths)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var validOffset int64
+	hotSegment := len(paths) - 1
+
+	// Start of the batch or fragmented entry being read, if any
+	inBatch := false
+	var batchLSN uint64
+	var batchSegment int
+	var batchOffset int64
+
+	// With RecoverSkip, scanFile reports the invalid records it skips
+	var skip func(Corruption)
+	if options.RecoveryMode == RecoverSkip {
+		skip = options.reportCorruption
+	}
+
+	for i := start; i < len(paths); i++ {
+		p := paths[i]
+		file, err := fh.OpenFile(*options.FileHandlerOpts, p)
 		if err != nil {
-			if err == io.EOF {
-				fmt.Println("Reached end of file")
-				break
+			return 0, 0, 0, fmt.Errorf("failed to open WAL file: %w", err)
+		}
+		if i > start {
+			from = 0
+		}
+		validOffset, err = scanFile(file, from, skip, func(entry RecoveredEntry, offset int64) error {
+			if !inBatch {
+				batchLSN, batchSegment, batchOffset = entry.LSN, i, offset
 			}
-			return nil, fmt.Errorf("error reading LSN: %w", err)
+			inBatch = !entry.completesEntry()
+			if !inBatch {
+				nextLSN = entry.LSN + 1
+			}
+			return nil
+		})
+		var size int64
+		if info, statErr := file.Stat(); statErr == nil {
+			size = info.Size()
+		}
+		file.Close()
+		if err == nil {
+			continue
+		}
+
+		last := i == len(paths)-1
+		mode := options.RecoveryMode
+		if !invalidRecord(err) || mode == RecoverFail || (mode == RecoverTruncateTail && !last) {
+			return 0, 0, 0, fmt.Errorf("failed to recover %s: %w", filepath.Base(p), err)
+		}
+
+		// Resume right before the invalid record, dropping everything after it
+		options.reportCorruption(Corruption{Segment: filepath.Base(p), Offset: validOffset, Size: size - validOffset, Err: err})
+		err = options.reportLater(paths[i+1:])
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		hotSegment = i
+		break
+	}
+
+	if inBatch {
+		return batchLSN, batchSegment, batchOffset, nil
+	}
+	return nextLSN, hotSegment, validOffset, nil
+}
+
+// checkpointStart finds where scanWalFiles can start scanning: right after the last checkpoint,
+// whose entries were synced before it was written, so nothing before it needs to be scanned.
+// A checkpoint whose segment is gone (e.g. removed by Truncate) or shorter than its offset
+// is not valid, and the scan starts from the first WAL file then.
+//
+// Parameters:
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
+//   - paths: The paths of the WAL files, in creation order.
+//
+// Returns:
+//   - The index in paths of the file to start from.
+//   - The offset in that file to start from, 0 to scan the whole file.
+//   - The LSN assigned to the next entry if no entry is found from there.
+//   - An error if the checkpoint or the size of its segment cannot be read.
+func checkpointStart(options *WalOptions, paths []string) (int, int64, uint64, error) {
+	checkpoint, hasCheckpoint, err := ReadCheckpoint(options)
+	if err != nil || !hasCheckpoint {
+		return 0, 0, firstLSN, err
+	}
+
+	for i, p := range paths {
+		if filepath.Base(p) != checkpoint.Segment {
+			continue
+		}
+		info, err := fh.StatFile(*options.FileHandlerOpts, p)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("failed to read WAL file size: %w", err)
+		}
+		if info.Size() < checkpoint.Offset {
+			break
+		}
+		return i, checkpoint.Offset, checkpoint.LSN + 1, nil
+	}
+	return 0, 0, firstLSN, nil
+}
+
+// resumeHotFile prepares the last WAL file found in the Wal folder to keep appending to it.
+// Anything after validOffset is a torn tail and is truncated. If the file has no valid header,
+// it is started again from scratch, and if it was written with an older format version,
+// a new WAL file is created instead, since records of different versions cannot be mixed.
+// So is a file without any valid record named after an LSN higher than nextLSN, e.g. because
+// a crash lost the tail of the previous segment, since no record in it can be below its name.
+// With WalOptions.Preallocate, the hot file is preallocated again after truncating it.
+// The file passed is closed if another one is returned, or if an error happens.
+//
+// Parameters:
+//   - options: A pointer to WalOptions used to create a new WAL file if needed.
+//   - file: The last WAL file.
+//   - validOffset: The offset where the last valid entry of the file ends.
+//   - nextLSN: The LSN of the next entry, the first one of the new WAL file if one is created.
+//
+// Returns:
+//   - The hot file, positioned where the next entry must be written.
+//   - The number of bytes used in the hot file.
+//   - An error if the file cannot be prepared.
+func resumeHotFile(options *WalOptions, file fh.File, validOffset int64, nextLSN uint64) (fh.File, int64, error) {
+	opts := *options.FileHandlerOpts
+
+	if validOffset <= segmentHeaderSize && segmentFirstLSN(file) > nextLSN {
+		file.Close()
+		err := fh.RemoveWalFile(opts, file.Name())
+		if err != nil {
+			return nil, 0, err
+		}
+		return newHotFile(options, nextLSN)
+	}
+
+	version, _, err := readSegmentHeader(bufio.NewReader(file))
+	if err != nil || validOffset == 0 {
+		// Torn header, or a file without anything valid
+		err = writeSegmentHeader(file)
+		if err == nil {
+			err = preallocateSegment(options, file)
+		}
+		if err != nil {
+			file.Close()
+			return nil, 0, err
 		}
+		return file, segmentHeaderSize, nil
+	}
+
+	err = file.Truncate(validOffset)
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to truncate torn tail: %w", err)
+	}
+
+	if version != formatVersionLatest {
+		file.Close()
+		return newHotFile(options, nextLSN)
+	}
+
+	err = preallocateSegment(options, file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	_, err = file.Seek(validOffset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to seek hot file: %w", err)
+	}
+	return file, validOffset, nil
+}
+
+// newHotFile creates a new WAL file for resumeHotFile, never a recycled one, since the hot file
+// it returns must not hold anything after validOffset.
+//
+// Parameters:
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
+//   - nextLSN: The LSN of the first entry of the new WAL file.
+//
+// Returns:
+//   - The new hot file, positioned where the next entry must be written.
+//   - The number of bytes used in the hot file.
+//   - An error if the file cannot be created.
+func newHotFile(options *WalOptions, nextLSN uint64) (fh.File, int64, error) {
+	file, err := fh.CreateWalNewFile(*options.FileHandlerOpts, nextLSN)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = writeSegmentHeader(file)
+	if err == nil {
+		err = preallocateSegment(options, file)
+	}
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, segmentHeaderSize, nil
+}
+
+// WriteBuffer writes a slice of bytes to the WAL.
+// It first writes to a buffer, which will be dumped into a file when reaching WalOptions.BufferSize.
+// Entries bigger than the buffer are split in fragments, joined back on recovery.
+// Every entry is assigned an LSN one higher than the previous one, starting at 1.
+// With SyncOnWrite the entry is flushed and synced before returning, and with SyncInterval
+// the buffer is flushed and synced if the interval has elapsed. Otherwise, the entry is not
+// durable until a later flush (see SyncMode).
+//
+// Parameters:
+//   - data: A slice of bytes to be written to the WAL.
+//
+// Returns:
+//   - The LSN assigned to the entry.
+//   - An error if the write operation fails. The LSN is not consumed unless the entry
+//     was already buffered, even partially.
+func (w *Wal) WriteBuffer(data []byte) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writeBuffer(data)
+}
+
+// writeBuffer implements WriteBuffer. The caller must hold mu.
+func (w *Wal) writeBuffer(data []byte) (uint64, error) {
+	err := w.writable()
+	if err != nil {
+		return 0, err
+	}
+
+	// create temp buffers before flushing any data.
+	// An entry bigger than the buffer is split in several records
+	records, err := w.encodeEntry(w.lsn, 0, data)
+	if err != nil {
+		return 0, err
+	}
 
-		// Read lengthData
-		_, err = reader.Read(lengthBytes)
+	// Checks either buffer can be written, must be flushed or the hot file must be rotated first
+	lsn := w.lsn
+	for i, tmpBuffer := range records {
+		err = w.manageWriteFlow(tmpBuffer)
 		if err != nil {
-			return nil, fmt.Errorf("error reading data length: %w", err)
+			if i == 0 {
+				return 0, err
+			}
+			// Some fragments are buffered, so the LSN cannot be reused
+			w.lsn++
+			return lsn, err
 		}
-		dataLength := utils.BytesToUint32(lengthBytes)
+	}
 
-		// Read data
-		dataBytes := make([]byte, dataLength)
-		_, err = reader.Read(dataBytes)
+	// The entry is in the buffer, so its LSN is taken
+	w.lsn++
+
+	if w.Options.SyncMode == SyncOnWrite || w.syncIntervalElapsed() {
+		err = w.flushBuffer()
 		if err != nil {
-			return nil, fmt.Errorf("error reading data: %w", err)
+			return lsn, err
 		}
+	}
+
+	return lsn, nil
+}
 
-		// Read 4 bytes of CRC
-		_, err = reader.Read(crcBytes)
+// scanFile reads the records of a given file and validates their integrity using CRC.
+// Every valid record is passed to fn as it is read, fragments included, along with the offset where it starts.
+// If skip is set, invalid records are skipped and reported to it instead of stopping the scan.
+//
+// Parameters:
+//   - file: A pointer to the file to be scanned.
+//   - from: The offset where an entry starts to scan from. 0 scans the whole file.
+//   - skip: A function called for every invalid record skipped, or nil to stop at the first one.
+//   - fn: A function called for every valid entry and its offset. Returning an error stops the scan.
+//
+// Returns:
+//   - The offset where the last valid entry ends, even if an error is returned.
+//   - An error if any issues occur during the scan or fn fails.
+func scanFile(file fh.File, from int64, skip func(Corruption), fn func(RecoveredEntry, int64) error) (int64, error) {
+	reader := bufio.NewReader(file)
+
+	// Legacy files have no header, and their records a different layout
+	version, headerSize, err := readSegmentHeader(reader)
+	if err != nil {
+		return 0, err
+	}
+	validOffset := int64(headerSize)
+	offset := validOffset
+	firstLSN := segmentFirstLSN(file)
+
+	// Skip the entries before from
+	if from > offset {
+		_, err = file.Seek(from, io.SeekStart)
 		if err != nil {
-			return nil, fmt.Errorf("error reading CRC: %w", err)
+			return validOffset, fmt.Errorf("failed to seek WAL file: %w", err)
 		}
-		crcData := utils.BytesToUint32(crcBytes)
+		reader.Reset(file)
+		validOffset, offset = from, from
+	}
 
-		// Calculate CRC of LSN, lengthData and data
-		dataWithoutCRC := append(lsnBytes, lengthBytes...)
-		dataWithoutCRC = append(dataWithoutCRC, dataBytes...)
-		calculatedCRC := utils.CalculateCRC(dataWithoutCRC)
+	for {
+		newRecord, recordSize, err := readRecord(reader, version)
+		if err == nil && newRecord.LSN < firstLSN {
+			// Stale record of the segment the file was recycled from
+			err = io.EOF
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if skip == nil || !invalidRecord(err) {
+				return validOffset, err
+			}
 
-		// Compare CRC bytes
-		if crcData != calculatedCRC {
-			return nil, fmt.Errorf("CRC mismatch: read %v, calculated %v", crcData, calculatedCRC)
+			// Go on from the next valid record, if any
+			next, found, findErr := findNextRecord(file, version, offset+1)
+			if findErr != nil {
+				return validOffset, findErr
+			}
+			skip(Corruption{Segment: filepath.Base(file.Name()), Offset: offset, Size: next - offset, Err: err})
+			if !found {
+				break
+			}
+			_, err = file.Seek(next, io.SeekStart)
+			if err != nil {
+				return validOffset, fmt.Errorf("failed to seek WAL file: %w", err)
+			}
+			reader.Reset(file)
+			offset = next
+			continue
 		}
 
-		// Store data in the slice
-		newRecord := RecoveredEntry{
-			lsn:  utils.BytesToUint32(lsnBytes),
-			data: dataBytes,
+		// Hand the entry to the caller
+		err = fn(newRecord, offset)
+		if err != nil {
+			return validOffset, err
 		}
+		offset += int64(recordSize)
+		validOffset = offset
+	}
+
+	return validOffset, nil
+}
 
-		records = append(records, newRecord)
+// Recover reads every WAL file found in the WAL folder and returns their valid entries.
+// Files are replayed in the order they were created.
+// If a nil argument is passed, it will use the default options.
+//
+// Parameters:
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
+//
+// Returns:
+//   - A slice of RecoveredEntry containing the valid entries of all WAL files.
+//   - An error if any issues occur during recovery.
+func Recover(options *WalOptions) ([]RecoveredEntry, error) {
+	var records []RecoveredEntry
+
+	err := RecoverFunc(options, func(entry RecoveredEntry) error {
+		records = append(records, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return records, nil
 }
 
+// RecoverFunc reads every WAL file found in the WAL folder and passes their valid entries to fn.
+// Files are replayed in the order they were created, so entries are never held in memory.
+// Entries discarded by Truncate or covered by the last checkpoint are skipped,
+// and replay starts directly at the position stored in the checkpoint.
+// An entry torn at the end of the last file is ignored, since it may still be written by a running Wal,
+// and so are the entries of a batch that was not written whole.
+// Other invalid records are handled as set by WalOptions.RecoveryMode.
+// If a nil argument is passed, it will use the default options.
+//
+// Parameters:
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
+//   - fn: A function called for every valid entry. Returning an error stops the recovery.
+//
+// Returns:
+//   - An error if any issues occur during recovery or fn fails.
+func RecoverFunc(options *WalOptions, fn func(RecoveredEntry) error) error {
+	r, err := NewReader(options)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		entry := r.Entry()
+		err = fn(entry)
+		if err != nil {
+			return fmt.Errorf("failed to recover LSN %d: %w", entry.LSN, err)
+		}
+	}
+	return r.Err()
+}
+
 // FlushBuffer forces a flush of the buffer to the segment/WAL file.
+// The hot file is then synced to disk with SyncOnFlush and SyncOnWrite, and with SyncInterval
+// if the interval has elapsed. With SyncNever, flushed entries are only in the OS page cache.
 //
 // Returns:
-//   - An error if the flush operation fails.
+//   - An error if the flush or sync operation fails.
 func (w *Wal) FlushBuffer() error {
-	fmt.Println("Flushing buffer to file")
-	w.segmentUsed += w.Buffer.Buffered()
-	err := w.Buffer.Flush()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushBuffer()
+}
+
+// flushBuffer implements FlushBuffer. The caller must hold mu.
+func (w *Wal) flushBuffer() error {
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	flushed, err := w.flush()
 	if err != nil {
-		return fmt.Errorf("error flushing to file")
+		return err
+	}
+
+	switch w.Options.SyncMode {
+	case SyncOnFlush, SyncOnWrite:
+		// Everything flushed before was already synced
+		if flushed > 0 {
+			return w.syncHotFile()
+		}
+	case SyncInterval:
+		if w.syncIntervalElapsed() {
+			return w.syncHotFile()
+		}
 	}
 	return nil
 }
 
+// Sync flushes the buffer and syncs the hot file to disk, whatever the SyncMode.
+// Every entry written before calling Sync is durable once it returns.
+//
+// Returns:
+//   - An error if the flush or sync operation fails.
+func (w *Wal) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushAndSync()
+}
+
+// flushAndSync implements Sync. The caller must hold mu.
+func (w *Wal) flushAndSync() error {
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	_, err = w.flush()
+	if err != nil {
+		return err
+	}
+	return w.syncHotFile()
+}
+
+// flush dumps the buffer into the hot file, without syncing it.
+// If the hot file cannot be written, part of the buffer may be in it, so the Wal fails.
+//
+// Returns:
+//   - The number of bytes flushed.
+//   - An error if the flush operation fails.
+func (w *Wal) flush() (int, error) {
+	flushed := w.Buffer.Buffered()
+	if flushed == 0 {
+		return 0, nil
+	}
+	end := int64(w.segmentUsed + flushed)
+	if end < w.staleEnd {
+		err := w.writeEndMarker(end)
+		if err != nil {
+			return 0, w.fail(err)
+		}
+	}
+	w.segmentUsed += flushed
+	err := w.Buffer.Flush()
+	if err != nil {
+		return 0, w.fail(fmt.Errorf("error flushing to file: %w", err))
+	}
+	w.unsynced = true
+	w.notifyFlush()
+	return flushed, nil
+}
+
 // checkBufferOverflow checks if the new data fits within the buffer.
 //
 // Parameters:
@@ -197,51 +876,74 @@ func (w *Wal) checkBufferOverflow(newEntryLength int) bool {
 	return (w.Buffer.Buffered() + newEntryLength) > int(w.Options.BufferSize)
 }
 
-// changeHotFile creates a new file/segment and updates the WAL's pointer to the new file.
-//
-// Parameters:
-//   - newFile: A pointer to the new file to be used as the hot file.
-//
-// Returns:
-//   - An error if the operation fails.
-func (w *Wal) changeHotFile(newFile *os.File) error {
-	w.HotFile = newFile
-	return nil
-}
-
-// createTmpBuff creates a temporary buffer before writing to Bufio with all the data.
-//
-// Parameters:
-//   - data: A slice of bytes to be written to the temporary buffer.
+// rotate closes the hot file and continues writing into a new segment.
+// The buffer is flushed and the old segment synced to disk before closing it (unless in SyncNever mode),
+// so no entry is lost or left behind in the buffer. The old segment is trimmed right after its last
+// record first, and the new one may be a segment recycled by Truncate (see createSegment).
+// The old segment is only closed once the new one is created, so the Wal keeps writing to it
+// if the new one cannot be. If the old segment cannot be closed, the Wal fails (see fail).
 //
 // Returns:
-//   - A slice of bytes representing the temporary buffer.
-//   - An error if the operation fails.
-func (w *Wal) createTmpBuff(data []byte) ([]byte, error) {
-	var tmpBuffer []byte
+//   - An error if the old segment cannot be closed or the new one created.
+func (w *Wal) rotate() error {
+	err := w.flushBuffer()
+	if err != nil {
+		return err
+	}
 
-	// First we add the LSN (4 bytes) to the buffer
-	// in []byte
-	newBytes := utils.Uint32ToBytes(w.lsn)
-	tmpBuffer = utils.AppendBytesToSlice(tmpBuffer, newBytes)
+	var previousFile string
+	if w.HotFile != nil {
+		previousFile = w.HotFile.Name()
+		err = w.trimHotFile()
+		if err != nil {
+			return err
+		}
+		if w.Options.SyncMode != SyncNever {
+			err = w.syncHotFile()
+			if err != nil {
+				return err
+			}
+		}
+	}
 
-	// Then add data length (4 bytes)
-	dataLength, err := utils.IntToUint32(len(data))
+	newFile, staleEnd, err := createSegment(w.Options, w.lsn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to convert data length to uint32: %w", err)
+		return err
+	}
+
+	if w.HotFile != nil {
+		err = w.HotFile.Close()
+		if err != nil {
+			newFile.Close()
+			w.HotFile = nil
+			return w.fail(fmt.Errorf("failed to close segment: %w", err))
+		}
 	}
-	newBytes = utils.Uint32ToBytes(dataLength)
-	tmpBuffer = utils.AppendBytesToSlice(tmpBuffer, newBytes)
 
-	// Then add data (get length from content of dataLengthBytes)
-	tmpBuffer = utils.AppendBytesToSlice(tmpBuffer, data)
+	// Bind the buffer to the new segment and reset accounting
+	w.HotFile = newFile
+	w.Buffer.Reset(newFile)
+	w.segmentUsed = segmentHeaderSize
+	w.staleEnd = staleEnd
 
-	// Calculate CRC and add it to the tmpBuffer
-	crc := utils.CalculateCRC(tmpBuffer)
-	newBytes = utils.Uint32ToBytes(crc)
-	tmpBuffer = utils.AppendBytesToSlice(tmpBuffer, newBytes)
+	if w.Options.OnRotate != nil {
+		w.Options.OnRotate(RotationEvent{
+			PreviousFile: previousFile,
+			NewFile:      newFile.Name(),
+			FirstLSN:     w.lsn,
+		})
+	}
 
-	return tmpBuffer, nil
+	// Old segments may be discarded now that one more is full. Unless that fails the Wal,
+	// an error is only reported: the new segment is ready, so the write goes ahead
+	err = w.enforceRetention()
+	if err != nil && w.failed == nil {
+		if w.Options.OnRetentionError != nil {
+			w.Options.OnRetentionError(err)
+		}
+		return nil
+	}
+	return err
 }
 
 // manageWriteFlow manages the process of writing data into the buffer and flushing it to the hot file if needed.
@@ -257,55 +959,119 @@ func (w *Wal) manageWriteFlow(tmpBuffer []byte) error {
 		return fmt.Errorf("data is bigger than buffer, data cannot be handled")
 	}
 
-	// Check if tmpBuffer fits real Buffer
-	// If it fits (no overflow), enter the condition and Write
-	if !w.checkBufferOverflow(len(tmpBuffer)) {
-		w.Buffer.Write(tmpBuffer)
-		return nil
+	// If tmpBuffer does not fit in what is left of the segment, we have to Rotate the new file first.
+	// An empty segment is never rotated, so it always takes at least one entry.
+	segmentEnd := w.segmentUsed + w.Buffer.Buffered()
+	if segmentEnd > segmentHeaderSize && segmentEnd+len(tmpBuffer) > int(w.Options.SegmentSize) {
+		err := w.rotate()
+		if err != nil {
+			return err
+		}
 	}
 
-	// If buffer can be flushed into file
-	// Flush and write
-	if w.Buffer.Buffered() < (int(w.Options.SegmentSize) - w.segmentUsed) {
-		err := w.FlushBuffer()
+	// If tmpBuffer does not fit real Buffer, flush it first
+	if w.checkBufferOverflow(len(tmpBuffer)) {
+		err := w.flushBuffer()
 		if err != nil {
 			return err
 		}
-		w.Buffer.Write(tmpBuffer)
+	}
+
+	_, err := w.Buffer.Write(tmpBuffer)
+	if err != nil {
+		return fmt.Errorf("error writing to buffer: %w", err)
+	}
+
+	return nil
+}
+
+// Close flushes the buffer, trims the hot file right after its last record, syncs it and closes it.
+// A clean shutdown marker is written before closing, so the next OpenWal can resume
+// without scanning the segments, and the lock of the Wal folder is released.
+// The files are closed and the lock released even if the flush or the sync fail,
+// so the Wal folder can be opened again, but no marker is written then.
+// So it is for a Wal failed by a previous error, which is returned again.
+// Calling Close more than once does nothing.
+// The Wal must not be used after calling Close: writes and flushes return ErrClosed.
+//
+// Returns:
+//   - An error if the flush, the sync or any of the close operations fail.
+func (w *Wal) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	if w.Options.ReadOnly {
+		w.closed = true
+		w.notifyFlush()
 		return nil
 	}
 
-	// If buffer cannot be flushed into file, we have to Rotate the new file
-	// Rotate, flush and write
-	newFile, err := fh.CreateWalNewFile(*w.Options.FileHandlerOpts)
+	// A failed Wal may hold anything after its last entry, so it is scanned on the next OpenWal
+	err := w.failed
+	if err == nil {
+		err = w.shutdown()
+	}
+
+	w.closed = true
+	w.notifyFlush()
+	if w.stopSyncer != nil {
+		close(w.stopSyncer)
+	}
+
+	return errors.Join(err, w.release())
+}
+
+// shutdown flushes the buffer, trims and syncs the hot file, and writes the clean shutdown marker.
+// The caller must hold mu.
+//
+// Returns:
+//   - An error if the flush, the sync or the marker fail.
+func (w *Wal) shutdown() error {
+	err := w.flushBuffer()
 	if err != nil {
 		return err
 	}
-	err = w.changeHotFile(newFile)
+
+	err = w.trimHotFile()
 	if err != nil {
 		return err
 	}
-	err = w.FlushBuffer()
+	err = w.HotFile.Sync()
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to sync hot file: %w", err)
 	}
-	w.Buffer.Write(tmpBuffer)
 
-	return nil
+	info, err := w.HotFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read hot file size: %w", err)
+	}
+	return writeShutdownMarker(*w.Options.FileHandlerOpts, shutdownMarker{
+		nextLSN: w.lsn,
+		hotSize: info.Size(),
+		hotFile: filepath.Base(w.HotFile.Name()),
+	})
 }
 
-// Truncate removes entries from the WAL between the specified LSN range.
-//
-// Parameters:
-//   - lsnFirst: The starting LSN of the range to truncate.
-//   - lsnLast: The ending LSN of the range to truncate.
+// release closes the hot file and releases the lock of the Wal folder,
+// so another Wal can write to it. The caller must hold mu.
 //
 // Returns:
-//   - An error if the truncate operation fails.
-func (w *Wal) Truncate(lsnFirst uint32, lsnLast uint32) error {
-	return nil
+//   - The errors of every close operation that failed.
+func (w *Wal) release() error {
+	var errs []error
+	// A failed TruncateAfter may leave the Wal without a hot file
+	if w.HotFile != nil {
+		err := w.HotFile.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to close hot file: %w", err))
+		}
+	}
+	err := fh.UnlockDir(w.lock)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
 }
-
-// TODO
-// 1. Close file properly
-// 2. New func to recover file from LSN
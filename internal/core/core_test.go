@@ -3,10 +3,14 @@ package core
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
+	"github.com/casteloig/walrog/internal/faultfs"
 	fh "github.com/casteloig/walrog/internal/file_handler"
 )
 
@@ -95,10 +99,10 @@ func TestCheckBufferOverflow(t *testing.T) {
 }
 
 // Test function for WriteBuffer method
-func TestCreateTmpBuff(t *testing.T) {
+func TestEncodeRecord(t *testing.T) {
 	testCases := []struct {
 		name           string
-		lsn            uint32
+		lsn            uint64
 		data           []byte
 		expectedBuffer []byte
 	}{
@@ -106,27 +110,25 @@ func TestCreateTmpBuff(t *testing.T) {
 			name:           "Case 1",
 			lsn:            1,
 			data:           []byte{1, 2, 3},
-			expectedBuffer: []byte{1, 0, 0, 0, 3, 0, 0, 0, 1, 2, 3, 190, 45, 28, 49},
+			expectedBuffer: []byte{1, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 1, 1, 2, 3, 77, 227, 29, 222},
 		},
 		{
 			name:           "Case 2",
 			lsn:            11,
 			data:           []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
-			expectedBuffer: []byte{11, 0, 0, 0, 10, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 181, 89, 81, 142},
+			expectedBuffer: []byte{11, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 1, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 132, 195, 215, 100},
 		},
 		{
 			name:           "Empty data",
 			lsn:            11,
 			data:           []byte{},
-			expectedBuffer: []byte{11, 0, 0, 0, 0, 0, 0, 0, 63, 195, 72, 56},
+			expectedBuffer: []byte{11, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 183, 201, 186, 159},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			wal := &Wal{lsn: tc.lsn}
-
-			tmpBuffer, err := wal.createTmpBuff(tc.data)
+			tmpBuffer, err := encodeRecord(tc.lsn, recordTypeFull, tc.data)
 
 			if tc.expectedBuffer == nil {
 				if err == nil {
@@ -234,6 +236,431 @@ func TestManageWriteFlow(t *testing.T) {
 	}
 }
 
+func TestWriteBufferAssignsLSN(t *testing.T) {
+	tempDir := t.TempDir()
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = tempDir
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     1024,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	defer w.Close()
+
+	// LSNs start at 1 and increase by one on every entry
+	for i := uint64(1); i <= 5; i++ {
+		lsn, err := w.WriteBuffer([]byte{byte(i)})
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+		if lsn != i {
+			t.Errorf("Expected LSN %d, got %d", i, lsn)
+		}
+	}
+
+	// An entry bigger than the buffer is split in fragments, but takes a single LSN
+	lsn, err := w.WriteBuffer(make([]byte, 100))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed with data bigger than buffer: %v", err)
+	}
+	if lsn != 6 {
+		t.Errorf("Expected LSN 6, got %d", lsn)
+	}
+	lsn, err = w.WriteBuffer([]byte{7})
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 7 {
+		t.Errorf("Expected LSN 7, got %d", lsn)
+	}
+
+	// The LSNs are stored with the entries
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	result, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	for i, entry := range result {
+		if entry.LSN != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, entry.LSN)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	tempDir := t.TempDir()
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = tempDir
+
+	var events []RotationEvent
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     128,
+		FileHandlerOpts: &fileHandlerOpts,
+		OnRotate: func(event RotationEvent) {
+			events = append(events, event)
+		},
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+
+	// Every entry takes 27 bytes, so 4 of them fit in a segment after the header
+	for i := 0; i < 10; i++ {
+		_, err := w.WriteBuffer([]byte("0123456789"))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// Rotation events point to the segments and the LSN they start with
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 rotations, got %d", len(events))
+	}
+	for i, event := range events {
+		if event.FirstLSN != uint64(4*(i+1)+1) {
+			t.Errorf("Expected new segment to start at LSN %d, got %d", 4*(i+1)+1, event.FirstLSN)
+		}
+		if i > 0 && event.PreviousFile != events[i-1].NewFile {
+			t.Errorf("Expected rotation from %s, got %s", events[i-1].NewFile, event.PreviousFile)
+		}
+	}
+
+	// Every segment received its entries, without exceeding its size
+	paths, err := fh.ListWalFiles(fileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	if len(paths) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", len(paths))
+	}
+	for i, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatalf("Error reading segment: %v", err)
+		}
+		expectedSize := int64(segmentHeaderSize + 4*27)
+		if i == len(paths)-1 {
+			expectedSize = segmentHeaderSize + 2*27
+		}
+		if info.Size() != expectedSize {
+			t.Errorf("Expected segment %s to have %d bytes, got %d", filepath.Base(p), expectedSize, info.Size())
+		}
+	}
+
+	// Segments are named after the LSN they start with
+	for i, p := range paths {
+		first, ok := fh.WalFileFirstLSN(p)
+		if !ok || first != uint64(4*i+1) {
+			t.Errorf("Expected segment %s to be named after LSN %d", filepath.Base(p), 4*i+1)
+		}
+	}
+
+	result, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(result) != 10 {
+		t.Fatalf("Expected 10 entries, got %d", len(result))
+	}
+	for i, entry := range result {
+		if entry.LSN != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, entry.LSN)
+		}
+	}
+}
+
+func TestRotationFailure(t *testing.T) {
+	fs := faultfs.New(1)
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fs
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     128,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	writeEntries(t, w, 4)
+
+	// The new segment cannot be created, so the write that rotates fails
+	enospc := errors.New("no space left on device")
+	fs.SetFault(func(op faultfs.Op, name string) error {
+		if op == faultfs.OpOpen {
+			return enospc
+		}
+		return nil
+	})
+	hotFile := w.HotFile.Name()
+	for i := 0; i < 4; i++ {
+		_, err = w.WriteBuffer([]byte("0123456789"))
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, enospc) {
+		t.Fatalf("Expected WriteBuffer() to fail with the open error, got %v", err)
+	}
+	if w.HotFile.Name() != hotFile {
+		t.Errorf("Expected the hot file to stay %s, got %s", hotFile, w.HotFile.Name())
+	}
+	fs.SetFault(nil)
+
+	// The old segment is still open, so the Wal goes on once the segment can be created
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	writeEntries(t, w, 4)
+	last := w.lsn - 1
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	checkEntries(t, options, 1, last)
+}
+
+func TestSegmentNames(t *testing.T) {
+	// Two Wal instances in the same process name their segments independently
+	first, firstOptions := newTestWal(t, 10)
+	second, secondOptions := newTestWal(t, 6)
+	for _, w := range []*Wal{first, second} {
+		err := w.Close()
+		if err != nil {
+			t.Fatalf("Close() failed: %v", err)
+		}
+	}
+
+	expected := map[*WalOptions][]string{
+		firstOptions:  {"wal_0000000000000001.log", "wal_0000000000000005.log", "wal_0000000000000009.log"},
+		secondOptions: {"wal_0000000000000001.log", "wal_0000000000000005.log"},
+	}
+	for options, names := range expected {
+		paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+		if err != nil {
+			t.Fatalf("ListWalFiles() failed: %v", err)
+		}
+		if len(paths) != len(names) {
+			t.Fatalf("Expected %d segments, got %d", len(names), len(paths))
+		}
+		for i, name := range names {
+			if filepath.Base(paths[i]) != name {
+				t.Errorf("Expected segment %s, got %s", name, filepath.Base(paths[i]))
+			}
+		}
+	}
+
+	// After a restart, new segments follow the existing ones instead of overwriting them
+	w, err := OpenWal(secondOptions)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		_, err := w.WriteBuffer([]byte("0123456789"))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	paths, err := fh.ListWalFiles(*secondOptions.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	if len(paths) != 3 || filepath.Base(paths[2]) != "wal_0000000000000009.log" {
+		t.Errorf("Expected a new segment wal_0000000000000009.log, got %v", paths)
+	}
+	entries, err := Recover(secondOptions)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 10 {
+		t.Errorf("Expected 10 entries, got %d", len(entries))
+	}
+}
+
+func TestLock(t *testing.T) {
+	w, options := newTestWal(t, 10)
+
+	// A single Wal can write to the folder
+	_, err := OpenWal(options)
+	if err != ErrLocked {
+		t.Errorf("Expected OpenWal() to fail with ErrLocked, got %v", err)
+	}
+	_, err = InitWal(options)
+	if err != ErrLocked {
+		t.Errorf("Expected InitWal() to fail with ErrLocked, got %v", err)
+	}
+
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+
+	// A read-only Wal does not need the lock, and leaves the folder untouched
+	readOnlyOptions := *options
+	readOnlyOptions.ReadOnly = true
+	readOnly, err := OpenWal(&readOnlyOptions)
+	if err != nil {
+		t.Fatalf("OpenWal() failed in read-only mode: %v", err)
+	}
+
+	writes := map[string]func() error{
+		"WriteBuffer": func() error {
+			_, err := readOnly.WriteBuffer([]byte("data"))
+			return err
+		},
+		"WriteBatch": func() error {
+			var batch Batch
+			batch.Add([]byte("data"))
+			_, err := readOnly.WriteBatch(&batch)
+			return err
+		},
+		"FlushBuffer":   readOnly.FlushBuffer,
+		"Sync":          readOnly.Sync,
+		"Truncate":      func() error { return readOnly.Truncate(5) },
+		"TruncateAfter": func() error { return readOnly.TruncateAfter(5) },
+		"Checkpoint":    func() error { return readOnly.Checkpoint(5, nil) },
+	}
+	for name, write := range writes {
+		if err := write(); err != ErrReadOnly {
+			t.Errorf("Expected %s() to fail with ErrReadOnly, got %v", name, err)
+		}
+	}
+	err = readOnly.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	_, err = InitWal(&readOnlyOptions)
+	if err != ErrReadOnly {
+		t.Errorf("Expected InitWal() to fail with ErrReadOnly, got %v", err)
+	}
+
+	// Close releases the lock
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed after Close(): %v", err)
+	}
+	w.Close()
+}
+
+func TestOpenReadOnlyTornTail(t *testing.T) {
+	w, options := newTestWal(t, 10)
+	err := w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	crash(w)
+
+	// A torn record at the tail fails OpenWal in RecoverFail mode
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	file, err := os.OpenFile(paths[len(paths)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Error opening segment: %v", err)
+	}
+	_, err = file.Write([]byte{1, 2, 3})
+	file.Close()
+	if err != nil {
+		t.Fatalf("Error tearing segment: %v", err)
+	}
+	options.RecoveryMode = RecoverFail
+
+	// A read-only Wal does not scan the segments, so it is left to its Readers
+	readOnlyOptions := *options
+	readOnlyOptions.ReadOnly = true
+	readOnly, err := OpenWal(&readOnlyOptions)
+	if err != nil {
+		t.Fatalf("OpenWal() failed in read-only mode: %v", err)
+	}
+	err = readOnly.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	_, err = OpenWal(options)
+	if err == nil {
+		t.Errorf("Expected OpenWal() to fail on the torn record")
+	}
+}
+
+func TestCloseFailure(t *testing.T) {
+	fs := faultfs.New(1)
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fs
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     256,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	_, err = w.WriteBuffer([]byte("Hello World!"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+
+	// The files are closed and the lock released even if the hot file cannot be synced
+	eio := errors.New("input/output error")
+	fs.SetFault(func(op faultfs.Op, name string) error {
+		if op == faultfs.OpSync {
+			return eio
+		}
+		return nil
+	})
+	err = w.Close()
+	if !errors.Is(err, eio) {
+		t.Errorf("Expected Close() to fail with the sync error, got %v", err)
+	}
+	fs.SetFault(nil)
+	if _, err = w.WriteBuffer([]byte("Bye")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	// Without a shutdown marker, the segments are scanned: the entry was dropped by the failed sync
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed after a failed Close(): %v", err)
+	}
+	if w.lsn != 1 {
+		t.Errorf("Expected next LSN 1, got %d", w.lsn)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+}
+
 func TestRecoverFile(t *testing.T) {
 	testCases := []struct {
 		name           string
@@ -245,8 +672,8 @@ func TestRecoverFile(t *testing.T) {
 			dataFile: []byte{1, 0, 0, 0, 12, 0, 0, 0, 72, 101, 108, 108, 111, 32, 87, 111, 114, 108, 100, 33, 207, 169, 108, 170},
 			expectedResult: []RecoveredEntry{
 				{
-					lsn:  1,
-					data: []byte{72, 101, 108, 108, 111, 32, 87, 111, 114, 108, 100, 33},
+					LSN:  1,
+					Data: []byte{72, 101, 108, 108, 111, 32, 87, 111, 114, 108, 100, 33},
 				},
 			},
 		},
@@ -255,12 +682,12 @@ func TestRecoverFile(t *testing.T) {
 			dataFile: []byte{12, 0, 0, 0, 12, 0, 0, 0, 72, 101, 108, 108, 111, 32, 87, 111, 114, 108, 100, 33, 98, 175, 61, 28, 13, 0, 0, 0, 10, 0, 0, 0, 66, 121, 101, 32, 87, 111, 114, 108, 100, 33, 16, 211, 148, 16},
 			expectedResult: []RecoveredEntry{
 				{
-					lsn:  12,
-					data: []byte{72, 101, 108, 108, 111, 32, 87, 111, 114, 108, 100, 33},
+					LSN:  12,
+					Data: []byte{72, 101, 108, 108, 111, 32, 87, 111, 114, 108, 100, 33},
 				},
 				{
-					lsn:  13,
-					data: []byte{66, 121, 101, 32, 87, 111, 114, 108, 100, 33},
+					LSN:  13,
+					Data: []byte{66, 121, 101, 32, 87, 111, 114, 108, 100, 33},
 				},
 			},
 		},
@@ -269,33 +696,27 @@ func TestRecoverFile(t *testing.T) {
 	// Writing existing data to file
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// Crate temp file
-			file, err := os.CreateTemp("/tmp", "wal_test")
-			if err != nil {
-				t.Fatalf("Error creating temp file: %v", err)
-			}
-			defer os.Remove(file.Name()) // Make sure file is removed
-
-			// Write test data into de file
-			_, err = file.Write(tc.dataFile)
+			// Write test data into a legacy WAL file
+			fileHandlerOpts := *fh.DefaultOptions
+			fileHandlerOpts.DirName = t.TempDir()
+			options := &WalOptions{FileHandlerOpts: &fileHandlerOpts}
+			err := os.WriteFile(filepath.Join(fileHandlerOpts.DirName, "wal_0.log"), tc.dataFile, 0644)
 			if err != nil {
 				t.Fatalf("Error writing data to file: %v", err)
 			}
 
-			// Close file after writing
-			file.Close()
-
-			// Reopen file to recover data
-			file, err = os.Open(file.Name())
-			if err != nil {
-				t.Fatalf("Error reopening file for reading: %v", err)
-			}
-			defer file.Close() // Make sure file is closed
-
 			// Recover data
-			result, err := recoverFile(file)
+			r, err := NewReader(options)
 			if err != nil {
-				t.Fatalf("Error recovering file: %v", err)
+				t.Fatalf("Error opening reader: %v", err)
+			}
+			defer r.Close()
+			var result []RecoveredEntry
+			for r.Next() {
+				result = append(result, r.Entry())
+			}
+			if r.Err() != nil {
+				t.Fatalf("Error recovering file: %v", r.Err())
 			}
 
 			// Check for expected results
@@ -304,12 +725,12 @@ func TestRecoverFile(t *testing.T) {
 					t.Fatalf("Expected more entries in result")
 				}
 
-				if result[i].lsn != entry.lsn {
-					t.Fatalf("Expected LSN %d, got %d", entry.lsn, result[i].lsn)
+				if result[i].LSN != entry.LSN {
+					t.Fatalf("Expected LSN %d, got %d", entry.LSN, result[i].LSN)
 				}
 
-				if !bytes.Equal(result[i].data, entry.data) {
-					t.Fatalf("Expected data %v, got %v", entry.data, result[i].data)
+				if !bytes.Equal(result[i].Data, entry.Data) {
+					t.Fatalf("Expected data %v, got %v", entry.Data, result[i].Data)
 				}
 			}
 
@@ -321,5 +742,459 @@ func TestRecoverFile(t *testing.T) {
 	}
 }
 
+func TestRecoverFunc(t *testing.T) {
+	tempDir := t.TempDir()
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = tempDir
+	options := &WalOptions{FileHandlerOpts: &fileHandlerOpts}
+
+	// Files are named so that lexical and creation order differ
+	files := map[string][]byte{
+		"wal_1000.log": {13, 0, 0, 0, 10, 0, 0, 0, 66, 121, 101, 32, 87, 111, 114, 108, 100, 33, 16, 211, 148, 16},
+		"wal_999.log":  {12, 0, 0, 0, 12, 0, 0, 0, 72, 101, 108, 108, 111, 32, 87, 111, 114, 108, 100, 33, 98, 175, 61, 28},
+		"checkpoint":   {},
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(tempDir, name), content, 0644)
+		if err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+
+	var lsns []uint64
+	err := RecoverFunc(options, func(entry RecoveredEntry) error {
+		lsns = append(lsns, entry.LSN)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RecoverFunc() failed: %v", err)
+	}
+	if len(lsns) != 2 || lsns[0] != 12 || lsns[1] != 13 {
+		t.Fatalf("Expected LSNs [12 13], got %v", lsns)
+	}
+
+	// Errors returned by the callback stop the recovery
+	stop := errors.New("stop")
+	calls := 0
+	err = RecoverFunc(options, func(entry RecoveredEntry) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("Expected recovery to stop after 1 call, got %d calls and error %v", calls, err)
+	}
+
+	// A corrupted record fails the recovery
+	err = os.WriteFile(filepath.Join(tempDir, "wal_999.log"), []byte{12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0644)
+	if err != nil {
+		t.Fatalf("Error writing wal_999.log: %v", err)
+	}
+	_, err = Recover(options)
+	if err == nil {
+		t.Fatalf("Expected CRC error recovering a corrupted file")
+	}
+}
+
+func TestOpenWal(t *testing.T) {
+	tempDir := t.TempDir()
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = tempDir
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     1024,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	// Older legacy file, plus hot file with a valid entry followed by a torn one
+	validEntry := []byte{
+		87, 76, 82, 71, 1, 0, 0, 0,
+		13, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 1, 66, 121, 101, 32, 87, 111, 114, 108, 100, 33, 222, 135, 164, 25,
+	}
+	tornEntry := []byte{14, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 1, 66, 121}
+	files := map[string][]byte{
+		"wal_002.log": {12, 0, 0, 0, 12, 0, 0, 0, 72, 101, 108, 108, 111, 32, 87, 111, 114, 108, 100, 33, 98, 175, 61, 28},
+		"wal_003.log": append(append([]byte{}, validEntry...), tornEntry...),
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(tempDir, name), content, 0644)
+		if err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+
+	w, err := OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	defer w.Close()
+
+	// Resumes on the last file, after the last valid entry
+	if filepath.Base(w.HotFile.Name()) != "wal_003.log" {
+		t.Errorf("Expected hot file wal_003.log, got %s", w.HotFile.Name())
+	}
+	if w.lsn != 14 {
+		t.Errorf("Expected next LSN 14, got %d", w.lsn)
+	}
+	if w.segmentUsed != len(validEntry) {
+		t.Errorf("Expected %d bytes used in segment, got %d", len(validEntry), w.segmentUsed)
+	}
+
+	// The torn tail has been dropped
+	info, err := os.Stat(filepath.Join(tempDir, "wal_003.log"))
+	if err != nil {
+		t.Fatalf("Error reading wal_003.log: %v", err)
+	}
+	if info.Size() != int64(len(validEntry)) {
+		t.Errorf("Expected torn tail to be truncated to %d bytes, got %d", len(validEntry), info.Size())
+	}
+
+	// New entries are appended after the existing ones
+	lsn, err := w.WriteBuffer([]byte("Hello again!"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 14 {
+		t.Errorf("Expected LSN 14, got %d", lsn)
+	}
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+
+	result, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(result) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(result))
+	}
+	if !bytes.Equal(result[2].Data, []byte("Hello again!")) {
+		t.Errorf("Expected appended entry, got %v", result[2].Data)
+	}
+}
+
+func TestOpenWalLegacyHotFile(t *testing.T) {
+	tempDir := t.TempDir()
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = tempDir
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     1024,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	// Legacy hot file with a valid entry followed by a torn one
+	validEntry := []byte{13, 0, 0, 0, 10, 0, 0, 0, 66, 121, 101, 32, 87, 111, 114, 108, 100, 33, 16, 211, 148, 16}
+	tornEntry := []byte{14, 0, 0, 0, 10, 0, 0, 0, 66, 121}
+	err := os.WriteFile(filepath.Join(tempDir, "wal_000.log"), append(append([]byte{}, validEntry...), tornEntry...), 0644)
+	if err != nil {
+		t.Fatalf("Error writing wal_000.log: %v", err)
+	}
+
+	w, err := OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	defer w.Close()
+
+	// Records of the latest version cannot be appended to a legacy file
+	if filepath.Base(w.HotFile.Name()) == "wal_000.log" {
+		t.Errorf("Expected a new hot file, got %s", w.HotFile.Name())
+	}
+	if w.lsn != 14 {
+		t.Errorf("Expected next LSN 14, got %d", w.lsn)
+	}
+
+	// The torn tail of the legacy file has been dropped anyway
+	info, err := os.Stat(filepath.Join(tempDir, "wal_000.log"))
+	if err != nil {
+		t.Fatalf("Error reading wal_000.log: %v", err)
+	}
+	if info.Size() != int64(len(validEntry)) {
+		t.Errorf("Expected torn tail to be truncated to %d bytes, got %d", len(validEntry), info.Size())
+	}
+
+	_, err = w.WriteBuffer([]byte("Hello again!"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+
+	result, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(result) != 2 || result[0].LSN != 13 || result[1].LSN != 14 {
+		t.Fatalf("Expected LSNs 13 and 14 recovered, got %v", result)
+	}
+}
+
+func TestOpenWalCorruptedOlderFile(t *testing.T) {
+	tempDir := t.TempDir()
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = tempDir
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     1024,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	// Only the hot file may have a torn tail
+	files := map[string][]byte{
+		"wal_000.log": {12, 0, 0, 0, 12, 0, 0, 0, 72, 101},
+		"wal_001.log": {},
+	}
+	for name, content := range files {
+		err := os.WriteFile(filepath.Join(tempDir, name), content, 0644)
+		if err != nil {
+			t.Fatalf("Error writing %s: %v", name, err)
+		}
+	}
+
+	_, err := OpenWal(options)
+	if err == nil {
+		t.Fatalf("Expected OpenWal() to fail with a corrupted older file")
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	w, options := newTestWal(t, 0)
+
+	const writers = 8
+	const writesPerWriter = 50
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// Readers and flushes run along with the writers
+	var readerErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := w.FlushBuffer(); err != nil {
+				readerErr = err
+				return
+			}
+			if _, err := Recover(options); err != nil {
+				readerErr = err
+				return
+			}
+		}
+	}()
+
+	var writersWg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		writersWg.Add(1)
+		go func(writer int) {
+			defer writersWg.Done()
+			for j := 0; j < writesPerWriter; j++ {
+				// Every entry holds its writer and its position
+				_, err := w.WriteBuffer([]byte(fmt.Sprintf("%d-%03d", writer, j)))
+				if err != nil {
+					t.Errorf("WriteBuffer() failed: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	writersWg.Wait()
+	close(done)
+	wg.Wait()
+	if readerErr != nil {
+		t.Fatalf("Concurrent flush or read failed: %v", readerErr)
+	}
+
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != writers*writesPerWriter {
+		t.Fatalf("Expected %d entries, got %d", writers*writesPerWriter, len(entries))
+	}
+
+	// LSNs have no gaps, and the entries of every writer are in the order it wrote them
+	next := make(map[byte]int)
+	for i, entry := range entries {
+		if entry.LSN != uint64(i+1) {
+			t.Fatalf("Expected LSN %d, got %d", i+1, entry.LSN)
+		}
+		writer := entry.Data[0]
+		expected := fmt.Sprintf("%c-%03d", writer, next[writer])
+		if string(entry.Data) != expected {
+			t.Fatalf("Expected entry %q at LSN %d, got %q", expected, entry.LSN, entry.Data)
+		}
+		next[writer]++
+	}
+}
+
+func TestConcurrentTruncateAndCheckpoint(t *testing.T) {
+	w, options := newTestWal(t, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := w.WriteBuffer([]byte("0123456789"))
+				if err != nil {
+					t.Errorf("WriteBuffer() failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Keep truncating and checkpointing behind the writers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 20; j++ {
+			w.mu.Lock()
+			lsn := w.lsn - 1
+			w.mu.Unlock()
+
+			if err := w.Checkpoint(lsn, nil); err != nil {
+				t.Errorf("Checkpoint() failed: %v", err)
+				return
+			}
+			if err := w.Truncate(lsn); err != nil {
+				t.Errorf("Truncate() failed: %v", err)
+				return
+			}
+			if _, err := Recover(options); err != nil {
+				t.Errorf("Recover() failed: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	lsn, err := w.WriteBuffer([]byte("last"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 202 {
+		t.Errorf("Expected LSN 202, got %d", lsn)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// The entries after the last checkpoint are still there
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) == 0 || entries[len(entries)-1].LSN != 202 {
+		t.Fatalf("Expected entries up to LSN 202, got %v", entries)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].LSN != entries[i-1].LSN+1 {
+			t.Fatalf("Expected contiguous LSNs, got %d after %d", entries[i].LSN, entries[i-1].LSN)
+		}
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fh.NewMemFS()
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     128,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		_, err := w.WriteBuffer([]byte("0123456789"))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+	err = w.Checkpoint(5, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	err = w.Truncate(5)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+	err = w.TruncateAfter(15)
+	if err != nil {
+		t.Fatalf("TruncateAfter() failed: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// Reopen and keep writing, the segments are only in the FS
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	lsn, err := w.WriteBuffer([]byte("after"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 16 {
+		t.Errorf("Expected LSN 16, got %d", lsn)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// Entries after the checkpoint are recovered
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 11 || entries[0].LSN != 6 || string(entries[10].Data) != "after" {
+		t.Errorf("Expected entries 6 to 16, got %+v", entries)
+	}
+
+	r, err := NewReader(options)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %v", err)
+	}
+	defer r.Close()
+	err = r.Seek(5)
+	if err != nil {
+		t.Fatalf("Seek() failed: %v", err)
+	}
+	count := 0
+	for r.Next() {
+		count++
+	}
+	if r.Err() != nil || count != 12 {
+		t.Errorf("Expected to read 12 entries, got %d, %v", count, r.Err())
+	}
+
+	if _, err := os.Stat("/wal"); !os.IsNotExist(err) {
+		t.Errorf("Expected /wal not to exist on disk, got %v", err)
+	}
+}
+
 // TODO
 // 1. Test using custom options
@@ -0,0 +1,272 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/casteloig/walrog/internal/faultfs"
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// crashState is what a crash test knows about the Wal, to check what recovery returns.
+type crashState struct {
+	written map[uint64][]byte // Data of every entry the Wal assigned an LSN to
+	batches [][2]uint64       // First and last LSN of every batch written
+	durable uint64            // Entries up to this LSN were acknowledged as durable
+	last    uint64            // LSN of the last entry written
+
+	truncated  uint64 // Low-water mark acknowledged by Truncate
+	truncating uint64 // Highest LSN passed to Truncate, maybe not persisted
+}
+
+// TestCrashConsistency writes to a Wal on a fault-injecting FS, loses power at a random point,
+// recovers and checks that every entry acknowledged as durable survived, several times in a row.
+// Writes may also fail before, because the disk is full or a sync fails.
+func TestCrashConsistency(t *testing.T) {
+	for seed := int64(0); seed < 100; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			runCrashTest(t, seed)
+		})
+	}
+}
+
+// runCrashTest runs a crash test with the given seed. Odd seeds sync on every write,
+// and half of the seeds preallocate segments and recycle the ones removed by Truncate.
+func runCrashTest(t *testing.T, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	fs := faultfs.New(seed)
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fs
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     256,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+	if seed%2 == 1 {
+		options.SyncMode = SyncOnWrite
+	}
+	if seed%4 >= 2 {
+		options.Preallocate = true
+		options.RecycleSegments = 2
+	}
+
+	state := &crashState{written: make(map[uint64][]byte)}
+	for round := 0; round < 5; round++ {
+		// Besides losing power, the disk may fill up or fail to sync
+		switch rng.Intn(4) {
+		case 0:
+			fs.SetCapacity(int64(2000 + rng.Intn(4000)))
+		case 1:
+			fs.SetFault(func(op faultfs.Op, name string) error {
+				if op == faultfs.OpSync && rng.Intn(10) == 0 {
+					return errors.New("input/output error")
+				}
+				return nil
+			})
+		}
+		fs.CrashAfter(rng.Intn(1000))
+
+		w, err := OpenWal(options)
+		if err == nil {
+			runCrashWorkload(rng, w, state)
+		}
+		fs.SetCapacity(0)
+		fs.SetFault(nil)
+
+		if rng.Intn(2) == 0 {
+			fs.Crash()
+		} else {
+			fs.CrashTorn()
+		}
+		checkCrashRecovery(t, options, state)
+	}
+}
+
+// runCrashWorkload writes entries and batches, flushing, syncing, checkpointing and truncating from time to time,
+// until the power is lost or the Wal is closed.
+func runCrashWorkload(rng *rand.Rand, w *Wal, state *crashState) {
+	for i := 0; i < 100; i++ {
+		switch op := rng.Intn(12); {
+		case op < 6:
+			// Some entries are bigger than the buffer, so they are fragmented
+			data := randomEntry(rng)
+			lsn, err := w.WriteBuffer(data)
+			if lsn != 0 {
+				state.written[lsn] = data
+				state.last = lsn
+			}
+			if err != nil {
+				return
+			}
+			if w.Options.SyncMode == SyncOnWrite {
+				state.durable = lsn
+			}
+		case op < 8:
+			batch := &Batch{}
+			for j := rng.Intn(4); j >= 0; j-- {
+				batch.Add(randomEntry(rng))
+			}
+			first, err := w.WriteBatch(batch)
+			if first != 0 {
+				for j, data := range batch.entries {
+					state.written[first+uint64(j)] = data
+				}
+				state.last = first + uint64(batch.Len()) - 1
+				state.batches = append(state.batches, [2]uint64{first, state.last})
+			}
+			if err != nil {
+				return
+			}
+			if w.Options.SyncMode == SyncOnWrite {
+				state.durable = state.last
+			}
+		case op < 9:
+			if w.FlushBuffer() != nil {
+				return
+			}
+			state.durable = state.last
+		case op < 10:
+			if w.Sync() != nil {
+				return
+			}
+			state.durable = state.last
+		case op < 11:
+			// Only durable entries are checkpointed, so recovery resumes from entries on disk
+			if state.durable == 0 {
+				continue
+			}
+			if w.Checkpoint(1+uint64(rng.Intn(int(state.durable))), nil) != nil {
+				return
+			}
+		default:
+			// Only durable entries are discarded, so the entries kept are always known
+			lsn := 1 + uint64(rng.Intn(int(state.durable)+1))
+			state.truncating = max(state.truncating, lsn)
+			if w.Truncate(lsn) != nil {
+				return
+			}
+			state.truncated = max(state.truncated, lsn)
+		}
+	}
+
+	if w.Close() == nil {
+		state.durable = state.last
+	}
+}
+
+// randomEntry returns an entry of up to 150 bytes of random data.
+func randomEntry(rng *rand.Rand) []byte {
+	data := make([]byte, 1+rng.Intn(150))
+	rng.Read(data)
+	return data
+}
+
+// checkCrashRecovery recovers the Wal after a crash and checks that the entries recovered are
+// the ones written, in order after the low-water mark and the checkpoint, including every durable one and never
+// part of a batch. The entries lost are forgotten, since their LSNs are assigned again.
+func checkCrashRecovery(t *testing.T, options *WalOptions, state *crashState) {
+	t.Helper()
+	lowWaterMark, err := readLowWaterMark(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("readLowWaterMark() failed: %v", err)
+	}
+	if lowWaterMark < state.truncated || lowWaterMark > state.truncating {
+		t.Fatalf("Expected a low-water mark between %d and %d, got %d", state.truncated, state.truncating, lowWaterMark)
+	}
+	checkpoint, _, err := ReadCheckpoint(options)
+	if err != nil {
+		t.Fatalf("ReadCheckpoint() failed: %v", err)
+	}
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+
+	first := max(lowWaterMark, checkpoint.LSN+1)
+	for i, entry := range entries {
+		lsn := first + uint64(i)
+		if entry.LSN != lsn {
+			t.Fatalf("Expected LSN %d, got %d", lsn, entry.LSN)
+		}
+		if !bytes.Equal(entry.Data, state.written[lsn]) {
+			t.Fatalf("Expected the data written with LSN %d, got %d bytes", lsn, len(entry.Data))
+		}
+	}
+
+	recovered := first + uint64(len(entries)) - 1
+	if recovered < state.durable {
+		t.Fatalf("Expected every entry up to LSN %d to be durable, only up to %d recovered", state.durable, recovered)
+	}
+	for _, batch := range state.batches {
+		if batch[0] <= recovered && recovered < batch[1] {
+			t.Fatalf("Expected the batch of LSNs %d to %d to be recovered whole, got up to %d", batch[0], batch[1], recovered)
+		}
+	}
+
+	for lsn := recovered + 1; lsn <= state.last; lsn++ {
+		delete(state.written, lsn)
+	}
+	state.last = recovered
+	state.durable = recovered
+	state.batches = nil
+	state.truncated = lowWaterMark
+	state.truncating = lowWaterMark
+}
+
+func TestFailedSync(t *testing.T) {
+	fs := faultfs.New(1)
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fs
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     256,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	_, err = w.WriteBuffer([]byte("Hello World!"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+
+	eio := errors.New("input/output error")
+	fs.SetFault(func(op faultfs.Op, name string) error {
+		if op == faultfs.OpSync {
+			return eio
+		}
+		return nil
+	})
+	err = w.FlushBuffer()
+	if !errors.Is(err, eio) {
+		t.Fatalf("Expected FlushBuffer() to fail with the sync error, got %v", err)
+	}
+	fs.SetFault(nil)
+
+	// The entry was dropped, so a sync succeeding now would not make it durable
+	if err = w.Sync(); !errors.Is(err, eio) {
+		t.Errorf("Expected Sync() to fail with the sync error, got %v", err)
+	}
+	if _, err = w.WriteBuffer([]byte("Bye")); !errors.Is(err, eio) {
+		t.Errorf("Expected WriteBuffer() to fail with the sync error, got %v", err)
+	}
+	if err = w.Close(); !errors.Is(err, eio) {
+		t.Errorf("Expected Close() to fail with the sync error, got %v", err)
+	}
+	fs.Crash()
+
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected the entry to be lost, got %d entries", len(entries))
+	}
+}
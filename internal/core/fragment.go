@@ -0,0 +1,118 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/casteloig/walrog/internal/record"
+)
+
+// encodeEntry builds the records holding an entry, ready to be written to a WAL file.
+// An entry whose record does not fit in the buffer is split in fragments: a first record,
+// as many middle records as needed and a last record, all of them with the entry LSN.
+// Fragments are written like any other record, so an entry can span buffers and segments.
+//
+// Parameters:
+//   - lsn: The LSN of the entry.
+//   - flags: The flags set on every record of the entry, e.g. recordFlagBatch.
+//   - data: A slice of bytes with the entry data.
+//
+// Returns:
+//   - The records holding the entry, each one no bigger than the buffer or record.MaxRecordSize.
+//   - An error if the buffer is too small to hold any data.
+func (w *Wal) encodeEntry(lsn uint64, flags byte, data []byte) ([][]byte, error) {
+	maxData := int(min(w.Options.BufferSize, record.MaxRecordSize)) - recordHeaderSize - recordCRCSize
+	if maxData <= 0 {
+		return nil, fmt.Errorf("buffer of %d bytes is too small to hold a record", w.Options.BufferSize)
+	}
+
+	if len(data) <= maxData {
+		record, err := encodeRecord(lsn, recordTypeFull|flags, data)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{record}, nil
+	}
+
+	var records [][]byte
+	for start := 0; start < len(data); start += maxData {
+		end := min(start+maxData, len(data))
+
+		recordType := recordTypeMiddle
+		if start == 0 {
+			recordType = recordTypeFirst
+		} else if end == len(data) {
+			recordType = recordTypeLast
+		}
+
+		record, err := encodeRecord(lsn, recordType|flags, data[start:end])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// completesEntry checks if a record is the end of a unit written atomically:
+// a whole entry, or the last fragment of one, not followed by more entries of its batch.
+// Recovery only resumes writing after such a record.
+func (e RecoveredEntry) completesEntry() bool {
+	return (e.recordType == recordTypeFull || e.recordType == recordTypeLast) && !e.batchContinues
+}
+
+// entryAssembler rebuilds the entries read from the WAL files record by record:
+// fragments are joined back into their entry, and the entries of a batch are held back
+// until the last one is read, so only whole entries of whole batches are handed over.
+// Fragments without their first record, e.g. the tail of an entry removed by Truncate, are dropped.
+type entryAssembler struct {
+	fragments *RecoveredEntry  // Entry being rebuilt from its fragments
+	pending   []RecoveredEntry // Entries of the batch being read
+}
+
+// add hands the entries completed by record to fn, in the order they were written.
+//
+// Parameters:
+//   - record: The record read from a WAL file.
+//   - fn: A function called for every entry of a complete batch.
+//
+// Returns:
+//   - An error if fn fails.
+func (a *entryAssembler) add(record RecoveredEntry, fn func(RecoveredEntry) error) error {
+	entry := record
+	switch record.recordType {
+	case recordTypeFirst:
+		a.fragments = &RecoveredEntry{LSN: record.LSN, Data: append([]byte{}, record.Data...)}
+		return nil
+	case recordTypeMiddle, recordTypeLast:
+		if a.fragments == nil || a.fragments.LSN != record.LSN {
+			a.fragments = nil
+			return nil
+		}
+		a.fragments.Data = append(a.fragments.Data, record.Data...)
+		if record.recordType == recordTypeMiddle {
+			return nil
+		}
+		entry = *a.fragments
+		entry.batchContinues = record.batchContinues
+		a.fragments = nil
+	default:
+		// A whole entry ends any entry left without its last fragment
+		a.fragments = nil
+	}
+	entry.recordType = recordTypeFull
+
+	if entry.batchContinues {
+		a.pending = append(a.pending, entry)
+		return nil
+	}
+
+	pending := a.pending
+	a.pending = nil
+	for _, p := range pending {
+		err := fn(p)
+		if err != nil {
+			return err
+		}
+	}
+	return fn(entry)
+}
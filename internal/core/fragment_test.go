@@ -0,0 +1,265 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"testing"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+func TestEncodeEntry(t *testing.T) {
+	testCases := []struct {
+		name          string
+		bufferSize    uint32
+		dataSize      int
+		flags         byte
+		expectedTypes []byte
+		expectedError bool
+	}{
+		{
+			name:          "Entry fitting in the buffer",
+			bufferSize:    64,
+			dataSize:      10,
+			expectedTypes: []byte{recordTypeFull},
+		},
+		{
+			name:          "Entry filling the buffer",
+			bufferSize:    64,
+			dataSize:      47,
+			expectedTypes: []byte{recordTypeFull},
+		},
+		{
+			name:          "Entry split in two fragments",
+			bufferSize:    64,
+			dataSize:      48,
+			expectedTypes: []byte{recordTypeFirst, recordTypeLast},
+		},
+		{
+			name:          "Entry split in many fragments",
+			bufferSize:    64,
+			dataSize:      150,
+			expectedTypes: []byte{recordTypeFirst, recordTypeMiddle, recordTypeMiddle, recordTypeLast},
+		},
+		{
+			name:          "Fragments of a batch entry",
+			bufferSize:    64,
+			dataSize:      100,
+			flags:         recordFlagBatch,
+			expectedTypes: []byte{recordTypeFirst | recordFlagBatch, recordTypeMiddle | recordFlagBatch, recordTypeLast | recordFlagBatch},
+		},
+		{
+			name:          "Buffer too small",
+			bufferSize:    17,
+			dataSize:      10,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &Wal{Options: &WalOptions{BufferSize: tc.bufferSize}}
+			data := bytes.Repeat([]byte{7}, tc.dataSize)
+
+			records, err := w.encodeEntry(3, tc.flags, data)
+			if tc.expectedError {
+				if err == nil {
+					t.Errorf("expected an error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+			if len(records) != len(tc.expectedTypes) {
+				t.Fatalf("expected %d records, got %d", len(tc.expectedTypes), len(records))
+			}
+
+			// Every record fits in the buffer and the fragments hold the whole data
+			var joined []byte
+			for i, record := range records {
+				if len(record) > int(tc.bufferSize) {
+					t.Errorf("expected records of at most %d bytes, got %d", tc.bufferSize, len(record))
+				}
+				if record[12] != tc.expectedTypes[i] {
+					t.Errorf("expected record type %d, got %d", tc.expectedTypes[i], record[12])
+				}
+				entry, _, err := readRecord(bufio.NewReader(bytes.NewReader(record)), formatVersionLatest)
+				if err != nil {
+					t.Fatalf("readRecord() failed: %v", err)
+				}
+				if entry.LSN != 3 {
+					t.Errorf("expected LSN 3 on every fragment, got %d", entry.LSN)
+				}
+				joined = append(joined, entry.Data...)
+			}
+			if !bytes.Equal(joined, data) {
+				t.Errorf("expected fragments to hold the data")
+			}
+		})
+	}
+}
+
+func TestWriteFragmentedEntry(t *testing.T) {
+	w, options := newTestWal(t, 1)
+
+	// Bigger than the buffer and than a segment
+	big := make([]byte, 300)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	lsn, err := w.WriteBuffer(big)
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 2 {
+		t.Errorf("Expected LSN 2, got %d", lsn)
+	}
+
+	var batch Batch
+	batch.Add(big)
+	batch.Add([]byte("last"))
+	_, err = w.WriteBatch(&batch)
+	if err != nil {
+		t.Fatalf("WriteBatch() failed: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.LSN != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, entry.LSN)
+		}
+	}
+	if !bytes.Equal(entries[1].Data, big) || !bytes.Equal(entries[2].Data, big) {
+		t.Errorf("Expected fragmented entries to be joined back")
+	}
+	if string(entries[3].Data) != "last" {
+		t.Errorf("Expected last entry %q, got %q", "last", entries[3].Data)
+	}
+}
+
+func TestTornFragmentedEntry(t *testing.T) {
+	w, options := newTestWal(t, 1)
+	err := w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+
+	_, err = w.WriteBuffer(make([]byte, 300))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+
+	// Crash before the last fragment reached the disk
+	hotPath := w.HotFile.Name()
+	info, err := w.HotFile.Stat()
+	if err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	crash(w)
+	err = os.Truncate(hotPath, info.Size()-1)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected only the entry before the torn one, got %d entries", len(entries))
+	}
+
+	// The Wal resumes where the torn entry started
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	defer w.Close()
+	if w.HotFile.Name() != paths[0] {
+		t.Errorf("Expected hot file %s, got %s", paths[0], w.HotFile.Name())
+	}
+	lsn, err := w.WriteBuffer([]byte("after"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 2 {
+		t.Errorf("Expected LSN 2, got %d", lsn)
+	}
+}
+
+func TestTruncateFragmentedEntry(t *testing.T) {
+	testCases := []struct {
+		name             string
+		truncateLSN      uint64
+		expectedEntries  int
+		expectedFirstLSN uint64
+	}{
+		{
+			name:             "Keeping the fragmented entry",
+			truncateLSN:      2,
+			expectedEntries:  6,
+			expectedFirstLSN: 2,
+		},
+		{
+			name:             "Discarding the fragmented entry",
+			truncateLSN:      3,
+			expectedEntries:  5,
+			expectedFirstLSN: 3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, options := newTestWal(t, 1)
+			defer w.Close()
+
+			// The fragmented entry spans 3 segments, followed by 5 entries
+			_, err := w.WriteBuffer(make([]byte, 300))
+			if err != nil {
+				t.Fatalf("WriteBuffer() failed: %v", err)
+			}
+			for i := 0; i < 5; i++ {
+				_, err = w.WriteBuffer([]byte("0123456789"))
+				if err != nil {
+					t.Fatalf("WriteBuffer() failed: %v", err)
+				}
+			}
+
+			err = w.Truncate(tc.truncateLSN)
+			if err != nil {
+				t.Fatalf("Truncate() failed: %v", err)
+			}
+
+			entries, err := Recover(options)
+			if err != nil {
+				t.Fatalf("Recover() failed: %v", err)
+			}
+			if len(entries) != tc.expectedEntries || entries[0].LSN != tc.expectedFirstLSN {
+				t.Fatalf("Expected %d entries from LSN %d, got %v", tc.expectedEntries, tc.expectedFirstLSN, entries)
+			}
+			if tc.truncateLSN == 2 && len(entries[0].Data) != 300 {
+				t.Errorf("Expected the fragmented entry whole, got %d bytes", len(entries[0].Data))
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// GroupCommitOptions defines how a GroupCommitter batches entries.
+type GroupCommitOptions struct {
+	MaxBatchSize int           // Max number of entries synced together
+	MaxWait      time.Duration // Max time the first entry of a batch waits for more entries
+}
+
+// DefaultGroupCommitOptions provides a default configuration for a GroupCommitter.
+var DefaultGroupCommitOptions = &GroupCommitOptions{
+	MaxBatchSize: 256,
+	MaxWait:      time.Millisecond,
+}
+
+// GroupCommitter lets many goroutines write entries that must be durable before they go on,
+// sharing the cost of the sync: concurrent entries are written in a batch, followed by
+// a single flush and sync of the hot file, and then every caller of the batch is released.
+//
+// The Wal can still be used directly while a GroupCommitter is running.
+// Use it with SyncOnFlush or SyncNever: SyncOnWrite would sync every entry anyway.
+type GroupCommitter struct {
+	wal      *Wal
+	options  GroupCommitOptions
+	requests chan commitRequest
+	quit     chan struct{}
+	done     chan struct{}
+	stop     sync.Once
+}
+
+// commitRequest is an entry waiting to be committed.
+type commitRequest struct {
+	data   []byte
+	result chan commitResult
+}
+
+// commitResult is sent back to the caller once its entry is durable, or failed.
+type commitResult struct {
+	lsn uint64
+	err error
+}
+
+// NewGroupCommitter starts a GroupCommitter writing to the given Wal.
+// If a nil options argument is passed, it will use the default options.
+//
+// Parameters:
+//   - w: A pointer to the Wal entries are written to.
+//   - options: A pointer to GroupCommitOptions with the batching configuration.
+//
+// Returns:
+//   - A pointer to the running GroupCommitter. It must be stopped with Close.
+func NewGroupCommitter(w *Wal, options *GroupCommitOptions) *GroupCommitter {
+	if options == nil {
+		options = DefaultGroupCommitOptions
+	}
+
+	g := &GroupCommitter{
+		wal:      w,
+		options:  *options,
+		requests: make(chan commitRequest),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if g.options.MaxBatchSize < 1 {
+		g.options.MaxBatchSize = 1
+	}
+
+	go g.run()
+	return g
+}
+
+// Commit writes an entry to the Wal and waits until it is synced to disk.
+// It is safe to call Commit from many goroutines at the same time.
+//
+// Parameters:
+//   - data: A slice of bytes to be written to the WAL. It must not be modified until Commit returns.
+//
+// Returns:
+//   - The LSN assigned to the entry.
+//   - An error if the entry cannot be written or synced, or ErrClosed if the GroupCommitter is closed.
+//     If only the sync failed, the LSN is returned too but the entry may not be durable.
+func (g *GroupCommitter) Commit(data []byte) (uint64, error) {
+	request := commitRequest{data: data, result: make(chan commitResult, 1)}
+
+	select {
+	case g.requests <- request:
+	case <-g.quit:
+		return 0, ErrClosed
+	}
+
+	result := <-request.result
+	return result.lsn, result.err
+}
+
+// Close stops the GroupCommitter, once every entry already accepted is committed.
+// Calls to Commit after Close return ErrClosed. The Wal is not closed.
+//
+// Returns:
+//   - Always nil. It exists so GroupCommitter can be used as an io.Closer.
+func (g *GroupCommitter) Close() error {
+	g.stop.Do(func() {
+		close(g.quit)
+	})
+	<-g.done
+	return nil
+}
+
+// run collects entries into batches and commits them, until Close is called.
+func (g *GroupCommitter) run() {
+	defer close(g.done)
+
+	for {
+		// Wait for the first entry of the batch
+		var first commitRequest
+		select {
+		case first = <-g.requests:
+		case <-g.quit:
+			return
+		}
+
+		batch := g.collect([]commitRequest{first})
+		g.commit(batch)
+	}
+}
+
+// collect adds entries to the batch until it is full or MaxWait has elapsed.
+//
+// Parameters:
+//   - batch: A batch with its first entry.
+//
+// Returns:
+//   - The batch with every entry collected.
+func (g *GroupCommitter) collect(batch []commitRequest) []commitRequest {
+	// Without waiting, only take the entries already pending
+	if g.options.MaxWait <= 0 {
+		for len(batch) < g.options.MaxBatchSize {
+			select {
+			case request := <-g.requests:
+				batch = append(batch, request)
+			default:
+				return batch
+			}
+		}
+		return batch
+	}
+
+	timer := time.NewTimer(g.options.MaxWait)
+	defer timer.Stop()
+
+	for len(batch) < g.options.MaxBatchSize {
+		select {
+		case request := <-g.requests:
+			batch = append(batch, request)
+		case <-timer.C:
+			return batch
+		case <-g.quit:
+			return batch
+		}
+	}
+	return batch
+}
+
+// commit writes every entry of the batch, syncs the Wal once and releases the callers.
+//
+// Parameters:
+//   - batch: The entries to be committed.
+func (g *GroupCommitter) commit(batch []commitRequest) {
+	results := make([]commitResult, len(batch))
+	written := false
+	for i, request := range batch {
+		lsn, err := g.wal.WriteBuffer(request.data)
+		results[i] = commitResult{lsn: lsn, err: err}
+		if lsn != 0 {
+			written = true
+		}
+	}
+
+	// A failed sync means no entry of the batch can be considered durable
+	if written {
+		err := g.wal.Sync()
+		if err != nil {
+			for i := range results {
+				if results[i].err == nil {
+					results[i].err = err
+				}
+			}
+		}
+	}
+
+	for i, request := range batch {
+		request.result <- results[i]
+	}
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/casteloig/walrog/internal/faultfs"
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// newGroupCommitWal creates a Wal that only syncs when asked to, and counts its syncs,
+// so every sync is the one of a batch.
+func newGroupCommitWal(t *testing.T) (*Wal, *WalOptions, *atomic.Int64) {
+	t.Helper()
+	fs := faultfs.New(1)
+	syncs := &atomic.Int64{}
+	fs.SetFault(func(op faultfs.Op, name string) error {
+		if op == faultfs.OpSync {
+			syncs.Add(1)
+		}
+		return nil
+	})
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fs
+	options := &WalOptions{
+		BufferSize:      4096,
+		SegmentSize:     1 << 20,
+		FileHandlerOpts: &fileHandlerOpts,
+		SyncMode:        SyncNever,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	syncs.Store(0)
+	return w, options, syncs
+}
+
+func TestGroupCommit(t *testing.T) {
+	testCases := []struct {
+		name            string
+		options         *GroupCommitOptions
+		writers         int
+		expectedBatched bool // Expected fewer batches than writers
+	}{
+		{
+			name:            "Default options",
+			options:         nil,
+			writers:         50,
+			expectedBatched: true,
+		},
+		{
+			name:            "Waiting for full batches",
+			options:         &GroupCommitOptions{MaxBatchSize: 10, MaxWait: time.Second},
+			writers:         50,
+			expectedBatched: true,
+		},
+		{
+			name:    "One entry per batch",
+			options: &GroupCommitOptions{MaxBatchSize: 1, MaxWait: time.Second},
+			writers: 20,
+		},
+		{
+			name:    "No waiting",
+			options: &GroupCommitOptions{MaxBatchSize: 10, MaxWait: 0},
+			writers: 20,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w, opts, syncs := newGroupCommitWal(t)
+			defer w.Close()
+
+			g := NewGroupCommitter(w, tc.options)
+
+			var wg sync.WaitGroup
+			lsns := make([]uint64, tc.writers)
+			for i := range lsns {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					lsn, err := g.Commit([]byte{byte(i)})
+					if err != nil {
+						t.Errorf("Commit() failed: %v", err)
+					}
+					lsns[i] = lsn
+				}(i)
+			}
+			wg.Wait()
+			g.Close()
+
+			// Every writer got a different LSN
+			seen := make(map[uint64]bool)
+			for _, lsn := range lsns {
+				if lsn < firstLSN || lsn > uint64(tc.writers) || seen[lsn] {
+					t.Fatalf("Expected unique LSNs from 1 to %d, got %v", tc.writers, lsns)
+				}
+				seen[lsn] = true
+			}
+
+			batches := int(syncs.Load())
+			if tc.expectedBatched && batches >= tc.writers {
+				t.Errorf("Expected fewer than %d batches, got %d", tc.writers, batches)
+			}
+			if tc.options != nil && batches*tc.options.MaxBatchSize < tc.writers {
+				t.Errorf("Expected batches of at most %d entries, got %d batches", tc.options.MaxBatchSize, batches)
+			}
+
+			// Entries are on disk without flushing the Wal
+			entries, err := Recover(opts)
+			if err != nil {
+				t.Fatalf("Recover() failed: %v", err)
+			}
+			if len(entries) != tc.writers {
+				t.Fatalf("Expected %d entries, got %d", tc.writers, len(entries))
+			}
+			for i, lsn := range lsns {
+				if entries[lsn-1].Data[0] != byte(i) {
+					t.Errorf("Expected data %d at LSN %d, got %d", i, lsn, entries[lsn-1].Data[0])
+				}
+			}
+		})
+	}
+}
+
+func TestGroupCommitClosed(t *testing.T) {
+	w, _ := newTestWal(t, 0)
+	defer w.Close()
+
+	g := NewGroupCommitter(w, nil)
+	g.Close()
+
+	if _, err := g.Commit([]byte("late")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err := g.Close(); err != nil {
+		t.Errorf("Expected second Close() to do nothing, got %v", err)
+	}
+}
@@ -0,0 +1,460 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync/atomic"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// Reader iterates over the entries stored in the Wal folder, segment by segment,
+// reading one record at a time so memory usage does not depend on the size of the WAL.
+// Like RecoverFunc, it starts after the last checkpoint and skips the entries discarded by Truncate,
+// and Seek moves it to any entry still on disk.
+//
+//	r, err := NewReader(options)
+//	...
+//	defer r.Close()
+//	for r.Next() {
+//		entry := r.Entry()
+//	}
+//	if err := r.Err(); err != nil {
+//		...
+//	}
+//
+// A Reader is not safe for concurrent use, but it can be used while a Wal writes to the same folder.
+type Reader struct {
+	options   *WalOptions
+	paths     []string // WAL files, in creation order
+	segment   int      // Index in paths of the file being read
+	file      fh.File
+	reader    *bufio.Reader
+	version   int              // Format version of the file being read
+	firstLSN  uint64           // Records with a lower LSN are stale, see segmentFirstLSN
+	offset    int64            // Offset in the file where the next record starts
+	from      uint64           // Entries with a lower LSN are skipped
+	assembler entryAssembler   // Joins fragments and holds back incomplete batches
+	ready     []RecoveredEntry // Entries completed, waiting to be returned by Next
+	entry     RecoveredEntry
+	err       error
+	stopped   bool          // An invalid record ended the WAL, see RecoveryMode
+	wal       *Wal          // Wal followed by NextContext, if any
+	waitErr   error         // Why the last NextContext stopped waiting
+	pin       atomic.Uint64 // Retention keeps the entries from this LSN on, for a Reader following a Wal
+}
+
+// NewReader creates a Reader over the Wal stored in the Wal folder.
+// If a nil argument is passed, it will use the default options.
+//
+// Parameters:
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
+//
+// Returns:
+//   - A pointer to the Reader, positioned before the first entry after the last checkpoint.
+//   - An error if the WAL files, the low-water mark or the checkpoint cannot be read.
+func NewReader(options *WalOptions) (*Reader, error) {
+	if options == nil {
+		options = DefaultWalOptions
+	}
+
+	r := &Reader{options: options}
+	err := r.start()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// start positions a new Reader before the first entry after the last checkpoint.
+//
+// Returns:
+//   - An error if the WAL files, the low-water mark or the checkpoint cannot be read.
+func (r *Reader) start() error {
+	var err error
+	r.paths, err = fh.ListWalFiles(*r.options.FileHandlerOpts)
+	if err != nil {
+		return err
+	}
+
+	// Entries below the low-water mark were discarded by Truncate
+	r.from, err = readLowWaterMark(*r.options.FileHandlerOpts)
+	if err != nil {
+		return err
+	}
+
+	// Entries up to the checkpoint do not need to be replayed,
+	// so start right after it if its segment is still there
+	checkpoint, hasCheckpoint, err := ReadCheckpoint(r.options)
+	if err != nil {
+		return err
+	}
+	var segment int
+	var offset int64
+	if hasCheckpoint {
+		r.from = max(r.from, checkpoint.LSN+1)
+		for i, p := range r.paths {
+			if filepath.Base(p) == checkpoint.Segment {
+				segment, offset = i, checkpoint.Offset
+				break
+			}
+		}
+	}
+
+	return r.open(segment, offset)
+}
+
+// Next advances the Reader to the next entry, opening the following segments as needed.
+// An entry torn at the end of the last segment is considered the end of the WAL,
+// and Next can be called again later to read the entries written since then.
+// Other invalid records are handled as set by WalOptions.RecoveryMode.
+//
+// Returns:
+//   - true if there is an entry available through Entry.
+//   - false when there are no more entries or an error happened, see Err.
+func (r *Reader) Next() bool {
+	for r.err == nil && !r.stopped {
+		if len(r.ready) > 0 {
+			r.entry = r.ready[0]
+			r.ready = r.ready[1:]
+			return true
+		}
+		if r.file == nil {
+			// The last segment may have been created right before, without its header yet
+			if r.segment == len(r.paths)-1 {
+				r.err = r.open(r.segment, 0)
+				if r.file != nil {
+					continue
+				}
+			}
+			return false
+		}
+
+		record, recordSize, err := readRecord(r.reader, r.version)
+		if err == nil && record.LSN < r.firstLSN {
+			// Stale record of the segment the file was recycled from, the segment ends before it
+			err = io.EOF
+		}
+		if err != nil {
+			last := r.segment == len(r.paths)-1
+			torn := err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF)
+			// Only a Wal that may still be writing the last record excuses a torn tail with RecoverFail
+			if last && torn && (err == io.EOF || r.options.RecoveryMode != RecoverFail || r.wal != nil) {
+				// The Wal may have rotated to new segments since the Reader listed them
+				rotated, refreshErr := r.refresh()
+				if refreshErr != nil {
+					r.err = refreshErr
+					return false
+				}
+				if rotated {
+					r.err = r.seek(r.offset)
+					continue
+				}
+				if r.version == formatVersionLegacy && r.offset == 0 {
+					// An empty segment may get its header later: read it again on the next call
+					r.err = r.closeFile()
+					return false
+				}
+				// Forget what was read of a torn record, it may be complete on the next call
+				r.err = r.seek(r.offset)
+				return false
+			}
+			if err == io.EOF {
+				r.err = r.open(r.segment+1, 0)
+				continue
+			}
+			if !invalidRecord(err) {
+				r.err = fmt.Errorf("failed to recover %s: %w", filepath.Base(r.paths[r.segment]), err)
+				return false
+			}
+			r.err = r.corrupted(err)
+			continue
+		}
+		r.offset += int64(recordSize)
+
+		// Cannot fail: keepEntry never returns an error
+		_ = r.assembler.add(record, r.keepEntry)
+	}
+	return false
+}
+
+// Entry returns the entry the Reader is positioned at.
+// It must only be called after Next returned true.
+func (r *Reader) Entry() RecoveredEntry {
+	return r.entry
+}
+
+// Err returns the first error found by the Reader, if any.
+// After NextContext, it also returns why it stopped waiting, e.g. the context error.
+func (r *Reader) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.waitErr
+}
+
+// Seek moves the Reader right before the entry with the given LSN, so the next call to Next
+// returns it. The segment holding the entry is found from the first LSN of each segment,
+// so only that segment is scanned. Entries covered by the checkpoint can be read again.
+//
+// Parameters:
+//   - lsn: The LSN of the next entry to read. If it has not been written yet,
+//     the Reader is moved to the end of the WAL.
+//
+// Returns:
+//   - An error if the entry was discarded by Truncate, or the WAL files cannot be read.
+func (r *Reader) Seek(lsn uint64) error {
+	lsn = max(lsn, firstLSN)
+
+	lowWaterMark, err := readLowWaterMark(*r.options.FileHandlerOpts)
+	if err != nil {
+		return err
+	}
+	if lsn < lowWaterMark {
+		return fmt.Errorf("cannot seek to LSN %d, entries below %d were discarded", lsn, lowWaterMark)
+	}
+
+	// New segments may have been written since the Reader was created
+	paths, err := fh.ListWalFiles(*r.options.FileHandlerOpts)
+	if err != nil {
+		return err
+	}
+	// Retention must keep the entry until its segment is opened
+	r.pin.Store(min(r.pin.Load(), lsn))
+	segment, offset, err := locateEntry(r.options, paths, lsn)
+	if err != nil {
+		return err
+	}
+
+	r.paths = paths
+	r.from = lsn
+	r.assembler = entryAssembler{}
+	r.ready = nil
+	r.entry = RecoveredEntry{}
+	r.stopped = false
+	r.err = r.open(segment, offset)
+	return r.err
+}
+
+// Close releases the file held by the Reader. A Reader following a Wal stops pinning
+// the entries it has not read yet, so retention can remove them.
+//
+// Returns:
+//   - An error if the file cannot be closed.
+func (r *Reader) Close() error {
+	if r.wal != nil {
+		r.wal.unpinReader(r)
+	}
+	return r.closeFile()
+}
+
+// closeFile closes the file being read, if any.
+//
+// Returns:
+//   - An error if the file cannot be closed.
+func (r *Reader) closeFile() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close WAL file: %w", err)
+	}
+	return nil
+}
+
+// corrupted handles an invalid record found by Next, as set by WalOptions.RecoveryMode.
+// The bytes dropped are reported to WalOptions.OnCorruption.
+//
+// Parameters:
+//   - err: Why the record at the current offset is invalid.
+//
+// Returns:
+//   - An error if the invalid record cannot be dropped in the recovery mode, or the WAL files cannot be read.
+func (r *Reader) corrupted(err error) error {
+	segment := filepath.Base(r.paths[r.segment])
+	info, statErr := r.file.Stat()
+	if statErr != nil {
+		return fmt.Errorf("failed to read WAL file size: %w", statErr)
+	}
+	size := info.Size()
+
+	switch r.options.RecoveryMode {
+	case RecoverSkip:
+		// Go on from the next valid record, or the end of the segment
+		next, _, findErr := findNextRecord(r.file, r.version, r.offset+1)
+		if findErr != nil {
+			return findErr
+		}
+		r.options.reportCorruption(Corruption{Segment: segment, Offset: r.offset, Size: next - r.offset, Err: err})
+		return r.seek(next)
+	case RecoverStop:
+	case RecoverTruncateTail:
+		if r.segment < len(r.paths)-1 {
+			return fmt.Errorf("failed to recover %s: %w", segment, err)
+		}
+	default:
+		return fmt.Errorf("failed to recover %s: %w", segment, err)
+	}
+
+	// Everything from the invalid record on is dropped
+	r.stopped = true
+	r.options.reportCorruption(Corruption{Segment: segment, Offset: r.offset, Size: size - r.offset, Err: err})
+	return r.options.reportLater(r.paths[r.segment+1:])
+}
+
+// refresh lists the WAL files again to find the segments created after the one being read.
+//
+// Returns:
+//   - true if there are segments after the one being read.
+//   - An error if the WAL files cannot be listed.
+func (r *Reader) refresh() (bool, error) {
+	paths, err := fh.ListWalFiles(*r.options.FileHandlerOpts)
+	if err != nil {
+		return false, err
+	}
+
+	// Older segments may have been removed by Truncate
+	current := r.paths[r.segment]
+	for i, p := range paths {
+		if p == current {
+			r.paths = paths
+			r.segment = i
+			return i < len(paths)-1, nil
+		}
+	}
+	return false, nil
+}
+
+// keepEntry queues the entries completed by the assembler, unless they are skipped.
+func (r *Reader) keepEntry(entry RecoveredEntry) error {
+	if entry.LSN >= r.from {
+		r.ready = append(r.ready, entry)
+	}
+	return nil
+}
+
+// open closes the file being read and opens a segment at the given offset.
+// Segments deleted in the meantime by Truncate are skipped. If the last segment has no
+// header yet, no file is left open and Next tries to open it again.
+//
+// Parameters:
+//   - segment: The index in paths of the segment. Past the last one, the Reader is at the end.
+//   - offset: The offset where a record starts. 0 reads the whole segment.
+//
+// Returns:
+//   - An error if the segment cannot be opened or its header is corrupted.
+func (r *Reader) open(segment int, offset int64) error {
+	err := r.closeFile()
+	if err != nil {
+		return err
+	}
+
+	for ; segment < len(r.paths); segment, offset = segment+1, 0 {
+		r.segment = segment
+		// Older segments are not read anymore. Legacy segments pin every entry
+		firstLSN, _ := fh.WalFileFirstLSN(r.paths[segment])
+		r.pin.Store(firstLSN)
+		file, err := fh.OpenFile(*r.options.FileHandlerOpts, r.paths[segment])
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open WAL file: %w", err)
+		}
+
+		reader := bufio.NewReader(file)
+		version, headerSize, err := readSegmentHeader(reader)
+		if err != nil {
+			file.Close()
+			// The header of the last segment may still be being written
+			if errors.Is(err, io.ErrUnexpectedEOF) && segment == len(r.paths)-1 {
+				return nil
+			}
+			return fmt.Errorf("failed to recover %s: %w", filepath.Base(r.paths[segment]), err)
+		}
+
+		r.file = file
+		r.reader = reader
+		r.version = version
+		r.firstLSN = segmentFirstLSN(file)
+		r.offset = int64(headerSize)
+		if offset > r.offset {
+			return r.seek(offset)
+		}
+		return nil
+	}
+
+	r.segment = len(r.paths)
+	return nil
+}
+
+// seek moves the Reader to an offset of the segment being read.
+//
+// Parameters:
+//   - offset: The offset where a record starts.
+//
+// Returns:
+//   - An error if the file cannot be seeked.
+func (r *Reader) seek(offset int64) error {
+	_, err := r.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek WAL file: %w", err)
+	}
+	r.reader.Reset(r.file)
+	r.offset = offset
+	return nil
+}
+
+// locateEntry finds the position in the WAL files where the entry with the given LSN starts.
+// Segments hold increasing LSNs, so the first LSN of each one tells which segment to scan.
+// It is taken from the name of the segment, only legacy segments have to be opened.
+//
+// Parameters:
+//   - options: A pointer to WalOptions with the filesystem and the recovery mode.
+//   - paths: The paths of the WAL files, in creation order.
+//   - lsn: The LSN of the entry.
+//
+// Returns:
+//   - The index in paths of the segment holding the entry.
+//   - The offset in that segment where the entry starts, or the end of the WAL if it is not there.
+//   - An error if any segment cannot be read.
+func locateEntry(options *WalOptions, paths []string, lsn uint64) (int, int64, error) {
+	if len(paths) == 0 {
+		return 0, 0, nil
+	}
+
+	// Walk backwards to the last segment starting at or before lsn
+	start := 0
+	for i := len(paths) - 1; i > 0; i-- {
+		// The entry with the LSN in the name may start in the segment before
+		first, named := fh.WalFileFirstLSN(paths[i])
+		if named {
+			if first < lsn {
+				start = i
+				break
+			}
+			continue
+		}
+
+		first, found, err := readFirstLSN(*options.FileHandlerOpts, paths[i])
+		if err != nil {
+			return 0, 0, err
+		}
+		if found && first <= lsn {
+			start = i
+			break
+		}
+	}
+
+	segment, offset, _, err := locateAfter(options, paths[start:], lsn-1)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start + segment, offset, nil
+}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	w, options := newTestWal(t, 20)
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	r, err := NewReader(options)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %v", err)
+	}
+	defer r.Close()
+
+	count := 0
+	for r.Next() {
+		count++
+		if r.Entry().LSN != uint64(count) {
+			t.Errorf("Expected LSN %d, got %d", count, r.Entry().LSN)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Reader failed: %v", err)
+	}
+	if count != 20 {
+		t.Errorf("Expected 20 entries, got %d", count)
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	testCases := []struct {
+		name          string
+		lsn           uint64
+		expectedFirst uint64
+		expectedCount int
+	}{
+		{name: "First entry", lsn: 1, expectedFirst: 1, expectedCount: 23},
+		{name: "LSN 0", lsn: 0, expectedFirst: 1, expectedCount: 23},
+		{name: "Middle of a segment", lsn: 7, expectedFirst: 7, expectedCount: 17},
+		{name: "Start of a segment", lsn: 9, expectedFirst: 9, expectedCount: 15},
+		{name: "Fragmented entry", lsn: 21, expectedFirst: 21, expectedCount: 3},
+		{name: "Inside a batch", lsn: 23, expectedFirst: 23, expectedCount: 1},
+		{name: "Start of a batch", lsn: 22, expectedFirst: 22, expectedCount: 2},
+		{name: "Not written yet", lsn: 30, expectedCount: 0},
+	}
+
+	// 20 entries, a fragmented one and a batch of 2
+	w, options := newTestWal(t, 20)
+	_, err := w.WriteBuffer(make([]byte, 300))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	var batch Batch
+	batch.Add([]byte("first"))
+	batch.Add([]byte("second"))
+	_, err = w.WriteBatch(&batch)
+	if err != nil {
+		t.Fatalf("WriteBatch() failed: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	r, err := NewReader(options)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %v", err)
+	}
+	defer r.Close()
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := r.Seek(tc.lsn)
+			if err != nil {
+				t.Fatalf("Seek() failed: %v", err)
+			}
+
+			count := 0
+			for r.Next() {
+				if count == 0 && r.Entry().LSN != tc.expectedFirst {
+					t.Errorf("Expected first LSN %d, got %d", tc.expectedFirst, r.Entry().LSN)
+				}
+				count++
+			}
+			if err := r.Err(); err != nil {
+				t.Fatalf("Reader failed: %v", err)
+			}
+			if count != tc.expectedCount {
+				t.Errorf("Expected %d entries, got %d", tc.expectedCount, count)
+			}
+		})
+	}
+}
+
+func TestReaderSeekTruncated(t *testing.T) {
+	w, options := newTestWal(t, 20)
+	defer w.Close()
+
+	err := w.Truncate(10)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+
+	r, err := NewReader(options)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %v", err)
+	}
+	defer r.Close()
+
+	if err := r.Seek(5); err == nil {
+		t.Errorf("Expected Seek() to a discarded entry to fail")
+	}
+	if err := r.Seek(10); err != nil {
+		t.Fatalf("Seek() failed: %v", err)
+	}
+	if !r.Next() || r.Entry().LSN != 10 {
+		t.Errorf("Expected entry 10 after Seek(10)")
+	}
+}
+
+func TestReaderNewEntries(t *testing.T) {
+	w, options := newTestWal(t, 2)
+	defer w.Close()
+	err := w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+
+	r, err := NewReader(options)
+	if err != nil {
+		t.Fatalf("NewReader() failed: %v", err)
+	}
+	defer r.Close()
+
+	count := 0
+	for r.Next() {
+		count++
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 entries, got %d", count)
+	}
+
+	// Entries flushed after reaching the end are read on the next call
+	_, err = w.WriteBuffer([]byte("0123456789"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	if !r.Next() || r.Entry().LSN != 3 {
+		t.Errorf("Expected entry 3 once flushed")
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Reader failed: %v", err)
+	}
+}
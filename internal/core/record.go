@@ -0,0 +1,105 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+	"github.com/casteloig/walrog/internal/record"
+)
+
+// The on-disk format of the WAL files is described in package record,
+// these are the names core uses for it.
+const (
+	formatVersionLegacy = record.FormatVersionLegacy
+	formatVersionLatest = record.FormatVersionLatest
+
+	segmentHeaderSize      = record.SegmentHeaderSize
+	legacyRecordHeaderSize = record.LegacyHeaderSize
+	recordHeaderSize       = record.HeaderSize
+	recordCRCSize          = record.CRCSize
+)
+
+// Record types of format version 1.
+const (
+	recordTypeFull   = record.TypeFull
+	recordTypeFirst  = record.TypeFirst
+	recordTypeMiddle = record.TypeMiddle
+	recordTypeLast   = record.TypeLast
+
+	recordFlagBatch = record.FlagBatch
+)
+
+// writeSegmentHeader empties a new WAL file and writes the header of the latest format version.
+// The file offset is left at the end of the header, ready to append records.
+//
+// Parameters:
+//   - file: A pointer to the WAL file.
+//
+// Returns:
+//   - An error if the header cannot be written.
+func writeSegmentHeader(file fh.File) error {
+	err := file.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("failed to empty WAL file: %w", err)
+	}
+	return overwriteSegmentHeader(file)
+}
+
+// overwriteSegmentHeader writes the header of the latest format version over the one of a WAL file,
+// keeping the rest of its content, e.g. the stale records of a recycled file.
+// The file offset is left at the end of the header, ready to append records.
+//
+// Parameters:
+//   - file: A pointer to the WAL file.
+//
+// Returns:
+//   - An error if the header cannot be written.
+func overwriteSegmentHeader(file fh.File) error {
+	_, err := file.WriteAt(record.SegmentHeader(), 0)
+	if err != nil {
+		return fmt.Errorf("failed to write segment header: %w", err)
+	}
+
+	_, err = file.Seek(segmentHeaderSize, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek WAL file: %w", err)
+	}
+	return nil
+}
+
+// readSegmentHeader reads the header at the beginning of a WAL file, see record.ReadSegmentHeader.
+func readSegmentHeader(reader *bufio.Reader) (int, int, error) {
+	return record.ReadSegmentHeader(reader)
+}
+
+// encodeRecord builds a record of the latest format version, see record.Encode.
+func encodeRecord(lsn uint64, recordType byte, data []byte) ([]byte, error) {
+	return record.Encode(lsn, recordType, data)
+}
+
+// readRecord reads the next record of a WAL file, see record.Decode.
+// Fragments are returned as they are, see entryAssembler to join them back.
+//
+// Parameters:
+//   - reader: A reader positioned at the beginning of a record.
+//   - version: The format version of the WAL file.
+//
+// Returns:
+//   - The entry stored in the record.
+//   - The size of the record in the file.
+//   - io.EOF if there are no more records, or an error if the record is torn or corrupted.
+func readRecord(reader io.Reader, version int) (RecoveredEntry, int, error) {
+	decoded, size, err := record.Decode(reader, version)
+	if err != nil {
+		return RecoveredEntry{}, 0, err
+	}
+	entry := RecoveredEntry{
+		LSN:            decoded.LSN,
+		Data:           decoded.Data,
+		recordType:     decoded.Type,
+		batchContinues: decoded.BatchContinues,
+	}
+	return entry, size, nil
+}
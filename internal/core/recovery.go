@@ -0,0 +1,146 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+	"github.com/casteloig/walrog/internal/record"
+	utils "github.com/casteloig/walrog/internal/utils"
+)
+
+// RecoveryMode defines what recovery does when it finds a torn or corrupted record,
+// both when reading the WAL and when OpenWal resumes appending to it.
+type RecoveryMode int
+
+const (
+	// RecoverTruncateTail drops everything from the first invalid record of the last segment,
+	// which is what a crash in the middle of a write leaves behind, and OpenWal truncates it.
+	// An invalid record in any other segment is an error. This is the default.
+	RecoverTruncateTail RecoveryMode = iota
+	// RecoverStop stops at the first invalid record, whatever the segment: every entry after it
+	// is dropped, and OpenWal truncates the WAL there, removing the later segments.
+	RecoverStop
+	// RecoverSkip skips invalid records and continues with the next valid one, found by
+	// scanning the rest of the segment. A torn tail of the last segment is truncated by OpenWal.
+	RecoverSkip
+	// RecoverFail fails on any invalid record, even a torn tail left by a crash.
+	// Readers following a running Wal still wait for the record being written at the tail.
+	RecoverFail
+)
+
+// Corruption describes a part of a WAL file dropped by recovery.
+type Corruption struct {
+	Segment string // Name of the WAL file
+	Offset  int64  // Offset where the dropped bytes start
+	Size    int64  // Number of bytes dropped
+	Err     error  // Why they were dropped
+}
+
+// errAfterCorruption is reported for the segments dropped by RecoverStop after an invalid record.
+var errAfterCorruption = errors.New("segment after an invalid record")
+
+// invalidRecord checks if an error reading a record means the record is torn or corrupted,
+// so recovery can drop it, rather than the file not being readable.
+func invalidRecord(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, record.ErrCorrupt)
+}
+
+// reportCorruption passes a Corruption to WalOptions.OnCorruption, if set.
+//
+// Parameters:
+//   - corruption: The part of a WAL file dropped by recovery.
+func (o *WalOptions) reportCorruption(corruption Corruption) {
+	if o.OnCorruption != nil {
+		o.OnCorruption(corruption)
+	}
+}
+
+// skipCorrupt returns the function scanFile needs to skip invalid records with RecoverSkip
+// when looking for an entry. Recovery already reported them, so they are skipped silently.
+//
+// Returns:
+//   - A function ignoring the records skipped, or nil if invalid records must not be skipped.
+func (o *WalOptions) skipCorrupt() func(Corruption) {
+	if o.RecoveryMode != RecoverSkip {
+		return nil
+	}
+	return func(Corruption) {}
+}
+
+// reportLater reports every segment after the given one as dropped, when RecoverStop stops
+// at an invalid record.
+//
+// Parameters:
+//   - paths: The paths of the segments dropped.
+//
+// Returns:
+//   - An error if the size of a segment cannot be read.
+func (o *WalOptions) reportLater(paths []string) error {
+	for _, p := range paths {
+		info, err := fh.StatFile(*o.FileHandlerOpts, p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read WAL file size: %w", err)
+		}
+		o.reportCorruption(Corruption{Segment: filepath.Base(p), Size: info.Size(), Err: errAfterCorruption})
+	}
+	return nil
+}
+
+// findNextRecord looks for the next valid record after an invalid one, trying every offset
+// until a record decodes with a valid CRC. The rest of the file is read into memory to do so.
+//
+// Parameters:
+//   - file: A pointer to the WAL file.
+//   - version: The format version of the file.
+//   - from: The offset to start looking at.
+//
+// Returns:
+//   - The offset where the next valid record starts.
+//   - false if there is no valid record after from. The offset returned is then the file size.
+//   - An error if the file cannot be read.
+func findNextRecord(file fh.File, version int, from int64) (int64, bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read WAL file size: %w", err)
+	}
+	size := info.Size()
+	if from >= size {
+		return size, false, nil
+	}
+
+	rest := make([]byte, size-from)
+	_, err = file.ReadAt(rest, from)
+	if err != nil && err != io.EOF {
+		return 0, false, fmt.Errorf("failed to read WAL file: %w", err)
+	}
+
+	headerSize := recordHeaderSize
+	lengthAt := 8
+	if version == formatVersionLegacy {
+		headerSize = legacyRecordHeaderSize
+		lengthAt = 4
+	}
+
+	for start := 0; start+headerSize+recordCRCSize <= len(rest); start++ {
+		// Only decode records that fit in the file
+		dataLength := int64(utils.BytesToUint32(rest[start+lengthAt : start+lengthAt+4]))
+		end := int64(start+headerSize+recordCRCSize) + dataLength
+		if end > int64(len(rest)) {
+			continue
+		}
+
+		_, _, err := readRecord(bytes.NewReader(rest[start:end]), version)
+		if err == nil {
+			return from + int64(start), true, nil
+		}
+	}
+	return size, false, nil
+}
@@ -0,0 +1,288 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// crashTestWal writes 10 entries to a Wal in 3 segments, like after a crash: the CRC of
+// the entry with LSN 2 is corrupted, and the last segment ends with a torn record.
+// It returns the options and the paths of the segments.
+func crashTestWal(t *testing.T, mode RecoveryMode, reports *[]Corruption) (*WalOptions, []string) {
+	w, options := newTestWal(t, 10)
+	err := w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	crash(w)
+
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	if len(paths) != 3 {
+		t.Fatalf("Expected 3 segments, got %d", len(paths))
+	}
+
+	// Every record is 27 bytes long, flip the last byte of the CRC of the second one
+	first, err := os.OpenFile(paths[0], os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	_, err = first.WriteAt([]byte{0xff}, segmentHeaderSize+2*27-1)
+	first.Close()
+	if err != nil {
+		t.Fatalf("WriteAt() failed: %v", err)
+	}
+
+	last, err := os.OpenFile(paths[2], os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	_, err = last.Write([]byte{0, 0, 0, 0, 0})
+	last.Close()
+	if err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	options.RecoveryMode = mode
+	options.OnCorruption = func(c Corruption) {
+		*reports = append(*reports, c)
+	}
+	return options, paths
+}
+
+func TestRecoveryModes(t *testing.T) {
+	corrupted := report{0, segmentHeaderSize + 27, 27}
+	torn := report{2, segmentHeaderSize + 2*27, 5}
+	stopped := []report{
+		{0, segmentHeaderSize + 27, 3 * 27},
+		{1, 0, segmentHeaderSize + 4*27},
+		{2, 0, segmentHeaderSize + 2*27 + 5},
+	}
+
+	tests := []struct {
+		name    string
+		mode    RecoveryMode
+		wantErr bool
+		entries int
+		reports []report
+	}{
+		{"TruncateTail", RecoverTruncateTail, true, 0, nil},
+		{"Stop", RecoverStop, false, 1, stopped},
+		// The torn tail may still be written by a running Wal, so it is not reported
+		{"Skip", RecoverSkip, false, 9, []report{corrupted}},
+		{"Fail", RecoverFail, true, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reports []Corruption
+			options, paths := crashTestWal(t, tt.mode, &reports)
+
+			entries, err := Recover(options)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Expected Recover() to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Recover() failed: %v", err)
+			}
+			if len(entries) != tt.entries {
+				t.Fatalf("Expected %d entries, got %d", tt.entries, len(entries))
+			}
+			if entries[0].LSN != 1 || (len(entries) > 1 && entries[1].LSN != 3) {
+				t.Errorf("Expected the entry with LSN 2 to be dropped, got %+v", entries)
+			}
+			checkReports(t, paths, reports, tt.reports)
+		})
+	}
+
+	// OpenWal also drops the torn tail
+	openTests := []struct {
+		name     string
+		mode     RecoveryMode
+		wantErr  bool
+		nextLSN  uint64
+		segments int
+		reports  []report
+	}{
+		{"TruncateTail", RecoverTruncateTail, true, 0, 0, nil},
+		{"Stop", RecoverStop, false, 2, 1, stopped},
+		{"Skip", RecoverSkip, false, 11, 3, []report{corrupted, torn}},
+		{"Fail", RecoverFail, true, 0, 0, nil},
+	}
+
+	for _, tt := range openTests {
+		t.Run("OpenWal"+tt.name, func(t *testing.T) {
+			var reports []Corruption
+			options, walPaths := crashTestWal(t, tt.mode, &reports)
+
+			w, err := OpenWal(options)
+			if tt.wantErr {
+				if err == nil {
+					w.Close()
+					t.Fatalf("Expected OpenWal() to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenWal() failed: %v", err)
+			}
+			defer w.Close()
+			checkReports(t, walPaths, reports, tt.reports)
+
+			paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+			if err != nil {
+				t.Fatalf("ListWalFiles() failed: %v", err)
+			}
+			if len(paths) != tt.segments {
+				t.Errorf("Expected %d segments, got %d", tt.segments, len(paths))
+			}
+			lsn, err := w.WriteBuffer([]byte("after"))
+			if err != nil {
+				t.Fatalf("WriteBuffer() failed: %v", err)
+			}
+			if lsn != tt.nextLSN {
+				t.Errorf("Expected LSN %d, got %d", tt.nextLSN, lsn)
+			}
+		})
+	}
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    RecoveryMode
+		wantErr bool
+	}{
+		{"TruncateTail", RecoverTruncateTail, false},
+		{"Stop", RecoverStop, false},
+		{"Skip", RecoverSkip, false},
+		{"Fail", RecoverFail, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reports []Corruption
+			options, paths := crashTestWal(t, tt.mode, &reports)
+
+			// Leave only the torn tail
+			err := os.Remove(paths[0])
+			if err != nil {
+				t.Fatalf("Remove() failed: %v", err)
+			}
+
+			w, err := OpenWal(options)
+			if tt.wantErr {
+				if err == nil {
+					w.Close()
+					t.Fatalf("Expected OpenWal() to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenWal() failed: %v", err)
+			}
+			defer w.Close()
+
+			want := report{2, segmentHeaderSize + 2*27, 5}
+			checkReports(t, paths, reports, []report{want})
+			info, err := w.HotFile.Stat()
+			if err != nil {
+				t.Fatalf("Stat() failed: %v", err)
+			}
+			if info.Size() != want.offset {
+				t.Errorf("Expected the hot file to be truncated to %d bytes, got %d", want.offset, info.Size())
+			}
+		})
+	}
+}
+
+func TestRecoverCorruptedLastSegment(t *testing.T) {
+	var reports []Corruption
+	options, paths := crashTestWal(t, RecoverTruncateTail, &reports)
+
+	// With the corrupted record in the last segment, it is dropped along with the rest
+	for _, p := range paths[1:] {
+		err := os.Remove(p)
+		if err != nil {
+			t.Fatalf("Remove() failed: %v", err)
+		}
+	}
+
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected 1 entry, got %d", len(entries))
+	}
+	checkReports(t, paths, reports, []report{{0, segmentHeaderSize + 27, 3 * 27}})
+}
+
+// report is a Corruption expected by a test, in the segment with the given index.
+type report struct {
+	segment      int
+	offset, size int64
+}
+
+// checkReports compares the Corruptions reported with the expected ones.
+func checkReports(t *testing.T, paths []string, got []Corruption, want []report) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d reports, got %d: %+v", len(want), len(got), got)
+	}
+	for i, w := range want {
+		if got[i].Err == nil {
+			t.Errorf("Expected report %d to have an error", i)
+		}
+		expected := Corruption{Segment: filepath.Base(paths[w.segment]), Offset: w.offset, Size: w.size, Err: got[i].Err}
+		if got[i] != expected {
+			t.Errorf("Expected report %+v, got %+v", expected, got[i])
+		}
+	}
+}
+
+func TestFindNextRecord(t *testing.T) {
+	record, err := encodeRecord(7, recordTypeFull, []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("encodeRecord() failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "garbage.log")
+	content := append([]byte{1, 2, 3, 255, 255, 255, 255}, record...)
+	err = os.WriteFile(path, append(content, 9, 9), 0644)
+	if err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer file.Close()
+
+	tests := []struct {
+		from   int64
+		offset int64
+		found  bool
+	}{
+		{0, 7, true},
+		{7, 7, true},
+		{8, int64(len(content) + 2), false},
+	}
+	for _, tt := range tests {
+		offset, found, err := findNextRecord(file, formatVersionLatest, tt.from)
+		if err != nil {
+			t.Fatalf("findNextRecord() failed: %v", err)
+		}
+		if offset != tt.offset || found != tt.found {
+			t.Errorf("Expected (%d, %v) from %d, got (%d, %v)", tt.offset, tt.found, tt.from, offset, found)
+		}
+	}
+}
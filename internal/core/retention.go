@@ -0,0 +1,136 @@
+package core
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"time"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// RetentionPolicy defines how many old segments the Wal keeps. Once any limit is exceeded,
+// the oldest segments are discarded with Truncate after every rotation, or when calling
+// EnforceRetention. A zero field sets no limit. Errors after a rotation do not fail the write
+// that rotated, they are reported to WalOptions.OnRetentionError.
+//
+// The limits are never enforced beyond the last checkpoint: the entries after it are kept,
+// however big or old, and so are the segments still pinned by a Reader following the Wal.
+// Without a checkpoint nothing is discarded. The hot file is never discarded either.
+type RetentionPolicy struct {
+	MaxBytes    int64         // Max size of the segments, hot file included
+	MaxAge      time.Duration // Max time since a segment was last written
+	MaxSegments int           // Max number of segments, hot file included
+}
+
+// EnforceRetention discards the oldest segments exceeding WalOptions.Retention, as done after
+// every rotation, e.g. to apply RetentionPolicy.MaxAge to a Wal not written for a while.
+//
+// Returns:
+//   - An error if the segments cannot be read or discarded.
+func (w *Wal) EnforceRetention() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	return w.enforceRetention()
+}
+
+// enforceRetention implements EnforceRetention. The caller must hold mu.
+func (w *Wal) enforceRetention() error {
+	policy := w.Options.Retention
+	if policy == (RetentionPolicy{}) {
+		return nil
+	}
+	opts := *w.Options.FileHandlerOpts
+
+	paths, err := fh.ListWalFiles(opts)
+	if err != nil {
+		return err
+	}
+	infos := make([]fs.FileInfo, len(paths))
+	var total int64
+	for i, p := range paths {
+		infos[i], err = fh.StatFile(opts, p)
+		if err != nil {
+			return fmt.Errorf("failed to read WAL file size: %w", err)
+		}
+		total += infos[i].Size()
+	}
+
+	// Find the oldest segment within every limit, never past the hot file
+	now := time.Now()
+	keep := 0
+	for count := len(paths); keep < len(paths)-1; keep++ {
+		tooBig := policy.MaxBytes > 0 && total > policy.MaxBytes
+		tooOld := policy.MaxAge > 0 && now.Sub(infos[keep].ModTime()) > policy.MaxAge
+		tooMany := policy.MaxSegments > 0 && count > policy.MaxSegments
+		if !tooBig && !tooOld && !tooMany {
+			break
+		}
+		total -= infos[keep].Size()
+		count--
+	}
+	if keep == 0 {
+		return nil
+	}
+
+	// Every entry before the first one of that segment can go, within the checkpoint and the pins
+	lsn, named := fh.WalFileFirstLSN(paths[keep])
+	if !named {
+		var found bool
+		lsn, found, err = readFirstLSN(opts, paths[keep])
+		if err != nil || !found {
+			return err
+		}
+	}
+	checkpoint, hasCheckpoint, err := ReadCheckpoint(w.Options)
+	if err != nil || !hasCheckpoint {
+		return err
+	}
+	lsn = min(lsn, checkpoint.LSN+1, w.pinnedLSN())
+
+	// Even below the low-water mark, truncate retries the deletions of a previous call that failed
+	return w.truncate(lsn)
+}
+
+// pinReader makes retention keep the entries a Reader following the Wal has not read yet,
+// from the LSN stored in its pin, until unpinReader is called.
+//
+// Parameters:
+//   - r: A pointer to the Reader.
+func (w *Wal) pinReader(r *Reader) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.readers == nil {
+		w.readers = make(map[*Reader]struct{})
+	}
+	w.readers[r] = struct{}{}
+}
+
+// unpinReader lets retention discard the entries pinned by a Reader.
+//
+// Parameters:
+//   - r: A pointer to the Reader.
+func (w *Wal) unpinReader(r *Reader) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.readers, r)
+}
+
+// pinnedLSN returns the lowest LSN pinned by the Readers following the Wal. The caller must hold mu.
+//
+// Returns:
+//   - The lowest LSN retention must keep, or math.MaxUint64 if no Reader pins any.
+func (w *Wal) pinnedLSN() uint64 {
+	pinned := uint64(math.MaxUint64)
+	for r := range w.readers {
+		pinned = min(pinned, r.pin.Load())
+	}
+	return pinned
+}
@@ -0,0 +1,280 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/casteloig/walrog/internal/faultfs"
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// countSegments returns the number of segments in the Wal folder.
+func countSegments(t *testing.T, options *WalOptions) int {
+	t.Helper()
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	return len(paths)
+}
+
+func TestRetentionMaxSegments(t *testing.T) {
+	// 4 entries per segment, so 10 segments
+	w, options := newTestWal(t, 40)
+	defer w.Close()
+	options.Retention = RetentionPolicy{MaxSegments: 3}
+
+	// Nothing is discarded without a checkpoint
+	err := w.EnforceRetention()
+	if err != nil {
+		t.Fatalf("EnforceRetention() failed: %v", err)
+	}
+	if count := countSegments(t, options); count != 10 {
+		t.Fatalf("Expected 10 segments, got %d", count)
+	}
+
+	// Nor after the checkpoint
+	err = w.Checkpoint(10, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	err = w.EnforceRetention()
+	if err != nil {
+		t.Fatalf("EnforceRetention() failed: %v", err)
+	}
+	if count := countSegments(t, options); count != 8 {
+		t.Errorf("Expected 8 segments, got %d", count)
+	}
+
+	err = w.Checkpoint(35, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	err = w.EnforceRetention()
+	if err != nil {
+		t.Fatalf("EnforceRetention() failed: %v", err)
+	}
+	if count := countSegments(t, options); count != 3 {
+		t.Errorf("Expected 3 segments, got %d", count)
+	}
+	lowWaterMark, err := readLowWaterMark(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("readLowWaterMark() failed: %v", err)
+	}
+	if lowWaterMark != 29 {
+		t.Errorf("Expected low-water mark 29, got %d", lowWaterMark)
+	}
+}
+
+func TestRetentionMaxBytes(t *testing.T) {
+	w, options := newTestWal(t, 40)
+	defer w.Close()
+	err := w.Checkpoint(40, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+
+	info, err := fh.StatFile(*options.FileHandlerOpts, w.HotFile.Name())
+	if err != nil {
+		t.Fatalf("StatFile() failed: %v", err)
+	}
+	options.Retention = RetentionPolicy{MaxBytes: 4*info.Size() + 1}
+	err = w.EnforceRetention()
+	if err != nil {
+		t.Fatalf("EnforceRetention() failed: %v", err)
+	}
+	if count := countSegments(t, options); count != 4 {
+		t.Errorf("Expected 4 segments, got %d", count)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	w, options := newTestWal(t, 40)
+	defer w.Close()
+	err := w.Checkpoint(40, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	options.Retention = RetentionPolicy{MaxAge: time.Hour}
+
+	// The 6 oldest segments were written 2 hours ago
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for i, p := range paths {
+		if i < 6 {
+			err = os.Chtimes(p, old, old)
+			if err != nil {
+				t.Fatalf("Chtimes() failed: %v", err)
+			}
+		}
+	}
+	err = w.EnforceRetention()
+	if err != nil {
+		t.Fatalf("EnforceRetention() failed: %v", err)
+	}
+	if count := countSegments(t, options); count != 4 {
+		t.Errorf("Expected 4 segments, got %d", count)
+	}
+}
+
+func TestRetentionTailReader(t *testing.T) {
+	w, options := newTestWal(t, 20)
+	defer w.Close()
+
+	// The reader is in the second segment, so only the first one can go
+	r, err := NewTailReader(w)
+	if err != nil {
+		t.Fatalf("NewTailReader() failed: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if !r.Next() {
+			t.Fatalf("Next() failed: %v", r.Err())
+		}
+	}
+	err = w.Checkpoint(20, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	options.Retention = RetentionPolicy{MaxSegments: 1}
+	err = w.EnforceRetention()
+	if err != nil {
+		t.Fatalf("EnforceRetention() failed: %v", err)
+	}
+	if count := countSegments(t, options); count != 4 {
+		t.Errorf("Expected 4 segments, got %d", count)
+	}
+	var last uint64
+	for r.Next() {
+		last = r.Entry().LSN
+	}
+	if r.Err() != nil {
+		t.Errorf("Reader failed: %v", r.Err())
+	}
+	if last != 20 {
+		t.Errorf("Expected the reader to reach LSN 20, got %d", last)
+	}
+
+	// Once closed, it pins nothing
+	r.Close()
+	err = w.EnforceRetention()
+	if err != nil {
+		t.Fatalf("EnforceRetention() failed: %v", err)
+	}
+	if count := countSegments(t, options); count != 1 {
+		t.Errorf("Expected 1 segment, got %d", count)
+	}
+}
+
+func TestRetentionOnRotate(t *testing.T) {
+	w, options := newTestWal(t, 0)
+	defer w.Close()
+	options.Retention = RetentionPolicy{MaxSegments: 2}
+
+	_, err := w.WriteBuffer([]byte("0123456789"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	err = w.Checkpoint(1, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	// Only the checkpoint keeps the segments after the first one
+	for i := 0; i < 39; i++ {
+		_, err = w.WriteBuffer([]byte("0123456789"))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+	if count := countSegments(t, options); count != 10 {
+		t.Errorf("Expected 10 segments, got %d", count)
+	}
+
+	err = w.Checkpoint(40, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	// The rotation to the 11th segment discards all but the last full one
+	for i := 0; i < 4; i++ {
+		_, err = w.WriteBuffer([]byte("0123456789"))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+	if count := countSegments(t, options); count != 2 {
+		t.Errorf("Expected 2 segments, got %d", count)
+	}
+	lowWaterMark, err := readLowWaterMark(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("readLowWaterMark() failed: %v", err)
+	}
+	if lowWaterMark != 37 {
+		t.Errorf("Expected low-water mark 37, got %d", lowWaterMark)
+	}
+}
+
+func TestRetentionErrorOnRotate(t *testing.T) {
+	fs := faultfs.New(1)
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fs
+	var retentionErrs []error
+	options := &WalOptions{
+		BufferSize:       64,
+		SegmentSize:      128,
+		FileHandlerOpts:  &fileHandlerOpts,
+		OnRetentionError: func(err error) { retentionErrs = append(retentionErrs, err) },
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	defer w.Close()
+	writeEntries(t, w, 12)
+	err = w.Checkpoint(12, nil)
+	if err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	options.Retention = RetentionPolicy{MaxSegments: 2}
+
+	// The segments cannot be removed, but the writes that rotate still succeed
+	eperm := errors.New("operation not permitted")
+	fs.SetFault(func(op faultfs.Op, name string) error {
+		if op == faultfs.OpRemove {
+			return eperm
+		}
+		return nil
+	})
+	writeEntries(t, w, 8)
+	if len(retentionErrs) == 0 {
+		t.Fatalf("Expected the retention errors to be reported")
+	}
+	for _, err := range retentionErrs {
+		if !errors.Is(err, eperm) {
+			t.Errorf("Expected the remove error, got %v", err)
+		}
+	}
+	if count := countSegments(t, options); count != 5 {
+		t.Errorf("Expected 5 segments, got %d", count)
+	}
+
+	// Once the fault is gone, retention catches up, keeping the segment of the checkpoint
+	fs.SetFault(nil)
+	err = w.EnforceRetention()
+	if err != nil {
+		t.Fatalf("EnforceRetention() failed: %v", err)
+	}
+	if count := countSegments(t, options); count != 3 {
+		t.Errorf("Expected 3 segments, got %d", count)
+	}
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	checkEntries(t, options, 13, 20)
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"fmt"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// endMarker is written after the last record of a recycled hot file: a record header of zeros,
+// which ends the records of a segment like the end of the file does.
+var endMarker = make([]byte, recordHeaderSize)
+
+// createSegment creates a new WAL file to become the hot file, with the header already written.
+// With WalOptions.RecycleSegments, a segment recycled by Truncate is reused instead, if any:
+// its stale records are kept, so the Wal must mark where the records written to it end.
+// With WalOptions.Preallocate, the file is preallocated to WalOptions.SegmentSize.
+//
+// Parameters:
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
+//   - firstLSN: The LSN of the first record that will be written to the file.
+//
+// Returns:
+//   - The new hot file, positioned where the first record must be written.
+//   - The offset where the stale records of a recycled file end, or 0 if it was not recycled.
+//   - An error if the file cannot be created.
+func createSegment(options *WalOptions, firstLSN uint64) (fh.File, int64, error) {
+	opts := *options.FileHandlerOpts
+
+	var file fh.File
+	var err error
+	if options.RecycleSegments > 0 {
+		file, err = fh.ReuseWalFile(opts, firstLSN)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var staleEnd int64
+	if file != nil {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, fmt.Errorf("failed to read recycled file size: %w", err)
+		}
+		staleEnd = info.Size()
+		err = overwriteSegmentHeader(file)
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+	} else {
+		file, err = fh.CreateWalNewFile(opts, firstLSN)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = writeSegmentHeader(file)
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+	}
+
+	err = preallocateSegment(options, file)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, staleEnd, nil
+}
+
+// preallocateSegment reserves WalOptions.SegmentSize bytes for a WAL file, if WalOptions.Preallocate
+// is set, so appending to it does not have to allocate space. The space reads as zeros.
+//
+// Parameters:
+//   - options: A pointer to WalOptions containing the configuration for the WAL.
+//   - file: The WAL file.
+//
+// Returns:
+//   - An error if the space cannot be reserved.
+func preallocateSegment(options *WalOptions, file fh.File) error {
+	if !options.Preallocate {
+		return nil
+	}
+	err := fh.Preallocate(file, int64(options.SegmentSize))
+	if err != nil {
+		return fmt.Errorf("failed to preallocate WAL file: %w", err)
+	}
+	return nil
+}
+
+// segmentFirstLSN returns the lowest LSN the records of a WAL file can have, taken from its name.
+// Records with a lower LSN are stale, left by the segment the file was recycled from.
+// Legacy files, named after a counter, are never recycled, so every record is valid.
+//
+// Parameters:
+//   - file: The WAL file.
+//
+// Returns:
+//   - The LSN in the name of the file, or 0 for legacy files.
+func segmentFirstLSN(file fh.File) uint64 {
+	lsn, _ := fh.WalFileFirstLSN(file.Name())
+	return lsn
+}
+
+// writeEndMarker marks where the records of a recycled hot file end, so the stale records after
+// them are never read. It is written before the records it follows, so readers following the
+// hot file never find them without it. The caller must hold mu.
+//
+// Parameters:
+//   - offset: The offset where the last record written ends.
+//
+// Returns:
+//   - An error if the marker cannot be written.
+func (w *Wal) writeEndMarker(offset int64) error {
+	_, err := w.HotFile.WriteAt(endMarker, offset)
+	if err != nil {
+		return fmt.Errorf("failed to write end marker: %w", err)
+	}
+	return nil
+}
+
+// trimHotFile cuts the hot file right after its last record, dropping the preallocated space or
+// the stale records after it, so only the hot file can hold anything but records.
+// The buffer must be flushed before. The caller must hold mu.
+//
+// Returns:
+//   - An error if the hot file cannot be truncated.
+func (w *Wal) trimHotFile() error {
+	info, err := w.HotFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read hot file size: %w", err)
+	}
+	if info.Size() > int64(w.segmentUsed) {
+		err = w.HotFile.Truncate(int64(w.segmentUsed))
+		if err != nil {
+			return fmt.Errorf("failed to trim hot file: %w", err)
+		}
+	}
+	w.staleEnd = 0
+	return nil
+}
@@ -0,0 +1,270 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// checkEntries recovers the Wal and checks that it holds the entries from first to last,
+// written by writeEntries, and that recovery dropped nothing.
+func checkEntries(t *testing.T, options *WalOptions, first, last uint64) {
+	t.Helper()
+	var corruptions []Corruption
+	options.OnCorruption = func(c Corruption) {
+		corruptions = append(corruptions, c)
+	}
+	defer func() { options.OnCorruption = nil }()
+
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(corruptions) > 0 {
+		t.Errorf("Expected nothing dropped, got %+v", corruptions)
+	}
+	if uint64(len(entries)) != last-first+1 {
+		t.Fatalf("Expected %d entries, got %d", last-first+1, len(entries))
+	}
+	for i, entry := range entries {
+		lsn := first + uint64(i)
+		if entry.LSN != lsn || string(entry.Data) != fmt.Sprintf("entry %d", lsn) {
+			t.Fatalf("Expected entry %d, got %d: %q", lsn, entry.LSN, entry.Data)
+		}
+	}
+}
+
+// writeEntries writes count entries with their LSN in the data, so their size varies
+// and the records of a recycled segment do not line up with the stale ones.
+func writeEntries(t *testing.T, w *Wal, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		_, err := w.WriteBuffer([]byte(fmt.Sprintf("entry %d", w.lsn)))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = t.TempDir()
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     256,
+		FileHandlerOpts: &fileHandlerOpts,
+		Preallocate:     true,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	writeEntries(t, w, 3)
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+
+	info, err := w.HotFile.Stat()
+	if err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	if info.Size() != 256 {
+		t.Errorf("Expected the hot file to be preallocated to 256 bytes, got %d", info.Size())
+	}
+
+	// The zeros after the last entry are not a torn tail
+	crash(w)
+	checkEntries(t, options, 1, 3)
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	writeEntries(t, w, 20)
+
+	// Only the hot file is left preallocated by rotations, and Close trims it too
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	paths, err := fh.ListWalFiles(fileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	if len(paths) < 2 {
+		t.Fatalf("Expected several segments, got %v", paths)
+	}
+	for _, p := range paths {
+		file, err := fh.OpenFile(fileHandlerOpts, p)
+		if err != nil {
+			t.Fatalf("OpenFile() failed: %v", err)
+		}
+		end, err := scanFile(file, 0, nil, func(RecoveredEntry, int64) error { return nil })
+		info, statErr := file.Stat()
+		file.Close()
+		if err != nil || statErr != nil {
+			t.Fatalf("Failed to read %s: %v, %v", p, err, statErr)
+		}
+		if info.Size() != end {
+			t.Errorf("Expected %s to end after its last entry at %d, got %d bytes", p, end, info.Size())
+		}
+	}
+	checkEntries(t, options, 1, 23)
+
+	// Resuming from the shutdown marker preallocates the hot file again
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	defer w.Close()
+	info, err = w.HotFile.Stat()
+	if err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	if info.Size() != 256 {
+		t.Errorf("Expected the hot file to be preallocated to 256 bytes, got %d", info.Size())
+	}
+	writeEntries(t, w, 1)
+	w.FlushBuffer()
+	checkEntries(t, options, 1, 24)
+}
+
+func TestRecycleSegments(t *testing.T) {
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = t.TempDir()
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     128,
+		FileHandlerOpts: &fileHandlerOpts,
+		RecycleSegments: 2,
+	}
+
+	// Segments of 4 entries
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	writeEntries(t, w, 20)
+	err = w.Truncate(17)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+
+	recycled, err := fh.ListRecycledFiles(fileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListRecycledFiles() failed: %v", err)
+	}
+	if len(recycled) != 2 {
+		t.Fatalf("Expected 2 recycled segments, got %v", recycled)
+	}
+	checkEntries(t, options, 17, 20)
+
+	// A rotation takes a recycled segment, and its stale entries are never read
+	writeEntries(t, w, 2)
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	recycled, _ = fh.ListRecycledFiles(fileHandlerOpts)
+	if len(recycled) != 1 {
+		t.Errorf("Expected a recycled segment to be reused, got %v", recycled)
+	}
+	if w.staleEnd == 0 {
+		t.Errorf("Expected the hot file to be recycled")
+	}
+	checkEntries(t, options, 17, 22)
+
+	// Nor after a crash
+	crash(w)
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	if w.lsn != 23 {
+		t.Errorf("Expected next LSN 23, got %d", w.lsn)
+	}
+	writeEntries(t, w, 10)
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	checkEntries(t, options, 17, 32)
+
+	// A new Wal does not reuse segments with LSNs it will assign again
+	w, err = InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	defer w.Close()
+	recycled, _ = fh.ListRecycledFiles(fileHandlerOpts)
+	if len(recycled) != 0 {
+		t.Errorf("Expected InitWal() to remove the recycled segments, got %v", recycled)
+	}
+}
+
+func TestStaleRecords(t *testing.T) {
+	w, options := newTestWal(t, 0)
+	options.RecycleSegments = 1
+	// Segments of entries 1 to 5, 6 to 9 and 10 to 13
+	writeEntries(t, w, 13)
+	err := w.Truncate(10)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+
+	// The segment of entries 1 to 5 is reused for entry 14, still in the buffer
+	writeEntries(t, w, 1)
+	if w.staleEnd == 0 {
+		t.Fatalf("Expected the hot file to be recycled")
+	}
+
+	// Stale entries right after the header end the segment, even without an end marker
+	countEntries := func() int {
+		r, err := NewReader(options)
+		if err != nil {
+			t.Fatalf("NewReader() failed: %v", err)
+		}
+		defer r.Close()
+		count := 0
+		for r.Next() {
+			count++
+		}
+		if r.Err() != nil {
+			t.Fatalf("Reader failed: %v", r.Err())
+		}
+		return count
+	}
+	if count := countEntries(); count != 4 {
+		t.Errorf("Expected 4 entries, got %d", count)
+	}
+	// Nor are they the first entry of the segment, which tells Truncate where the previous one ends
+	_, found, err := readFirstLSN(*options.FileHandlerOpts, w.HotFile.Name())
+	if err != nil || found {
+		t.Errorf("Expected no entries in the hot file, got %v, %v", found, err)
+	}
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	if count := countEntries(); count != 5 {
+		t.Errorf("Expected 5 entries, got %d", count)
+	}
+
+	// TruncateAfter drops the stale entries of the hot file along with the entries cut
+	writeEntries(t, w, 2)
+	err = w.TruncateAfter(15)
+	if err != nil {
+		t.Fatalf("TruncateAfter() failed: %v", err)
+	}
+	if w.staleEnd != 0 {
+		t.Errorf("Expected the stale entries to be dropped")
+	}
+	writeEntries(t, w, 1)
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	checkEntries(t, options, 10, 16)
+}
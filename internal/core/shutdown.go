@@ -0,0 +1,95 @@
+package core
+
+import (
+	"path/filepath"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+	utils "github.com/casteloig/walrog/internal/utils"
+)
+
+// cleanShutdownFile is the file in the Wal folder written by Close, and removed by OpenWal.
+// Its presence means the WAL was closed cleanly, so OpenWal can resume without scanning the segments.
+// Its content is:
+//
+//	next LSN (8 bytes) | hot file size (8 bytes) | hot file name length (4 bytes) | hot file name | CRC (4 bytes)
+const cleanShutdownFile = "clean_shutdown"
+
+// shutdownMarker is the state of the Wal stored in the clean shutdown marker.
+type shutdownMarker struct {
+	nextLSN uint64 // LSN assigned to the next entry
+	hotSize int64  // Size of the hot file when it was closed
+	hotFile string // Name of the hot file
+}
+
+// writeShutdownMarker durably writes the clean shutdown marker in the Wal folder.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name and file permissions.
+//   - marker: The state of the Wal when it was closed.
+//
+// Returns:
+//   - An error if the marker cannot be written.
+func writeShutdownMarker(opts fh.Options, marker shutdownMarker) error {
+	var data []byte
+	data = utils.AppendBytesToSlice(data, utils.Uint64ToBytes(marker.nextLSN))
+	data = utils.AppendBytesToSlice(data, utils.Uint64ToBytes(uint64(marker.hotSize)))
+	data = utils.AppendBytesToSlice(data, utils.Uint32ToBytes(uint32(len(marker.hotFile))))
+	data = utils.AppendBytesToSlice(data, []byte(marker.hotFile))
+	data = utils.AppendBytesToSlice(data, utils.Uint32ToBytes(utils.CalculateCRC(data)))
+	return fh.WriteFileAtomic(opts, cleanShutdownFile, data)
+}
+
+// consumeShutdownMarker reads the clean shutdown marker of the Wal folder and removes it,
+// so a crash after reopening the Wal is never mistaken for a clean shutdown.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name.
+//
+// Returns:
+//   - The state of the Wal when it was closed.
+//   - false if the Wal was not closed cleanly, or the marker is corrupted.
+//   - An error if the marker cannot be read or removed.
+func consumeShutdownMarker(opts fh.Options) (shutdownMarker, bool, error) {
+	data, err := fh.ReadFile(opts, cleanShutdownFile)
+	if err != nil || data == nil {
+		return shutdownMarker{}, false, err
+	}
+
+	err = fh.RemoveFile(opts, cleanShutdownFile)
+	if err != nil {
+		return shutdownMarker{}, false, err
+	}
+
+	// Next LSN, size, name length and CRC
+	if len(data) < 24 {
+		return shutdownMarker{}, false, nil
+	}
+	content := data[:len(data)-4]
+	if utils.BytesToUint32(data[len(data)-4:]) != utils.CalculateCRC(content) {
+		return shutdownMarker{}, false, nil
+	}
+	nameLength := int(utils.BytesToUint32(content[16:20]))
+	if nameLength != len(content)-20 {
+		return shutdownMarker{}, false, nil
+	}
+
+	marker := shutdownMarker{
+		nextLSN: utils.BytesToUint64(content[0:8]),
+		hotSize: int64(utils.BytesToUint64(content[8:16])),
+		hotFile: string(content[20:]),
+	}
+	return marker, true, nil
+}
+
+// matchesHotFile checks that the last WAL file is exactly as it was left by Close,
+// so the state stored in the marker can be trusted.
+//
+// Parameters:
+//   - hotPath: The full path to the last WAL file of the Wal folder.
+//   - hotSize: The current size of that file.
+//
+// Returns:
+//   - true if the marker describes the file.
+func (m shutdownMarker) matchesHotFile(hotPath string, hotSize int64) bool {
+	return m.hotFile == filepath.Base(hotPath) && m.hotSize == hotSize
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+func TestCloseWritesShutdownMarker(t *testing.T) {
+	w, options := newTestWal(t, 10)
+	opts := *options.FileHandlerOpts
+
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// Closing twice does nothing, using a closed Wal fails
+	err = w.Close()
+	if err != nil {
+		t.Errorf("Expected second Close() to do nothing, got %v", err)
+	}
+	_, err = w.WriteBuffer([]byte("late"))
+	if err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+
+	// Corrupt an older segment: a full scan would fail, so OpenWal must rely on the marker
+	paths, err := fh.ListWalFiles(opts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	err = os.WriteFile(paths[0], []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatalf("Error corrupting first segment: %v", err)
+	}
+
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	if w.lsn != 11 {
+		t.Errorf("Expected next LSN 11, got %d", w.lsn)
+	}
+
+	// The marker is consumed, so a crash from now on requires a full scan
+	if _, err := os.Stat(filepath.Join(opts.DirName, cleanShutdownFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected shutdown marker to be removed by OpenWal")
+	}
+	crash(w)
+	_, err = OpenWal(options)
+	if err == nil || errors.Is(err, ErrLocked) {
+		t.Errorf("Expected OpenWal() after a crash to scan and find the corrupted segment")
+	}
+}
+
+func TestShutdownMarkerMismatch(t *testing.T) {
+	w, options := newTestWal(t, 10)
+	opts := *options.FileHandlerOpts
+
+	err := w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// The hot file changed after closing, so the marker cannot be trusted
+	paths, err := fh.ListWalFiles(opts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	hotPath := paths[len(paths)-1]
+	info, err := os.Stat(hotPath)
+	if err != nil {
+		t.Fatalf("Error reading hot file: %v", err)
+	}
+	err = os.Truncate(hotPath, info.Size()-27)
+	if err != nil {
+		t.Fatalf("Error truncating hot file: %v", err)
+	}
+
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	defer w.Close()
+	if w.lsn != 10 {
+		t.Errorf("Expected next LSN 10 from a full scan, got %d", w.lsn)
+	}
+}
+
+func TestConsumeShutdownMarker(t *testing.T) {
+	opts := *fh.DefaultOptions
+	opts.DirName = t.TempDir()
+
+	// No marker
+	_, clean, err := consumeShutdownMarker(opts)
+	if err != nil || clean {
+		t.Errorf("Expected no clean shutdown, got %v (%v)", clean, err)
+	}
+
+	marker := shutdownMarker{nextLSN: 42, hotSize: 1234, hotFile: "wal_007.log"}
+	err = writeShutdownMarker(opts, marker)
+	if err != nil {
+		t.Fatalf("writeShutdownMarker() failed: %v", err)
+	}
+	read, clean, err := consumeShutdownMarker(opts)
+	if err != nil || !clean {
+		t.Fatalf("Expected clean shutdown, got %v (%v)", clean, err)
+	}
+	if read != marker {
+		t.Errorf("Expected marker %v, got %v", marker, read)
+	}
+
+	// Corrupted markers are ignored
+	err = os.WriteFile(filepath.Join(opts.DirName, cleanShutdownFile), []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatalf("Error writing marker: %v", err)
+	}
+	_, clean, err = consumeShutdownMarker(opts)
+	if err != nil || clean {
+		t.Errorf("Expected corrupted marker to be ignored, got %v (%v)", clean, err)
+	}
+}
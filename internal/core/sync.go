@@ -0,0 +1,109 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// SyncMode defines when the entries written to the hot file are synced to disk.
+// Entries that are flushed but not synced are in the OS page cache: they survive a crash
+// of the process, but may be lost on power loss. If a sync fails, the entries not synced yet
+// may be lost even if a later sync succeeds, so every later write, flush or sync returns the error.
+type SyncMode int
+
+const (
+	// SyncOnFlush syncs the hot file every time the buffer is flushed, either by FlushBuffer
+	// or automatically when the buffer is full. Entries are durable once FlushBuffer returns.
+	SyncOnFlush SyncMode = iota
+	// SyncOnWrite flushes the buffer and syncs the hot file on every WriteBuffer.
+	// Entries are durable once WriteBuffer returns, at the cost of one sync per entry.
+	SyncOnWrite
+	// SyncInterval flushes the buffer and syncs the hot file at most every WalOptions.SyncInterval.
+	// The interval is checked on every WriteBuffer and FlushBuffer, and in the background
+	// while nothing is written, so entries are durable once the interval has elapsed.
+	SyncInterval
+	// SyncNever leaves syncing to the OS. Only Close syncs the hot file.
+	SyncNever
+)
+
+// syncHotFile syncs the entries flushed to the hot file to disk.
+// fdatasync is used where available, since the metadata of the file is not needed to recover it.
+// A failed sync fails the Wal: the OS may have dropped the entries it could not write back,
+// and a later sync would report them as durable anyway, e.g. on Linux.
+//
+// Returns:
+//   - An error if the hot file cannot be synced.
+func (w *Wal) syncHotFile() error {
+	// The buffer is not bound to a file
+	if w.HotFile == nil {
+		return nil
+	}
+
+	err := fh.Datasync(w.HotFile)
+	if err != nil {
+		return w.fail(fmt.Errorf("failed to sync hot file: %w", err))
+	}
+	w.lastSync = time.Now()
+	w.unsynced = false
+	return nil
+}
+
+// syncIntervalElapsed checks if the hot file must be synced in SyncInterval mode.
+//
+// Returns:
+//   - true if the Wal is in SyncInterval mode, has entries written since the last sync,
+//     and the interval has elapsed since then.
+func (w *Wal) syncIntervalElapsed() bool {
+	if w.Options.SyncMode != SyncInterval || (!w.unsynced && w.Buffer.Buffered() == 0) {
+		return false
+	}
+	return time.Since(w.lastSync) >= w.Options.SyncInterval
+}
+
+// startSyncer starts the background sync of SyncInterval mode, if enabled.
+// It stops once the Wal is closed.
+func (w *Wal) startSyncer() {
+	if w.Options.SyncMode != SyncInterval || w.Options.SyncInterval <= 0 {
+		return
+	}
+	w.stopSyncer = make(chan struct{})
+	go w.runSyncer(w.stopSyncer)
+}
+
+// runSyncer flushes the buffer and syncs the hot file whenever the interval elapses without
+// a write or flush doing it, until stop is closed or the Wal cannot be written anymore.
+// A failure is reported by the next write, since it fails the Wal.
+//
+// Parameters:
+//   - stop: A channel closed by Close.
+func (w *Wal) runSyncer(stop <-chan struct{}) {
+	timer := time.NewTimer(w.Options.SyncInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-stop:
+			return
+		}
+
+		w.mu.Lock()
+		if w.writable() != nil {
+			w.mu.Unlock()
+			return
+		}
+		if w.syncIntervalElapsed() {
+			w.flushAndSync()
+		}
+		next := w.Options.SyncInterval - time.Since(w.lastSync)
+		if next <= 0 {
+			// Nothing was written since the last sync, so wait for a whole interval
+			next = w.Options.SyncInterval
+		}
+		w.mu.Unlock()
+
+		timer.Reset(next)
+	}
+}
@@ -0,0 +1,153 @@
+package core
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/casteloig/walrog/internal/faultfs"
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+func TestSyncModes(t *testing.T) {
+	testCases := []struct {
+		name             string
+		syncMode         SyncMode
+		syncInterval     time.Duration
+		expectedBuffered bool // Entry still in the buffer after WriteBuffer
+		expectedSynced   bool // Hot file synced after FlushBuffer
+	}{
+		{name: "Sync on flush", syncMode: SyncOnFlush, expectedBuffered: true, expectedSynced: true},
+		{name: "Sync on write", syncMode: SyncOnWrite, expectedBuffered: false, expectedSynced: true},
+		{name: "Sync interval elapsed", syncMode: SyncInterval, syncInterval: 0, expectedBuffered: false, expectedSynced: true},
+		{name: "Sync interval not elapsed", syncMode: SyncInterval, syncInterval: time.Hour, expectedBuffered: true, expectedSynced: false},
+		{name: "Sync never", syncMode: SyncNever, expectedBuffered: true, expectedSynced: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fileHandlerOpts := *fh.DefaultOptions
+			fileHandlerOpts.DirName = t.TempDir()
+			options := &WalOptions{
+				BufferSize:      64,
+				SegmentSize:     1024,
+				FileHandlerOpts: &fileHandlerOpts,
+				SyncMode:        tc.syncMode,
+				SyncInterval:    tc.syncInterval,
+			}
+
+			w, err := InitWal(options)
+			if err != nil {
+				t.Fatalf("InitWal() failed: %v", err)
+			}
+			defer w.Close()
+
+			// Pretend the last sync happened a moment ago
+			w.lastSync = time.Now().Add(-time.Second)
+			lastSync := w.lastSync
+
+			_, err = w.WriteBuffer([]byte("Hello World!"))
+			if err != nil {
+				t.Fatalf("WriteBuffer() failed: %v", err)
+			}
+			if buffered := w.Buffer.Buffered() > 0; buffered != tc.expectedBuffered {
+				t.Errorf("Expected entry buffered %v, got %v", tc.expectedBuffered, buffered)
+			}
+
+			err = w.FlushBuffer()
+			if err != nil {
+				t.Fatalf("FlushBuffer() failed: %v", err)
+			}
+			if synced := w.lastSync.After(lastSync); synced != tc.expectedSynced {
+				t.Errorf("Expected hot file synced %v, got %v", tc.expectedSynced, synced)
+			}
+
+			// Flushed entries are in the hot file whatever the mode
+			result, err := Recover(options)
+			if err != nil {
+				t.Fatalf("Recover() failed: %v", err)
+			}
+			if len(result) != 1 {
+				t.Errorf("Expected 1 entry, got %d", len(result))
+			}
+		})
+	}
+}
+
+func TestSyncIntervalInBackground(t *testing.T) {
+	fs := faultfs.New(1)
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fs
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     1024,
+		FileHandlerOpts: &fileHandlerOpts,
+		SyncMode:        SyncInterval,
+		SyncInterval:    20 * time.Millisecond,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	// The first entry is synced right away, the second one waits for the interval
+	for _, data := range []string{"Hello", "World"} {
+		_, err = w.WriteBuffer([]byte(data))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+
+	// Nothing else is written, but the second entry becomes durable anyway
+	time.Sleep(200 * time.Millisecond)
+	fs.Crash()
+	w.Close()
+
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries, got %d", len(entries))
+	}
+}
+
+func TestSyncIntervalIdle(t *testing.T) {
+	fs := faultfs.New(1)
+	syncs := &atomic.Int64{}
+	fs.SetFault(func(op faultfs.Op, name string) error {
+		if op == faultfs.OpSync {
+			syncs.Add(1)
+		}
+		return nil
+	})
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fs
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     1024,
+		FileHandlerOpts: &fileHandlerOpts,
+		SyncMode:        SyncInterval,
+		SyncInterval:    10 * time.Millisecond,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	defer w.Close()
+	_, err = w.WriteBuffer([]byte("Hello"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+
+	// Once the entry is synced, nothing is left to sync however many intervals elapse
+	time.Sleep(50 * time.Millisecond)
+	synced := syncs.Load()
+	time.Sleep(100 * time.Millisecond)
+	if count := syncs.Load() - synced; count != 0 {
+		t.Errorf("Expected no sync while idle, got %d", count)
+	}
+}
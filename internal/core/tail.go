@@ -0,0 +1,97 @@
+package core
+
+import (
+	"context"
+)
+
+// NewTailReader creates a Reader that follows the entries appended to a running Wal.
+// It works like NewReader, and NextContext waits for the Wal to flush new entries
+// when the end of the WAL is reached. Until it is closed, the Reader pins the segment
+// it is reading and the later ones, so retention does not remove them.
+//
+// Parameters:
+//   - w: A pointer to the Wal to follow.
+//
+// Returns:
+//   - A pointer to the Reader, positioned before the first entry after the last checkpoint.
+//   - An error if the WAL cannot be read.
+func NewTailReader(w *Wal) (*Reader, error) {
+	r := &Reader{options: w.Options, wal: w}
+
+	// Every entry is pinned until the first segment is opened
+	w.pinReader(r)
+	err := r.start()
+	if err != nil {
+		w.unpinReader(r)
+		return nil, err
+	}
+	return r, nil
+}
+
+// NextContext works like Next, but at the end of the WAL it blocks until the followed Wal
+// flushes new entries, moving to the new segments after a rotation, like `tail -f`.
+// Entries still in the buffer of the Wal are not visible until they are flushed.
+// For a Reader created with NewReader, it works exactly like Next.
+//
+// Parameters:
+//   - ctx: A context to stop waiting for new entries.
+//
+// Returns:
+//   - true if there is an entry available through Entry.
+//   - false if ctx is done, the Wal is closed and every entry was read, or an error happened.
+//     Err returns the context error or ErrClosed respectively, and NextContext can be
+//     called again after a context error.
+func (r *Reader) NextContext(ctx context.Context) bool {
+	r.waitErr = nil
+	if r.wal == nil {
+		return r.Next()
+	}
+
+	for {
+		// Taken before reading, so a flush happening meanwhile is not missed
+		flushed, err := r.wal.flushNotification()
+		if r.Next() {
+			return true
+		}
+		if r.err != nil {
+			return false
+		}
+		if err != nil {
+			r.waitErr = err
+			return false
+		}
+
+		select {
+		case <-ctx.Done():
+			r.waitErr = ctx.Err()
+			return false
+		case <-flushed:
+		}
+	}
+}
+
+// flushNotification returns a channel closed the next time entries are flushed to the hot file.
+//
+// Returns:
+//   - A channel closed on the next flush, or when the Wal is closed.
+//   - ErrClosed if the Wal is closed, so there will be no more entries.
+func (w *Wal) flushNotification() (<-chan struct{}, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil, ErrClosed
+	}
+	if w.flushed == nil {
+		w.flushed = make(chan struct{})
+	}
+	return w.flushed, nil
+}
+
+// notifyFlush wakes up the tail readers waiting for new entries. The caller must hold mu.
+func (w *Wal) notifyFlush() {
+	if w.flushed != nil {
+		close(w.flushed)
+		w.flushed = nil
+	}
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTailReader(t *testing.T) {
+	w, _ := newTestWal(t, 0)
+
+	r, err := NewTailReader(w)
+	if err != nil {
+		t.Fatalf("NewTailReader() failed: %v", err)
+	}
+	defer r.Close()
+
+	// 4 entries per segment: the reader must follow several rotations
+	const count = 30
+	go func() {
+		for i := 0; i < count; i++ {
+			_, err := w.WriteBuffer([]byte("0123456789"))
+			if err == nil {
+				err = w.FlushBuffer()
+			}
+			if err != nil {
+				t.Errorf("Write failed: %v", err)
+				return
+			}
+		}
+		w.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	read := 0
+	for r.NextContext(ctx) {
+		read++
+		if r.Entry().LSN != uint64(read) {
+			t.Fatalf("Expected LSN %d, got %d", read, r.Entry().LSN)
+		}
+	}
+	if read != count {
+		t.Errorf("Expected %d entries, got %d", count, read)
+	}
+	if !errors.Is(r.Err(), ErrClosed) {
+		t.Errorf("Expected ErrClosed once the Wal is closed, got %v", r.Err())
+	}
+}
+
+func TestTailReaderContext(t *testing.T) {
+	w, _ := newTestWal(t, 0)
+	defer w.Close()
+
+	r, err := NewTailReader(w)
+	if err != nil {
+		t.Fatalf("NewTailReader() failed: %v", err)
+	}
+	defer r.Close()
+
+	// Nothing to read: waits until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if r.NextContext(ctx) {
+		t.Fatalf("Expected NextContext() to wait without entries")
+	}
+	if !errors.Is(r.Err(), context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", r.Err())
+	}
+
+	// The Reader can keep waiting with another context
+	_, err = w.WriteBuffer([]byte("0123456789"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	if !r.NextContext(context.Background()) || r.Entry().LSN != 1 {
+		t.Errorf("Expected entry 1 once flushed")
+	}
+	if r.Err() != nil {
+		t.Errorf("Expected no error, got %v", r.Err())
+	}
+}
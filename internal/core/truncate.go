@@ -0,0 +1,422 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+	utils "github.com/casteloig/walrog/internal/utils"
+)
+
+// lowWaterMarkFile is the file in the Wal folder storing the lowest LSN kept after a Truncate.
+// Its content is the LSN (8 bytes) followed by its CRC (4 bytes).
+const lowWaterMarkFile = "low_water_mark"
+
+// Truncate removes the entries with an LSN lower than lsn from the WAL,
+// e.g. because they are already reflected in a snapshot.
+// The new low-water mark is persisted first, so recovery skips those entries from then on,
+// and then every segment whose entries are all below lsn is deleted, or recycled to be reused by
+// later rotations, up to WalOptions.RecycleSegments of them.
+// Entries sharing a segment with lsn stay on disk until the whole segment can be deleted.
+// The hot file is never deleted.
+//
+// Parameters:
+//   - lsn: The LSN of the first entry to keep.
+//
+// Returns:
+//   - An error if lsn has not been assigned yet, or the WAL cannot be truncated.
+func (w *Wal) Truncate(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	return w.truncate(lsn)
+}
+
+// truncate implements Truncate. The caller must hold mu.
+func (w *Wal) truncate(lsn uint64) error {
+	if lsn > w.lsn {
+		return fmt.Errorf("cannot truncate up to LSN %d, next LSN is %d", lsn, w.lsn)
+	}
+	opts := *w.Options.FileHandlerOpts
+
+	lowWaterMark, err := readLowWaterMark(opts)
+	if err != nil {
+		return err
+	}
+	if lsn > lowWaterMark {
+		err = writeLowWaterMark(opts, lsn)
+		if err != nil {
+			return err
+		}
+		lowWaterMark = lsn
+	}
+
+	// Segments are bounded by the first LSN of the next one,
+	// so every entry must be on disk to know where the last segments end
+	err = w.flushBuffer()
+	if err != nil {
+		return err
+	}
+
+	// Also retries the deletions of a previous Truncate interrupted by a crash
+	return w.removeSegmentsBelow(lowWaterMark)
+}
+
+// removeSegmentsBelow deletes every segment, except the hot file, whose entries are all below lsn.
+// While there are less than WalOptions.RecycleSegments recycled files, segments are recycled instead.
+// Segments are deleted from the oldest, so an interrupted call never leaves gaps between segments.
+//
+// Parameters:
+//   - lsn: The LSN of the first entry to keep.
+//
+// Returns:
+//   - An error if any segment cannot be read or deleted.
+func (w *Wal) removeSegmentsBelow(lsn uint64) error {
+	opts := *w.Options.FileHandlerOpts
+
+	paths, err := fh.ListWalFiles(opts)
+	if err != nil {
+		return err
+	}
+
+	// Walk backwards: each segment ends right before the first LSN of the next non-empty one
+	var removable []string
+	nextFirstLSN := w.lsn
+	for i := len(paths) - 1; i >= 0; i-- {
+		segmentEnd := nextFirstLSN
+
+		firstLSN, found, err := readFirstLSN(opts, paths[i])
+		if err != nil {
+			return err
+		}
+		if found {
+			nextFirstLSN = firstLSN
+		}
+
+		if paths[i] != w.HotFile.Name() && segmentEnd <= lsn {
+			removable = append(removable, paths[i])
+		}
+	}
+
+	recycled := 0
+	if w.Options.RecycleSegments > 0 && len(removable) > 0 {
+		pool, err := fh.ListRecycledFiles(opts)
+		if err != nil {
+			return err
+		}
+		recycled = len(pool)
+	}
+
+	for i := len(removable) - 1; i >= 0; i-- {
+		// Legacy segments are named after a counter, so their stale records could not be told apart
+		_, named := fh.WalFileFirstLSN(removable[i])
+		if named && recycled < w.Options.RecycleSegments {
+			err = fh.RecycleWalFile(opts, removable[i])
+			recycled++
+		} else {
+			err = fh.RemoveWalFile(opts, removable[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readFirstLSN returns the LSN of the first entry starting in a WAL file.
+// A file starting with the tail of an entry fragmented across segments ends that entry,
+// so the LSN returned is the one after it.
+//
+// Parameters:
+//   - opts: An Options struct containing the filesystem.
+//   - filePath: The full path to the WAL file.
+//
+// Returns:
+//   - The LSN of the first entry starting in the file.
+//   - false if the file has no entries.
+//   - An error if the file cannot be read or its first entry is corrupted.
+func readFirstLSN(opts fh.Options, filePath string) (uint64, bool, error) {
+	file, err := fh.OpenFile(opts, filePath)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open WAL file: %w", err)
+	}
+	defer file.Close()
+
+	// A header or entry still being written is not there yet
+	reader := bufio.NewReader(file)
+	version, _, err := readSegmentHeader(reader)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	entry, _, err := readRecord(reader, version)
+	if err == nil && entry.LSN < segmentFirstLSN(file) {
+		// Only stale records of the segment the file was recycled from
+		err = io.EOF
+	}
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if entry.recordType == recordTypeMiddle || entry.recordType == recordTypeLast {
+		return entry.LSN + 1, true, nil
+	}
+	return entry.LSN, true, nil
+}
+
+// readLowWaterMark returns the lowest LSN kept in the Wal folder after the last Truncate.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name.
+//
+// Returns:
+//   - The low-water mark, or 0 if the WAL has never been truncated.
+//   - An error if the low-water mark cannot be read or is corrupted.
+func readLowWaterMark(opts fh.Options) (uint64, error) {
+	data, err := fh.ReadFile(opts, lowWaterMarkFile)
+	if err != nil {
+		return 0, err
+	}
+	if data == nil {
+		return 0, nil
+	}
+
+	if len(data) != 12 || utils.BytesToUint32(data[8:]) != utils.CalculateCRC(data[:8]) {
+		return 0, fmt.Errorf("corrupted low-water mark")
+	}
+	return utils.BytesToUint64(data[:8]), nil
+}
+
+// writeLowWaterMark durably replaces the low-water mark stored in the Wal folder.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name and file permissions.
+//   - lsn: The lowest LSN kept in the WAL.
+//
+// Returns:
+//   - An error if the low-water mark cannot be written.
+func writeLowWaterMark(opts fh.Options, lsn uint64) error {
+	data := utils.Uint64ToBytes(lsn)
+	data = utils.AppendBytesToSlice(data, utils.Uint32ToBytes(utils.CalculateCRC(data)))
+	return fh.WriteFileAtomic(opts, lowWaterMarkFile, data)
+}
+
+// errStopScan stops scanFile once the entry looked for has been found.
+var errStopScan = errors.New("stop scan")
+
+// TruncateAfter removes every entry with an LSN higher than lsn from the WAL,
+// e.g. to roll back entries that were never committed.
+// The buffer is flushed, the segment holding the entry after lsn is cut right before it,
+// and every later segment is deleted. That segment becomes the hot file again,
+// and the next entry written gets lsn+1.
+//
+// Parameters:
+//   - lsn: The LSN of the last entry to keep. 0 removes every entry.
+//
+// Returns:
+//   - An error if entries below the low-water mark would have to be reused, lsn is below the
+//     last checkpoint or in the middle of a batch, or the WAL cannot be truncated.
+//     If the segments were already being removed, the Wal fails (see fail).
+func (w *Wal) TruncateAfter(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.writable()
+	if err != nil {
+		return err
+	}
+	if lsn+1 >= w.lsn {
+		// Nothing written after lsn
+		return nil
+	}
+	opts := *w.Options.FileHandlerOpts
+
+	lowWaterMark, err := readLowWaterMark(opts)
+	if err != nil {
+		return err
+	}
+	if lsn+1 < lowWaterMark {
+		return fmt.Errorf("cannot truncate after LSN %d, entries below %d were already discarded", lsn, lowWaterMark)
+	}
+
+	// The checkpoint must keep pointing to entries on disk
+	checkpoint, hasCheckpoint, err := ReadCheckpoint(w.Options)
+	if err != nil {
+		return err
+	}
+	if hasCheckpoint && lsn < checkpoint.LSN {
+		return fmt.Errorf("cannot truncate after LSN %d, checkpoint at LSN %d", lsn, checkpoint.LSN)
+	}
+
+	err = w.flushBuffer()
+	if err != nil {
+		return err
+	}
+
+	paths, err := fh.ListWalFiles(opts)
+	if err != nil {
+		return err
+	}
+
+	// Find the first entry after lsn. If the segments holding it were already deleted,
+	// the cut happens at the beginning of the oldest segment left
+	cutSegment, cutOffset, found, err := locateAfter(w.Options, paths, lsn)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("entry after LSN %d not found", lsn)
+	}
+
+	// Keeping only the beginning of a batch would make it look complete once more entries are written
+	ends, err := endsBatch(w.Options, paths[:cutSegment+1], lsn)
+	if err != nil {
+		return err
+	}
+	if !ends {
+		return fmt.Errorf("cannot truncate after LSN %d, in the middle of a batch", lsn)
+	}
+
+	// The Wal has no hot file until the cut segment is opened again,
+	// so it fails if any of the steps below does
+	err = w.HotFile.Close()
+	w.HotFile = nil
+	if err != nil {
+		return w.fail(fmt.Errorf("failed to close hot file: %w", err))
+	}
+
+	// Delete from the newest segment, so an interrupted call never leaves gaps between segments
+	for i := len(paths) - 1; i > cutSegment; i-- {
+		err = fh.RemoveWalFile(opts, paths[i])
+		if err != nil {
+			return w.fail(err)
+		}
+	}
+
+	// The cut segment becomes the hot file again
+	hotFile, err := fh.OpenWalFile(opts, paths[cutSegment])
+	if err != nil {
+		return w.fail(err)
+	}
+	hotFile, segmentUsed, err := resumeHotFile(w.Options, hotFile, cutOffset, lsn+1)
+	if err != nil {
+		return w.fail(err)
+	}
+	err = hotFile.Sync()
+	if err != nil {
+		hotFile.Close()
+		return w.fail(fmt.Errorf("failed to sync hot file: %w", err))
+	}
+
+	w.HotFile = hotFile
+	w.Buffer.Reset(hotFile)
+	w.segmentUsed = int(segmentUsed)
+	w.staleEnd = 0
+	w.lsn = lsn + 1
+
+	return nil
+}
+
+// endsBatch checks that no entry of the same batch follows the entry with the given LSN,
+// i.e. it is the last entry of its batch, or it was not written in a batch.
+//
+// Parameters:
+//   - options: A pointer to WalOptions with the filesystem and the recovery mode.
+//   - paths: The paths of the WAL files, in creation order.
+//   - lsn: The LSN of the entry.
+//
+// Returns:
+//   - false if the entry is followed by more entries of its batch.
+//     Entries not found, e.g. discarded by Truncate, never split a batch.
+//   - An error if any segment cannot be read.
+func endsBatch(options *WalOptions, paths []string, lsn uint64) (bool, error) {
+	// The entry is usually in the last segments
+	for i := len(paths) - 1; i >= 0; i-- {
+		p := paths[i]
+		file, err := fh.OpenFile(*options.FileHandlerOpts, p)
+		if err != nil {
+			return false, fmt.Errorf("failed to open WAL file: %w", err)
+		}
+
+		found := false
+		ends := true
+		_, err = scanFile(file, 0, options.skipCorrupt(), func(entry RecoveredEntry, offset int64) error {
+			if entry.LSN == lsn {
+				found = true
+				ends = !entry.batchContinues
+				return errStopScan
+			}
+			return nil
+		})
+		file.Close()
+		if err != nil && err != errStopScan {
+			return false, fmt.Errorf("failed to scan %s: %w", filepath.Base(p), err)
+		}
+
+		if found {
+			return ends, nil
+		}
+	}
+
+	return true, nil
+}
+
+// locateAfter finds the position in the WAL files where the first entry with an LSN higher than lsn starts.
+//
+// Parameters:
+//   - options: A pointer to WalOptions with the filesystem and the recovery mode.
+//   - paths: The paths of the WAL files, in creation order.
+//   - lsn: The LSN to look after.
+//
+// Returns:
+//   - The index in paths of the segment holding the entry.
+//   - The offset in that segment where the entry starts.
+//   - false if no entry after lsn is on disk. The position returned is then the end of the last segment.
+//   - An error if any segment cannot be read.
+func locateAfter(options *WalOptions, paths []string, lsn uint64) (int, int64, bool, error) {
+	for i, p := range paths {
+		file, err := fh.OpenFile(*options.FileHandlerOpts, p)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("failed to open WAL file: %w", err)
+		}
+
+		entryOffset := int64(-1)
+		endOffset, err := scanFile(file, 0, options.skipCorrupt(), func(entry RecoveredEntry, offset int64) error {
+			if entry.LSN > lsn {
+				entryOffset = offset
+				return errStopScan
+			}
+			return nil
+		})
+		file.Close()
+		// The last file may end with an entry still being written
+		if errors.Is(err, io.ErrUnexpectedEOF) && i == len(paths)-1 {
+			err = nil
+		}
+		if err != nil && err != errStopScan {
+			return 0, 0, false, fmt.Errorf("failed to scan %s: %w", filepath.Base(p), err)
+		}
+
+		if entryOffset >= 0 {
+			return i, entryOffset, true, nil
+		}
+		if i == len(paths)-1 {
+			return i, endOffset, false, nil
+		}
+	}
+
+	return 0, 0, false, fmt.Errorf("no WAL files found")
+}
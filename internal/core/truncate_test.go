@@ -0,0 +1,353 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/casteloig/walrog/internal/faultfs"
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// newTestWal creates a Wal in a temporary folder where every segment holds
+// 4 entries of 10 bytes, and writes count entries to it.
+func newTestWal(t *testing.T, count int) (*Wal, *WalOptions) {
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = t.TempDir()
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     128,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	for i := 0; i < count; i++ {
+		_, err := w.WriteBuffer([]byte("0123456789"))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+	return w, options
+}
+
+// crash releases the files held by a Wal without closing it, like a crash of the process would.
+func crash(w *Wal) {
+	w.HotFile.Close()
+	fh.UnlockDir(w.lock)
+}
+
+func TestTruncate(t *testing.T) {
+	w, options := newTestWal(t, 10)
+	defer w.Close()
+
+	// LSNs 1-4 are in the first segment, 5-8 in the second and 9-10 in the hot file
+	err := w.Truncate(6)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("Expected only the first segment to be deleted, got %v", paths)
+	}
+
+	// Entries below the low-water mark are not recovered, even if still on disk
+	result, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(result) != 5 || result[0].LSN != 6 {
+		t.Fatalf("Expected LSNs 6 to 10, got %v", result)
+	}
+
+	// A lower mark does not bring entries back
+	err = w.Truncate(2)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+	lowWaterMark, err := readLowWaterMark(*options.FileHandlerOpts)
+	if err != nil || lowWaterMark != 6 {
+		t.Errorf("Expected low-water mark 6, got %d (%v)", lowWaterMark, err)
+	}
+
+	// LSNs not assigned yet cannot be truncated
+	err = w.Truncate(12)
+	if err == nil {
+		t.Errorf("Expected Truncate() to fail beyond the next LSN")
+	}
+}
+
+func TestTruncateEverything(t *testing.T) {
+	w, options := newTestWal(t, 8)
+
+	// Leave the hot file empty, then discard every entry
+	err := w.rotate()
+	if err != nil {
+		t.Fatalf("rotate() failed: %v", err)
+	}
+	err = w.Truncate(9)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	if len(paths) != 1 {
+		t.Fatalf("Expected only the hot file to be kept, got %v", paths)
+	}
+
+	// LSNs keep increasing after reopening
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	defer w.Close()
+	lsn, err := w.WriteBuffer([]byte("0123456789"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 9 {
+		t.Errorf("Expected LSN 9, got %d", lsn)
+	}
+}
+
+func TestInitWalAfterTruncate(t *testing.T) {
+	w, options := newTestWal(t, 40)
+	err := w.Truncate(30)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// A new Wal starts from LSN 1 again, so the low-water mark would hide its entries
+	w, err = InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		_, err = w.WriteBuffer([]byte("0123456789"))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	defer w.Close()
+	lsn, err := w.WriteBuffer([]byte("0123456789"))
+	if err != nil {
+		t.Fatalf("WriteBuffer() failed: %v", err)
+	}
+	if lsn != 6 {
+		t.Errorf("Expected LSN 6, got %d", lsn)
+	}
+	err = w.FlushBuffer()
+	if err != nil {
+		t.Fatalf("FlushBuffer() failed: %v", err)
+	}
+	entries, err := Recover(options)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 6 || entries[0].LSN != 1 {
+		t.Errorf("Expected LSNs 1 to 6, got %d entries", len(entries))
+	}
+}
+
+func TestReadLowWaterMark(t *testing.T) {
+	opts := *fh.DefaultOptions
+	opts.DirName = t.TempDir()
+
+	// Never truncated
+	lowWaterMark, err := readLowWaterMark(opts)
+	if err != nil || lowWaterMark != 0 {
+		t.Errorf("Expected low-water mark 0, got %d (%v)", lowWaterMark, err)
+	}
+
+	err = writeLowWaterMark(opts, 1<<40)
+	if err != nil {
+		t.Fatalf("writeLowWaterMark() failed: %v", err)
+	}
+	lowWaterMark, err = readLowWaterMark(opts)
+	if err != nil || lowWaterMark != 1<<40 {
+		t.Errorf("Expected low-water mark %d, got %d (%v)", uint64(1<<40), lowWaterMark, err)
+	}
+
+	// Corrupted content is detected
+	err = os.WriteFile(filepath.Join(opts.DirName, lowWaterMarkFile), []byte{1, 2, 3}, 0644)
+	if err != nil {
+		t.Fatalf("Error writing low-water mark: %v", err)
+	}
+	_, err = readLowWaterMark(opts)
+	if err == nil {
+		t.Errorf("Expected an error reading a corrupted low-water mark")
+	}
+}
+
+func TestTruncateAfter(t *testing.T) {
+	testCases := []struct {
+		name             string
+		lsn              uint64
+		expectedSegments int
+	}{
+		{name: "Inside the buffer", lsn: 9, expectedSegments: 3},
+		{name: "Inside an older segment", lsn: 6, expectedSegments: 2},
+		{name: "At the end of a segment", lsn: 4, expectedSegments: 2},
+		{name: "Everything", lsn: 0, expectedSegments: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// LSNs 1-4 are in the first segment, 5-8 in the second and 9-10 in the buffer
+			w, options := newTestWal(t, 10)
+			defer w.Close()
+
+			err := w.TruncateAfter(tc.lsn)
+			if err != nil {
+				t.Fatalf("TruncateAfter() failed: %v", err)
+			}
+
+			paths, err := fh.ListWalFiles(*options.FileHandlerOpts)
+			if err != nil {
+				t.Fatalf("ListWalFiles() failed: %v", err)
+			}
+			if len(paths) != tc.expectedSegments {
+				t.Errorf("Expected %d segments, got %v", tc.expectedSegments, paths)
+			}
+
+			// Writing continues right after lsn
+			lsn, err := w.WriteBuffer([]byte("new"))
+			if err != nil {
+				t.Fatalf("WriteBuffer() failed: %v", err)
+			}
+			if lsn != tc.lsn+1 {
+				t.Errorf("Expected LSN %d, got %d", tc.lsn+1, lsn)
+			}
+			err = w.FlushBuffer()
+			if err != nil {
+				t.Fatalf("FlushBuffer() failed: %v", err)
+			}
+
+			result, err := Recover(options)
+			if err != nil {
+				t.Fatalf("Recover() failed: %v", err)
+			}
+			if len(result) != int(tc.lsn)+1 {
+				t.Fatalf("Expected %d entries, got %d", tc.lsn+1, len(result))
+			}
+			for i, entry := range result {
+				if entry.LSN != uint64(i+1) {
+					t.Errorf("Expected LSN %d, got %d", i+1, entry.LSN)
+				}
+			}
+			if string(result[len(result)-1].Data) != "new" {
+				t.Errorf("Expected last entry to be the new one, got %q", result[len(result)-1].Data)
+			}
+		})
+	}
+}
+
+func TestTruncateAfterLowWaterMark(t *testing.T) {
+	w, _ := newTestWal(t, 10)
+	defer w.Close()
+
+	err := w.Truncate(6)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+
+	// Entries below the low-water mark cannot be rewritten
+	err = w.TruncateAfter(3)
+	if err == nil {
+		t.Errorf("Expected TruncateAfter() to fail below the low-water mark")
+	}
+
+	// Right at the mark is fine
+	err = w.TruncateAfter(5)
+	if err != nil {
+		t.Fatalf("TruncateAfter() failed: %v", err)
+	}
+	lsn, err := w.WriteBuffer([]byte("new"))
+	if err != nil || lsn != 6 {
+		t.Errorf("Expected LSN 6, got %d (%v)", lsn, err)
+	}
+}
+
+func TestTruncateAfterFailure(t *testing.T) {
+	fs := faultfs.New(1)
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = "/wal"
+	fileHandlerOpts.FS = fs
+	options := &WalOptions{
+		BufferSize:      64,
+		SegmentSize:     128,
+		FileHandlerOpts: &fileHandlerOpts,
+	}
+
+	w, err := InitWal(options)
+	if err != nil {
+		t.Fatalf("InitWal() failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		_, err = w.WriteBuffer([]byte("0123456789"))
+		if err != nil {
+			t.Fatalf("WriteBuffer() failed: %v", err)
+		}
+	}
+
+	// The hot file is closed before the segments after the cut cannot be removed
+	eperm := errors.New("operation not permitted")
+	fs.SetFault(func(op faultfs.Op, name string) error {
+		if op == faultfs.OpRemove {
+			return eperm
+		}
+		return nil
+	})
+	err = w.TruncateAfter(2)
+	if !errors.Is(err, eperm) {
+		t.Fatalf("Expected TruncateAfter() to fail with the remove error, got %v", err)
+	}
+	fs.SetFault(nil)
+
+	if _, err = w.WriteBuffer([]byte("new")); !errors.Is(err, eperm) {
+		t.Errorf("Expected WriteBuffer() to fail with the remove error, got %v", err)
+	}
+	if err = w.FlushBuffer(); !errors.Is(err, eperm) {
+		t.Errorf("Expected FlushBuffer() to fail with the remove error, got %v", err)
+	}
+	if err = w.Close(); !errors.Is(err, eperm) {
+		t.Errorf("Expected Close() to fail with the remove error, got %v", err)
+	}
+
+	// Nothing was removed, and the Wal can be opened again
+	w, err = OpenWal(options)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	defer w.Close()
+	if w.lsn != 11 {
+		t.Errorf("Expected next LSN 11, got %d", w.lsn)
+	}
+}
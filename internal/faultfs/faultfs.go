@@ -0,0 +1,697 @@
+// Package faultfs implements a filesystem for the crash-consistency tests of the WAL.
+//
+// Like the in-memory FS of file_handler, it keeps every file in memory, but it also tracks
+// what would survive a power loss: the content of a file as of its last Sync, and the entries
+// of a directory as of its last SyncDir. Crash and CrashTorn simulate a power loss, bringing
+// the FS back to that state, and faults can be injected in any operation: SetFault fails it,
+// SetCapacity runs out of space (ENOSPC) and CrashAfter loses power before it runs.
+//
+// Directories are durable as soon as they are created. A failed Sync drops the writes since the
+// last one, like Linux may drop the pages it failed to write back: they are not read back anymore,
+// and a later Sync cannot make them durable.
+package faultfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// Op identifies an operation of the FS, for fault injection.
+type Op int
+
+const (
+	OpOpen Op = iota
+	OpRead
+	OpWrite
+	OpSeek
+	OpStat
+	OpTruncate
+	OpSync
+	OpMkdir
+	OpRemove
+	OpRename
+	OpReadDir
+	OpSyncDir
+	OpLock
+)
+
+var opNames = [...]string{"open", "read", "write", "seek", "stat", "truncate", "sync", "mkdir",
+	"remove", "rename", "readdir", "syncdir", "lock"}
+
+func (op Op) String() string {
+	return opNames[op]
+}
+
+// ErrCrashed is returned by every operation once the power is lost, until Crash or CrashTorn,
+// and by the files opened before the power was lost.
+var ErrCrashed = errors.New("power lost")
+
+// FS is a fh.FS injecting faults, safe for concurrent use.
+type FS struct {
+	mu         sync.Mutex
+	rand       *rand.Rand
+	files      map[string]*inode // Regular files by clean path
+	durable    map[string]*inode // Regular files as of the last SyncDir of their directory
+	dirs       map[string]bool   // Directories by clean path
+	locks      map[string]bool   // Files locked with Lock
+	fault      func(Op, string) error
+	capacity   int64 // Max bytes stored in the files, 0 means no limit
+	crashAfter int   // Operations left before losing power, -1 means never
+	crashed    bool  // The power was lost
+	generation int   // Number of crashes, files opened before the last one are dead
+}
+
+// inode is a file of the FS, shared by every name and open file pointing to it.
+type inode struct {
+	data    []byte  // Content read back, as in the OS page cache
+	synced  []byte  // Content as of the last Sync
+	pending []write // Writes and truncations since the last Sync, in order
+	perm    fs.FileMode
+	modTime time.Time
+}
+
+// write is a change to the content of an inode.
+type write struct {
+	offset   int64 // Offset of the data, or new size of a truncation
+	data     []byte
+	truncate bool
+}
+
+// New creates an empty FS. Its root directory always exists.
+//
+// Parameters:
+//   - seed: The seed of the random choices of CrashTorn.
+//
+// Returns:
+//   - A pointer to the new FS.
+func New(seed int64) *FS {
+	return &FS{
+		rand:       rand.New(rand.NewSource(seed)),
+		files:      make(map[string]*inode),
+		durable:    make(map[string]*inode),
+		dirs:       map[string]bool{"/": true, ".": true},
+		locks:      make(map[string]bool),
+		crashAfter: -1,
+	}
+}
+
+// SetFault sets a function called before every operation, with the path it is run on.
+// If it returns an error, the operation fails with it and does nothing.
+// It runs while the FS is locked, so it must not use the FS. nil removes it.
+//
+// Parameters:
+//   - fault: The function deciding which operations fail.
+func (f *FS) SetFault(fault func(op Op, name string) error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fault = fault
+}
+
+// SetCapacity limits the bytes stored in the files of the FS. Writes going beyond it
+// are cut short and fail with syscall.ENOSPC, like on a full disk.
+//
+// Parameters:
+//   - capacity: The max number of bytes, 0 removes the limit.
+func (f *FS) SetCapacity(capacity int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.capacity = capacity
+}
+
+// CrashAfter loses power right before the operation after the next n ones: it fails,
+// along with every operation after it, with ErrCrashed until Crash or CrashTorn.
+//
+// Parameters:
+//   - n: The number of operations that still succeed.
+func (f *FS) CrashAfter(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.crashAfter = n
+}
+
+// Crashed checks if the power was lost by CrashAfter.
+func (f *FS) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// Crash simulates a power loss and a reboot: every write not synced and every directory
+// entry not synced with SyncDir are lost. Files opened before are dead, and locks are released.
+func (f *FS) Crash() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.restart(false)
+}
+
+// CrashTorn simulates a power loss like Crash, but part of the writes not synced reach the disk:
+// the ones before a random point, in the order they were done, and a random part of the write
+// at that point. So the last file written usually ends with a torn record.
+func (f *FS) CrashTorn() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.restart(true)
+}
+
+// restart brings the FS back to its durable state. The caller must hold mu.
+//
+// Parameters:
+//   - torn: Part of the writes not synced are kept.
+func (f *FS) restart(torn bool) {
+	f.files = make(map[string]*inode)
+	restored := make(map[*inode]bool)
+	for name, node := range f.durable {
+		f.files[name] = node
+		if restored[node] {
+			continue
+		}
+		restored[node] = true
+
+		data := append([]byte{}, node.synced...)
+		if torn && len(node.pending) > 0 {
+			kept := f.rand.Intn(len(node.pending) + 1)
+			for _, w := range node.pending[:kept] {
+				data = w.apply(data)
+			}
+			if kept < len(node.pending) && !node.pending[kept].truncate {
+				w := node.pending[kept]
+				w.data = w.data[:f.rand.Intn(len(w.data)+1)]
+				data = w.apply(data)
+			}
+		}
+		node.data = data
+		node.synced = append([]byte{}, data...)
+		node.pending = nil
+	}
+
+	f.locks = make(map[string]bool)
+	f.crashAfter = -1
+	f.crashed = false
+	f.generation++
+}
+
+// apply returns the content of a file after the write.
+func (w write) apply(data []byte) []byte {
+	if w.truncate {
+		return resize(data, w.offset)
+	}
+	end := w.offset + int64(len(w.data))
+	if end > int64(len(data)) {
+		data = resize(data, end)
+	}
+	copy(data[w.offset:], w.data)
+	return data
+}
+
+// resize grows data with zeros, or shrinks it, to the given size.
+func resize(data []byte, size int64) []byte {
+	if size <= int64(len(data)) {
+		return data[:size]
+	}
+	return append(data, make([]byte, size-int64(len(data)))...)
+}
+
+// begin checks if an operation can run, losing power if it is its turn.
+// The caller must hold mu.
+//
+// Parameters:
+//   - op: The operation.
+//   - name: The path the operation is run on.
+//
+// Returns:
+//   - ErrCrashed once the power is lost, or the error of the fault set with SetFault.
+func (f *FS) begin(op Op, name string) error {
+	if f.crashAfter == 0 {
+		f.crashed = true
+	}
+	if f.crashed {
+		return &fs.PathError{Op: op.String(), Path: name, Err: ErrCrashed}
+	}
+	if f.crashAfter > 0 {
+		f.crashAfter--
+	}
+	if f.fault != nil {
+		err := f.fault(op, name)
+		if err != nil {
+			return &fs.PathError{Op: op.String(), Path: name, Err: err}
+		}
+	}
+	return nil
+}
+
+// free returns the bytes left before reaching the capacity, or -1 without limit.
+// The caller must hold mu.
+func (f *FS) free() int64 {
+	if f.capacity == 0 {
+		return -1
+	}
+	used := int64(0)
+	counted := make(map[*inode]bool)
+	for _, node := range f.files {
+		if !counted[node] {
+			counted[node] = true
+			used += int64(len(node.data))
+		}
+	}
+	return max(f.capacity-used, 0)
+}
+
+func (f *FS) OpenFile(name string, flag int, perm fs.FileMode) (fh.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = path.Clean(name)
+	err := f.begin(OpOpen, name)
+	if err != nil {
+		return nil, err
+	}
+
+	node, exists := f.files[name]
+	switch {
+	case f.dirs[name]:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !exists && (flag&os.O_CREATE == 0 || !f.dirs[path.Dir(name)]):
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if !exists {
+		node = &inode{perm: perm.Perm(), modTime: time.Now()}
+		f.files[name] = node
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		node.truncate(0)
+	}
+	return &file{fs: f, name: name, node: node, flag: flag, generation: f.generation}, nil
+}
+
+func (f *FS) MkdirAll(dir string, perm fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir = path.Clean(dir)
+	err := f.begin(OpMkdir, dir)
+	if err != nil {
+		return err
+	}
+
+	for ; !f.dirs[dir]; dir = path.Dir(dir) {
+		if _, ok := f.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		f.dirs[dir] = true
+	}
+	return nil
+}
+
+func (f *FS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = path.Clean(name)
+	err := f.begin(OpRemove, name)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := f.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(f.files, name)
+	return nil
+}
+
+func (f *FS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	oldpath, newpath = path.Clean(oldpath), path.Clean(newpath)
+	err := f.begin(OpRename, oldpath)
+	if err != nil {
+		return err
+	}
+
+	node, ok := f.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if f.dirs[newpath] || !f.dirs[path.Dir(newpath)] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+	delete(f.files, oldpath)
+	f.files[newpath] = node
+	return nil
+}
+
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = path.Clean(name)
+	err := f.begin(OpReadDir, name)
+	if err != nil {
+		return nil, err
+	}
+	if !f.dirs[name] {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []fs.DirEntry
+	for p, node := range f.files {
+		if path.Dir(p) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(node.info(path.Base(p))))
+		}
+	}
+	for p := range f.dirs {
+		if p != name && path.Dir(p) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(fileInfo{name: path.Base(p), mode: fs.ModeDir | 0755}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = path.Clean(name)
+	err := f.begin(OpStat, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if node, ok := f.files[name]; ok {
+		return node.info(path.Base(name)), nil
+	}
+	if f.dirs[name] {
+		return fileInfo{name: path.Base(name), mode: fs.ModeDir | 0755}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (f *FS) SyncDir(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = path.Clean(name)
+	err := f.begin(OpSyncDir, name)
+	if err != nil {
+		return err
+	}
+	if !f.dirs[name] {
+		return &fs.PathError{Op: "syncdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	for p := range f.durable {
+		if path.Dir(p) == name {
+			delete(f.durable, p)
+		}
+	}
+	for p, node := range f.files {
+		if path.Dir(p) == name {
+			f.durable[p] = node
+		}
+	}
+	return nil
+}
+
+func (f *FS) Lock(name string, perm fs.FileMode) (io.Closer, error) {
+	file, err := f.OpenFile(name, os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = path.Clean(name)
+	err = f.begin(OpLock, name)
+	if err != nil {
+		return nil, err
+	}
+	if f.locks[name] {
+		return nil, fh.ErrLocked
+	}
+	f.locks[name] = true
+	return &lock{fs: f, name: name, generation: f.generation}, nil
+}
+
+// truncate changes the size of the inode, as a write to be synced.
+func (n *inode) truncate(size int64) {
+	n.data = resize(n.data, size)
+	n.pending = append(n.pending, write{offset: size, truncate: true})
+	n.modTime = time.Now()
+}
+
+// info returns the FileInfo of the inode, named name.
+func (n *inode) info(name string) fs.FileInfo {
+	return fileInfo{name: name, size: int64(len(n.data)), mode: n.perm, modTime: n.modTime}
+}
+
+// lock is a lock taken by FS.Lock.
+type lock struct {
+	fs         *FS
+	name       string
+	generation int
+	released   bool
+}
+
+func (l *lock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+
+	if l.released {
+		return fs.ErrClosed
+	}
+	l.released = true
+	// A crash already released it, and it may be held by someone else now
+	if l.generation == l.fs.generation {
+		delete(l.fs.locks, l.name)
+	}
+	return nil
+}
+
+// file is a fh.File opened on a FS.
+type file struct {
+	fs         *FS
+	name       string // Path it was opened with
+	node       *inode
+	flag       int
+	offset     int64
+	closed     bool
+	generation int // Files opened before a crash are dead
+}
+
+// begin checks if an operation can run on the file. The caller must hold the lock of the FS.
+func (h *file) begin(op Op) error {
+	if h.generation != h.fs.generation {
+		return &fs.PathError{Op: op.String(), Path: h.name, Err: ErrCrashed}
+	}
+	if h.closed {
+		return &fs.PathError{Op: op.String(), Path: h.name, Err: fs.ErrClosed}
+	}
+	return h.fs.begin(op, h.name)
+}
+
+func (h *file) Name() string {
+	return h.name
+}
+
+func (h *file) Read(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	n, err := h.readAt(p, h.offset)
+	h.offset += int64(n)
+	return n, err
+}
+
+func (h *file) ReadAt(p []byte, off int64) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	n, err := h.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// readAt reads from the given offset. The caller must hold the lock of the FS.
+func (h *file) readAt(p []byte, off int64) (int, error) {
+	err := h.begin(OpRead)
+	if err != nil {
+		return 0, err
+	}
+	if h.flag&os.O_WRONLY != 0 || off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: h.name, Err: fs.ErrInvalid}
+	}
+	if off >= int64(len(h.node.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, h.node.data[off:]), nil
+}
+
+func (h *file) Write(p []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if h.flag&os.O_APPEND != 0 {
+		h.offset = int64(len(h.node.data))
+	}
+	n, err := h.writeAt(p, h.offset)
+	h.offset += int64(n)
+	return n, err
+}
+
+func (h *file) WriteAt(p []byte, off int64) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if h.flag&os.O_APPEND != 0 {
+		return 0, &fs.PathError{Op: "write", Path: h.name, Err: errors.New("file opened with O_APPEND")}
+	}
+	return h.writeAt(p, off)
+}
+
+// writeAt writes at the given offset, as much as fits in the capacity of the FS.
+// The caller must hold the lock of the FS.
+func (h *file) writeAt(p []byte, off int64) (int, error) {
+	err := h.begin(OpWrite)
+	if err != nil {
+		return 0, err
+	}
+	if h.flag&(os.O_WRONLY|os.O_RDWR) == 0 || off < 0 {
+		return 0, &fs.PathError{Op: "write", Path: h.name, Err: fs.ErrInvalid}
+	}
+
+	// Overwriting takes no space, growing the file does
+	var noSpace error
+	if free := h.fs.free(); free >= 0 && off+int64(len(p)) > int64(len(h.node.data))+free {
+		p = p[:max(int64(len(h.node.data))+free-off, 0)]
+		noSpace = &fs.PathError{Op: "write", Path: h.name, Err: syscall.ENOSPC}
+	}
+
+	w := write{offset: off, data: append([]byte{}, p...)}
+	h.node.data = w.apply(h.node.data)
+	h.node.pending = append(h.node.pending, w)
+	h.node.modTime = time.Now()
+	return len(p), noSpace
+}
+
+func (h *file) Seek(offset int64, whence int) (int64, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	err := h.begin(OpSeek)
+	if err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += h.offset
+	case io.SeekEnd:
+		offset += int64(len(h.node.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: h.name, Err: fs.ErrInvalid}
+	}
+	h.offset = offset
+	return offset, nil
+}
+
+func (h *file) Stat() (fs.FileInfo, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	err := h.begin(OpStat)
+	if err != nil {
+		return nil, err
+	}
+	return h.node.info(path.Base(h.name)), nil
+}
+
+func (h *file) Sync() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	err := h.begin(OpSync)
+	if err != nil {
+		// Only a fault reaches the disk, unlike a crash or a closed file
+		if !errors.Is(err, ErrCrashed) && !errors.Is(err, fs.ErrClosed) {
+			h.node.data = append([]byte{}, h.node.synced...)
+			h.node.pending = nil
+		}
+		return err
+	}
+	h.node.synced = append(h.node.synced[:0], h.node.data...)
+	h.node.pending = nil
+	return nil
+}
+
+func (h *file) Truncate(size int64) error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	err := h.begin(OpTruncate)
+	if err != nil {
+		return err
+	}
+	if h.flag&(os.O_WRONLY|os.O_RDWR) == 0 || size < 0 {
+		return &fs.PathError{Op: "truncate", Path: h.name, Err: fs.ErrInvalid}
+	}
+	if free := h.fs.free(); free >= 0 && size > int64(len(h.node.data))+free {
+		return &fs.PathError{Op: "truncate", Path: h.name, Err: syscall.ENOSPC}
+	}
+	h.node.truncate(size)
+	return nil
+}
+
+func (h *file) Close() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	// Closing never loses power, so a crashed Wal can still release its files
+	if h.generation != h.fs.generation || h.fs.crashed {
+		h.closed = true
+		return nil
+	}
+	if h.closed {
+		return &fs.PathError{Op: "close", Path: h.name, Err: fs.ErrClosed}
+	}
+	h.closed = true
+	return nil
+}
+
+// fileInfo is the FileInfo of a file or directory of a FS.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) Mode() fs.FileMode  { return i.mode }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fileInfo) Sys() any           { return nil }
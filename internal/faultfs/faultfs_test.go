@@ -0,0 +1,214 @@
+package faultfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// writeFile creates a file in /wal with the given content, optionally syncing it and its directory.
+func writeFile(t *testing.T, f *FS, name string, content string, sync bool) {
+	t.Helper()
+	err := f.MkdirAll("/wal", 0755)
+	if err != nil {
+		t.Fatalf("MkdirAll() failed: %v", err)
+	}
+	file, err := f.OpenFile("/wal/"+name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	defer file.Close()
+	_, err = file.Write([]byte(content))
+	if err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if !sync {
+		return
+	}
+	err = file.Sync()
+	if err != nil {
+		t.Fatalf("Sync() failed: %v", err)
+	}
+	err = f.SyncDir("/wal")
+	if err != nil {
+		t.Fatalf("SyncDir() failed: %v", err)
+	}
+}
+
+// readFile returns the content of a file of /wal, or nil if it does not exist.
+func readFile(t *testing.T, f *FS, name string) []byte {
+	t.Helper()
+	file, err := f.OpenFile("/wal/"+name, os.O_RDONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("ReadAll() failed: %v", err)
+	}
+	return data
+}
+
+func TestCrash(t *testing.T) {
+	f := New(1)
+	writeFile(t, f, "synced", "Hello", true)
+	writeFile(t, f, "unsynced", "Bye", false)
+
+	// Appended to a synced file, but not synced itself
+	file, err := f.OpenFile("/wal/synced", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	_, err = file.Write([]byte(" World!"))
+	if err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if data := readFile(t, f, "synced"); string(data) != "Hello World!" {
+		t.Errorf("Expected %q before the crash, got %q", "Hello World!", data)
+	}
+
+	f.Crash()
+
+	if data := readFile(t, f, "synced"); string(data) != "Hello" {
+		t.Errorf("Expected %q after the crash, got %q", "Hello", data)
+	}
+	// Its directory entry was never synced
+	if data := readFile(t, f, "unsynced"); data != nil {
+		t.Errorf("Expected the unsynced file to be lost, got %q", data)
+	}
+	// Files opened before the crash are dead
+	if _, err = file.Write([]byte("!")); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected ErrCrashed, got %v", err)
+	}
+}
+
+func TestCrashDirectory(t *testing.T) {
+	f := New(1)
+	writeFile(t, f, "first", "Hello", true)
+	writeFile(t, f, "second", "World", true)
+
+	// Neither the removal nor the rename are synced
+	err := f.Remove("/wal/first")
+	if err != nil {
+		t.Fatalf("Remove() failed: %v", err)
+	}
+	err = f.Rename("/wal/second", "/wal/third")
+	if err != nil {
+		t.Fatalf("Rename() failed: %v", err)
+	}
+
+	f.Crash()
+
+	if data := readFile(t, f, "first"); string(data) != "Hello" {
+		t.Errorf("Expected the removal to be lost, got %q", data)
+	}
+	if data := readFile(t, f, "second"); string(data) != "World" {
+		t.Errorf("Expected the rename to be lost, got %q", data)
+	}
+	if data := readFile(t, f, "third"); data != nil {
+		t.Errorf("Expected the rename to be lost, got %q", data)
+	}
+}
+
+func TestCrashTorn(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	torn := 0
+	for seed := int64(0); seed < 20; seed++ {
+		f := New(seed)
+		writeFile(t, f, "log", "", true)
+
+		file, err := f.OpenFile("/wal/log", os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("OpenFile() failed: %v", err)
+		}
+		for i := 0; i < len(content); i += 5 {
+			_, err = file.Write(content[i : i+5])
+			if err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+		}
+
+		f.CrashTorn()
+
+		// A prefix of the writes survives, the last one maybe torn
+		data := readFile(t, f, "log")
+		if !bytes.HasPrefix(content, data) {
+			t.Fatalf("Expected a prefix of %q, got %q", content, data)
+		}
+		if len(data)%5 != 0 {
+			torn++
+		}
+	}
+	if torn == 0 {
+		t.Errorf("Expected some writes to be torn")
+	}
+}
+
+func TestFaults(t *testing.T) {
+	f := New(1)
+	writeFile(t, f, "log", "Hello", true)
+	file, err := f.OpenFile("/wal/log", os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	defer file.Close()
+
+	// Failed syncs drop the writes
+	eio := errors.New("input/output error")
+	f.SetFault(func(op Op, name string) error {
+		if op == OpSync {
+			return eio
+		}
+		return nil
+	})
+	_, err = file.Write([]byte(" World!"))
+	if err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err = file.Sync(); !errors.Is(err, eio) {
+		t.Errorf("Expected the injected error, got %v", err)
+	}
+	f.SetFault(nil)
+	if data := readFile(t, f, "log"); string(data) != "Hello" {
+		t.Errorf("Expected the writes to be dropped, got %q", data)
+	}
+	if err = file.Sync(); err != nil {
+		t.Errorf("Sync() failed: %v", err)
+	}
+
+	// Writes beyond the capacity are cut short
+	f.SetCapacity(8)
+	n, err := file.Write([]byte("0123456789"))
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("Expected ENOSPC, got %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected 3 bytes written, got %d", n)
+	}
+	f.SetCapacity(0)
+
+	// The power is lost on the third operation
+	f.CrashAfter(2)
+	for i := 0; i < 3; i++ {
+		_, err = file.Write([]byte("!"))
+	}
+	if !errors.Is(err, ErrCrashed) || !f.Crashed() {
+		t.Errorf("Expected ErrCrashed, got %v", err)
+	}
+	if _, err = f.Stat("/wal/log"); !errors.Is(err, ErrCrashed) {
+		t.Errorf("Expected ErrCrashed after the power is lost, got %v", err)
+	}
+
+	f.Crash()
+	if data := readFile(t, f, "log"); string(data) != "Hello" {
+		t.Errorf("Expected %q, got %q", "Hello", data)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package file_handler
+
+import (
+	"os"
+	"syscall"
+)
+
+// Datasync() flushes the content of a file to disk using fdatasync, which skips the metadata
+// not needed to read the data back (e.g. modification time), making it cheaper than File.Sync().
+// Files not stored on disk by OSFS fall back to File.Sync().
+//
+// Parameters:
+//   - file: The file to be synced.
+//
+// Returns:
+//   - An error if the file cannot be synced.
+func Datasync(file File) error {
+	osFile, ok := file.(*os.File)
+	if !ok {
+		return file.Sync()
+	}
+
+	for {
+		err := syscall.Fdatasync(int(osFile.Fd()))
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
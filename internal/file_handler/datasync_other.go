@@ -0,0 +1,15 @@
+//go:build !linux
+
+package file_handler
+
+// Datasync() flushes the content of a file to disk.
+// fdatasync is not available on this platform, so it falls back to File.Sync().
+//
+// Parameters:
+//   - file: The file to be synced.
+//
+// Returns:
+//   - An error if the file cannot be synced.
+func Datasync(file File) error {
+	return file.Sync()
+}
@@ -1,26 +1,45 @@
 package file_handler
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-var (
-	fileWalCounter int = 0 // First aproach: only use one file for wal logs
-)
+// CheckpointFileName is the name of the checkpoint file inside the WAL directory.
+const CheckpointFileName = "checkpoint"
+
+// LockFileName is the name of the file locked by LockDir() inside the WAL directory.
+const LockFileName = "LOCK"
+
+// recycledFilePrefix is the prefix of the names of the WAL files kept by RecycleWalFile().
+// Their names do not start with "wal_", so they are not WAL files until ReuseWalFile() renames them.
+const recycledFilePrefix = "recycled_"
+
+// ErrLocked is returned by LockDir() when another Wal holds the lock of the WAL directory.
+var ErrLocked = errors.New("WAL folder is locked by another Wal")
+
+// ErrLockUnsupported is returned by LockDir() with OSFS on platforms where files cannot be locked.
+var ErrLockUnsupported = errors.New("locking the WAL folder is not supported on this platform")
 
 // Options defines the configuration options for managing WAL files and directories.
 // Fields:
 //   - DirName: The name of the directory where WAL files will be stored.
 //   - DirPerms: The permissions to set for the WAL directory.
 //   - FilePerms: The permissions to set for the WAL files.
+//   - FS: The filesystem where the WAL directory is stored. nil means OSFS.
 //   - createFileFlags: Flags used when creating WAL files (e.g., read/write, create).
 type Options struct {
 	DirName         string
 	DirPerms        fs.FileMode
 	FilePerms       fs.FileMode
+	FS              FS
 	createFileFlags int
 }
 
@@ -46,7 +65,7 @@ var DefaultOptions = &Options{
 // Returns:
 //   - An error if the directory cannot be created, or nil if successful.
 func CreateWalFolder(opts Options) error {
-	err := os.MkdirAll(opts.DirName, opts.DirPerms)
+	err := opts.fs().MkdirAll(opts.DirName, opts.DirPerms)
 	if err != nil {
 		return fmt.Errorf("failed to create WAL folder: %w", err)
 	}
@@ -54,20 +73,56 @@ func CreateWalFolder(opts Options) error {
 }
 
 // CreateWalNewFile() creates a new WAL file in the specified directory with the given options.
-// The file name is automatically generated in the format "wal_XXX.log", where XXX is a counter.
+// The file is named after the LSN of its first record, in the format "wal_XXXXXXXXXXXXXXXX.log"
+// with the LSN in hexadecimal, so files sort by name in the order they were created.
+// An entry split in fragments may span several files starting with the same LSN: the ones after
+// the first are named "wal_XXXXXXXXXXXXXXXX_N.log", N being the number of files before it.
+// The WAL directory is synced, so the file is not lost on power loss once its content is synced.
 //
 // Parameters:
 //   - opts: An Options struct containing the directory name, file permissions, and creation flags.
+//   - firstLSN: The LSN of the first record that will be written to the file.
 //
 // Returns:
-//   - A pointer to the newly created os.File object.
+//   - The newly created File.
 //   - An error if the file cannot be created.
-func CreateWalNewFile(opts Options) (*os.File, error) {
-	fileName := fmt.Sprintf("wal_%03d.log", fileWalCounter)
-	fileWalCounter++
-	filePath := path.Join(opts.DirName, fileName)
+func CreateWalNewFile(opts Options, firstLSN uint64) (File, error) {
+	for part := 0; ; part++ {
+		filePath := path.Join(opts.DirName, walFileName{lsn: firstLSN, part: part}.String())
+
+		file, err := opts.fs().OpenFile(filePath, opts.createFileFlags|os.O_EXCL, opts.FilePerms)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = SyncDir(opts)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+}
+
+// OpenWalFile() opens an existing WAL file to keep appending to it.
+//
+// Parameters:
+//   - opts: An Options struct containing the file permissions.
+//   - filePath: The full path to the WAL file to be opened.
+//
+// Returns:
+//   - The opened File.
+//   - An error if the file cannot be opened.
+func OpenWalFile(opts Options, filePath string) (File, error) {
+	_, ok := parseWalFileName(path.Base(filePath))
+	if !ok {
+		return nil, fmt.Errorf("%s is not a WAL file", filePath)
+	}
 
-	file, err := os.OpenFile(filePath, opts.createFileFlags, opts.FilePerms)
+	file, err := opts.fs().OpenFile(filePath, os.O_RDWR, opts.FilePerms)
 	if err != nil {
 		return nil, err
 	}
@@ -75,51 +130,459 @@ func CreateWalNewFile(opts Options) (*os.File, error) {
 	return file, nil
 }
 
-// CreateCheckpointFile() creates a new checkpoint file in the specified directory.
-// Checkpoint files are used to store the state of the system at a specific point in time.
+// OpenFile() opens a file of the WAL directory for reading.
 //
 // Parameters:
-//   - opts: An Options struct containing the directory name, file permissions, and creation flags.
+//   - opts: An Options struct containing the filesystem.
+//   - filePath: The full path to the file to be opened.
 //
 // Returns:
-//   - A pointer to the newly created os.File object.
-//   - An error if the file cannot be created.
-func CreateCheckpointFile(opts Options) (*os.File, error) {
-	filePath := path.Join(opts.DirName, "checkpoint")
+//   - The opened File.
+//   - An error wrapping fs.ErrNotExist if the file does not exist, or an error if it cannot be opened.
+func OpenFile(opts Options, filePath string) (File, error) {
+	return opts.fs().OpenFile(filePath, os.O_RDONLY, 0)
+}
+
+// StatFile() returns the FileInfo of a file of the WAL directory.
+//
+// Parameters:
+//   - opts: An Options struct containing the filesystem.
+//   - filePath: The full path to the file.
+//
+// Returns:
+//   - The FileInfo of the file.
+//   - An error wrapping fs.ErrNotExist if the file does not exist, or an error if it cannot be read.
+func StatFile(opts Options, filePath string) (fs.FileInfo, error) {
+	return opts.fs().Stat(filePath)
+}
+
+// ListWalFiles() returns the paths of the WAL files stored in the WAL directory,
+// in the order they were created. Files named after a counter by older versions,
+// in the format "wal_XXX.log", come first, ordered by their counter.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name.
+//
+// Returns:
+//   - A slice with the paths of the WAL files. It is empty if the directory does not exist.
+//   - An error if the directory cannot be read.
+func ListWalFiles(opts Options) ([]string, error) {
+	dirEntries, err := opts.fs().ReadDir(opts.DirName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read WAL folder: %w", err)
+	}
+
+	type walFile struct {
+		name walFileName
+		path string
+	}
+	var walFiles []walFile
+	for _, entry := range dirEntries {
+		name, ok := parseWalFileName(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		walFiles = append(walFiles, walFile{name: name, path: path.Join(opts.DirName, entry.Name())})
+	}
+
+	// Lexical order breaks once the counter of legacy files needs more than 3 digits
+	sort.Slice(walFiles, func(i, j int) bool {
+		return walFiles[i].name.less(walFiles[j].name)
+	})
+
+	paths := make([]string, 0, len(walFiles))
+	for _, f := range walFiles {
+		paths = append(paths, f.path)
+	}
+	return paths, nil
+}
+
+// WalFileFirstLSN() returns the LSN of the first record of a WAL file, taken from its name.
+// Every record of the file has an LSN equal or higher, but the first one may be the tail of
+// an entry split in fragments, so the entry with that LSN may start in an earlier file.
+//
+// Parameters:
+//   - filePath: The path to the WAL file.
+//
+// Returns:
+//   - The LSN of the first record of the file.
+//   - false if the file is named after a counter, so the LSN is unknown.
+func WalFileFirstLSN(filePath string) (uint64, bool) {
+	name, ok := parseWalFileName(path.Base(filePath))
+	if !ok || name.legacy {
+		return 0, false
+	}
+	return name.lsn, true
+}
+
+// walFileName identifies a WAL file from its name.
+type walFileName struct {
+	legacy  bool   // Named after a counter by older versions
+	counter int    // Counter of a legacy file
+	lsn     uint64 // LSN of the first record of the file
+	part    int    // Number of files before it starting with the same LSN
+}
+
+// String() returns the name of the file.
+func (n walFileName) String() string {
+	if n.legacy {
+		return fmt.Sprintf("wal_%03d.log", n.counter)
+	}
+	if n.part > 0 {
+		return fmt.Sprintf("wal_%016x_%d.log", n.lsn, n.part)
+	}
+	return fmt.Sprintf("wal_%016x.log", n.lsn)
+}
+
+// less() checks if the file named n was created before the one named o.
+func (n walFileName) less(o walFileName) bool {
+	if n.legacy != o.legacy {
+		return n.legacy
+	}
+	if n.legacy {
+		return n.counter < o.counter
+	}
+	if n.lsn != o.lsn {
+		return n.lsn < o.lsn
+	}
+	return n.part < o.part
+}
+
+// parseWalFileName() parses a file name in the format "wal_XXXXXXXXXXXXXXXX.log",
+// "wal_XXXXXXXXXXXXXXXX_N.log" or, for files named by older versions, "wal_XXX.log".
+//
+// Parameters:
+//   - name: The name of the file, without directory.
+//
+// Returns:
+//   - The parsed name of the WAL file.
+//   - false if the name does not belong to a WAL file.
+func parseWalFileName(name string) (walFileName, bool) {
+	if !strings.HasPrefix(name, "wal_") || !strings.HasSuffix(name, ".log") {
+		return walFileName{}, false
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(name, "wal_"), ".log")
+
+	lsn, part, hasPart := strings.Cut(id, "_")
+	if len(lsn) == 16 {
+		parsed := walFileName{}
+		var err error
+		parsed.lsn, err = strconv.ParseUint(lsn, 16, 64)
+		if err != nil {
+			return walFileName{}, false
+		}
+		if hasPart {
+			parsed.part, err = strconv.Atoi(part)
+			if err != nil || parsed.part <= 0 {
+				return walFileName{}, false
+			}
+		}
+		// Only the name the file was created with, so a file has a single name
+		return parsed, parsed.String() == name
+	}
 
-	file, err := os.OpenFile(filePath, opts.createFileFlags, opts.FilePerms)
+	counter, err := strconv.Atoi(id)
+	if err != nil || counter < 0 {
+		return walFileName{}, false
+	}
+	return walFileName{legacy: true, counter: counter}, true
+}
+
+// RemoveWalFile() deletes a WAL file and syncs the WAL directory, so the deletion is durable.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name.
+//   - filePath: The full path to the WAL file to be deleted.
+//
+// Returns:
+//   - An error if the file cannot be deleted.
+func RemoveWalFile(opts Options, filePath string) error {
+	err := opts.fs().Remove(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to remove WAL file: %w", err)
+	}
+	return SyncDir(opts)
+}
+
+// RecycleWalFile() moves a WAL file no longer needed to the pool of recycled files, instead of
+// deleting it, so ReuseWalFile() can take it for a new segment without allocating its space again.
+// The file is renamed "recycled_N.log" and keeps its content, and the WAL directory is synced.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name.
+//   - filePath: The full path to the WAL file to be recycled.
+//
+// Returns:
+//   - An error if the file cannot be renamed.
+func RecycleWalFile(opts Options, filePath string) error {
+	recycled, err := ListRecycledFiles(opts)
 	if err != nil {
+		return err
+	}
+
+	// Numbered after the last one, so the pool is reused in the order it was filled
+	next := 0
+	if len(recycled) > 0 {
+		last, _ := parseRecycledFileName(path.Base(recycled[len(recycled)-1]))
+		next = last + 1
+	}
+
+	recycledPath := path.Join(opts.DirName, fmt.Sprintf("%s%d.log", recycledFilePrefix, next))
+	err = opts.fs().Rename(filePath, recycledPath)
+	if err != nil {
+		return fmt.Errorf("failed to recycle WAL file: %w", err)
+	}
+	return SyncDir(opts)
+}
+
+// ReuseWalFile() takes a file from the pool filled by RecycleWalFile() and renames it like
+// CreateWalNewFile() would name a new WAL file, then opens it. The content of the file is kept:
+// the caller must tell its stale records apart, which all have an LSN lower than firstLSN.
+// The WAL directory is synced, so the new name is not lost on power loss.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name and file permissions.
+//   - firstLSN: The LSN of the first record that will be written to the file.
+//
+// Returns:
+//   - The reused File, or nil if there are no recycled files.
+//   - An error if a recycled file cannot be renamed or opened.
+func ReuseWalFile(opts Options, firstLSN uint64) (File, error) {
+	recycled, err := ListRecycledFiles(opts)
+	if err != nil || len(recycled) == 0 {
 		return nil, err
 	}
 
-	return file, nil
+	for part := 0; ; part++ {
+		filePath := path.Join(opts.DirName, walFileName{lsn: firstLSN, part: part}.String())
+
+		_, err = opts.fs().Stat(filePath)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		err = opts.fs().Rename(recycled[0], filePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reuse recycled file: %w", err)
+		}
+		err = SyncDir(opts)
+		if err != nil {
+			return nil, err
+		}
+		return opts.fs().OpenFile(filePath, os.O_RDWR, opts.FilePerms)
+	}
 }
 
-// OpenWal() opens an existing WAL file for reading or writing.
-// This function is used to access WAL files that have already been created.
+// ListRecycledFiles() returns the paths of the files in the pool filled by RecycleWalFile(),
+// in the order ReuseWalFile() takes them.
 //
 // Parameters:
-//   - filePath: The full path to the WAL file to be opened.
-//   - opts: An Options struct containing the file permissions and creation flags.
+//   - opts: An Options struct containing the directory name.
 //
 // Returns:
-//   - A pointer to the opened os.File object.
-//   - An error if the file cannot be opened.
-func OpenWal(opts *Options) (*os.File, *os.File, error) {
-	err := CreateWalFolder(*opts)
+//   - A slice with the paths of the recycled files. It is empty if the directory does not exist.
+//   - An error if the directory cannot be read.
+func ListRecycledFiles(opts Options) ([]string, error) {
+	dirEntries, err := opts.fs().ReadDir(opts.DirName)
 	if err != nil {
-		return nil, nil, err
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read WAL folder: %w", err)
+	}
+
+	type recycledFile struct {
+		n    int
+		path string
+	}
+	var files []recycledFile
+	for _, entry := range dirEntries {
+		n, ok := parseRecycledFileName(entry.Name())
+		if !ok || entry.IsDir() {
+			continue
+		}
+		files = append(files, recycledFile{n: n, path: path.Join(opts.DirName, entry.Name())})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].n < files[j].n
+	})
+
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	return paths, nil
+}
+
+// parseRecycledFileName() parses a file name in the format "recycled_N.log".
+//
+// Parameters:
+//   - name: The name of the file, without directory.
+//
+// Returns:
+//   - The number N of the recycled file.
+//   - false if the name does not belong to a recycled file.
+func parseRecycledFileName(name string) (int, bool) {
+	if !strings.HasPrefix(name, recycledFilePrefix) || !strings.HasSuffix(name, ".log") {
+		return 0, false
 	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, recycledFilePrefix), ".log"))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
 
-	walFile, err := CreateWalNewFile(*opts)
+// RemoveFile() deletes a file from the WAL directory, if it exists, and syncs the directory.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name.
+//   - name: The name of the file inside the WAL directory.
+//
+// Returns:
+//   - An error if the file exists but cannot be deleted.
+func RemoveFile(opts Options, name string) error {
+	err := opts.fs().Remove(path.Join(opts.DirName, name))
 	if err != nil {
-		return nil, nil, err
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove %s: %w", name, err)
 	}
+	return SyncDir(opts)
+}
+
+// WriteFileAtomic() replaces the content of a file in the WAL directory atomically.
+// The data is written to a temporary file which is synced and renamed over the old one,
+// so after a crash the file has either the old or the new content, never a mix of both.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name and file permissions.
+//   - name: The name of the file inside the WAL directory.
+//   - data: The new content of the file.
+//
+// Returns:
+//   - An error if the file cannot be written.
+func WriteFileAtomic(opts Options, name string, data []byte) error {
+	filePath := path.Join(opts.DirName, name)
+	tmpPath := filePath + ".tmp"
 
-	checkpointFile, err := CreateCheckpointFile(*opts)
+	file, err := opts.fs().OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, opts.FilePerms)
 	if err != nil {
-		return nil, nil, err
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		opts.fs().Remove(tmpPath)
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
 	}
 
-	return walFile, checkpointFile, nil
+	err = opts.fs().Rename(tmpPath, filePath)
+	if err != nil {
+		opts.fs().Remove(tmpPath)
+		return fmt.Errorf("failed to rename %s: %w", tmpPath, err)
+	}
+	return SyncDir(opts)
+}
+
+// ReadFile() reads a file written with WriteFileAtomic().
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name.
+//   - name: The name of the file inside the WAL directory.
+//
+// Returns:
+//   - The content of the file, or nil if it does not exist.
+//   - An error if the file exists but cannot be read.
+func ReadFile(opts Options, name string) ([]byte, error) {
+	file, err := opts.fs().OpenFile(path.Join(opts.DirName, name), os.O_RDONLY, 0)
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(file)
+		file.Close()
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// SyncDir() syncs the WAL directory, making durable the creation, rename and deletion of its files.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name.
+//
+// Returns:
+//   - An error if the directory cannot be synced.
+func SyncDir(opts Options) error {
+	err := opts.fs().SyncDir(opts.DirName)
+	if err != nil {
+		return fmt.Errorf("failed to sync WAL folder: %w", err)
+	}
+	return nil
+}
+
+// OpenWal() creates the WAL directory and a new WAL file.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name, file permissions and creation flags.
+//   - firstLSN: The LSN of the first record that will be written to the WAL file.
+//
+// Returns:
+//   - The new WAL file.
+//   - An error if the directory or the file cannot be created.
+func OpenWal(opts *Options, firstLSN uint64) (File, error) {
+	err := CreateWalFolder(*opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return CreateWalNewFile(*opts, firstLSN)
+}
+
+// LockDir() takes an exclusive lock on the lock file of the WAL directory, so a single Wal
+// at a time can write to it. With OSFS it is an advisory lock (flock, or LockFileEx on Windows)
+// that keeps out other processes too, and the OS releases it if the process dies.
+//
+// Parameters:
+//   - opts: An Options struct containing the directory name and file permissions.
+//
+// Returns:
+//   - The lock, to be passed to UnlockDir().
+//   - ErrLocked if the WAL directory is already locked, ErrLockUnsupported if files cannot be locked
+//     on this platform, or an error if the lock file cannot be opened.
+func LockDir(opts Options) (io.Closer, error) {
+	return opts.fs().Lock(path.Join(opts.DirName, LockFileName), opts.FilePerms)
+}
+
+// UnlockDir() releases the lock taken by LockDir().
+//
+// Parameters:
+//   - lock: The lock returned by LockDir().
+//
+// Returns:
+//   - An error if the lock cannot be released.
+func UnlockDir(lock io.Closer) error {
+	err := lock.Close()
+	if err != nil {
+		return fmt.Errorf("failed to unlock WAL folder: %w", err)
+	}
+	return nil
 }
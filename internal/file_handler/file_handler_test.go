@@ -1,6 +1,7 @@
 package file_handler
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"testing"
@@ -25,51 +26,79 @@ func TestWalOperations(t *testing.T) {
 	})
 
 	t.Run("TestCreateWalFile", func(t *testing.T) {
-		// Ensure the specific file does not exist
-		os.Remove("/tmp/WalFolder/wal_000.log")
-		os.Remove("/tmp/WalFolder/wal_001.log")
+		// Ensure the specific files do not exist
+		first := "/tmp/WalFolder/wal_0000000000000001.log"
+		second := "/tmp/WalFolder/wal_000000000000002a.log"
+		os.Remove(first)
+		os.Remove(second)
 
 		// Calls test function
-		file, err := CreateWalNewFile(*options)
+		file, err := CreateWalNewFile(*options, 1)
 		if err != nil {
 			t.Fatalf("CreateWalNewFile() failed: %v", err)
 		}
+		defer os.Remove(first)
 
 		// Verifies if the file has been created
-		_, err = os.Stat("/tmp/WalFolder/wal_000.log")
+		_, err = os.Stat(first)
 		if err != nil {
-			t.Fatalf("Expected wal_000.log to exist")
+			t.Fatalf("Expected %s to exist", first)
 		}
 
 		// Verifies if the file pointer has been returned correctly
 		if file == nil {
 			t.Fatalf("Expected WalNewFile pointer to exist")
 		}
+		file.Close()
 
 		// Calls test function again, for second wal file
-		file, err = CreateWalNewFile(*options)
+		file, err = CreateWalNewFile(*options, 42)
 		if err != nil {
 			t.Fatalf("CreateWalNewFile() failed: %v", err)
 		}
+		defer os.Remove(second)
 
 		// Verifies if the second file has been created
-		_, err = os.Stat("/tmp/WalFolder/wal_001.log")
+		_, err = os.Stat(second)
 		if err != nil {
-			t.Fatalf("Expected wal_001.log to exist")
+			t.Fatalf("Expected %s to exist", second)
 		}
 
 		// Verifies if the second file pointer has been returned correctly
 		if file == nil {
 			t.Fatalf("Expected WalNewFile pointer to exist")
 		}
-
+		file.Close()
 	})
 
 	// Clean up after all subtests
 	os.RemoveAll("WalFolder")
 }
 
-func TestCreateCheckpointFile(t *testing.T) {
+func TestOpenWal(t *testing.T) {
+	// Setup temporary directory for testing
+	tempDir := t.TempDir()
+	opts := &Options{
+		DirName:         tempDir,
+		DirPerms:        0755,
+		FilePerms:       0644,
+		createFileFlags: os.O_CREATE | os.O_RDWR,
+	}
+	// Call OpenWal
+	walFile, err := OpenWal(opts, 1)
+	if err != nil {
+		t.Fatalf("OpenWal failed: %v", err)
+	}
+	defer walFile.Close()
+
+	// Verify the WAL file exists
+	walFilePath := filepath.Join(tempDir, "wal_0000000000000001.log")
+	if _, err := os.Stat(walFilePath); os.IsNotExist(err) {
+		t.Errorf("WAL file was not created at %s", walFilePath)
+	}
+}
+
+func TestListWalFiles(t *testing.T) {
 	// Setup temporary directory for testing
 	tempDir := t.TempDir()
 	opts := Options{
@@ -79,49 +108,326 @@ func TestCreateCheckpointFile(t *testing.T) {
 		createFileFlags: os.O_CREATE | os.O_RDWR,
 	}
 
-	// Call CreateCheckpointFile
-	file, err := CreateCheckpointFile(opts)
+	// Create files out of order, plus some that are not WAL files.
+	// Files named after a counter by older versions come first
+	names := []string{
+		"wal_1000.log", "wal_0000000000000010_1.log", "wal_002.log", "checkpoint", "wal_abc.log",
+		"wal_0000000000000100.log", "wal_999.log", "wal_0000000000000010.log", "wal_000.log",
+		"wal_00000000000000zz.log", "wal_0000000000000010_0.log", "wal_0000000000000010_x.log",
+	}
+	for _, name := range names {
+		err := os.WriteFile(filepath.Join(tempDir, name), nil, 0644)
+		if err != nil {
+			t.Fatalf("Error creating %s: %v", name, err)
+		}
+	}
+
+	paths, err := ListWalFiles(opts)
 	if err != nil {
-		t.Fatalf("CreateCheckpointFile failed: %v", err)
+		t.Fatalf("ListWalFiles failed: %v", err)
+	}
+
+	expected := []string{
+		"wal_000.log", "wal_002.log", "wal_999.log", "wal_1000.log",
+		"wal_0000000000000010.log", "wal_0000000000000010_1.log", "wal_0000000000000100.log",
+	}
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected %d WAL files, got %v", len(expected), paths)
+	}
+	for i, name := range expected {
+		if paths[i] != filepath.Join(tempDir, name) {
+			t.Errorf("Expected %s at position %d, got %s", name, i, paths[i])
+		}
+	}
+
+	// A missing folder has no WAL files
+	opts.DirName = filepath.Join(tempDir, "missing")
+	paths, err = ListWalFiles(opts)
+	if err != nil || len(paths) != 0 {
+		t.Errorf("Expected no WAL files and no error, got %v, %v", paths, err)
+	}
+}
+
+func TestOpenWalFile(t *testing.T) {
+	// Setup temporary directory for testing
+	tempDir := t.TempDir()
+	opts := Options{
+		DirName:         tempDir,
+		DirPerms:        0755,
+		FilePerms:       0644,
+		createFileFlags: os.O_CREATE | os.O_RDWR,
+	}
+	walFilePath := filepath.Join(tempDir, "wal_005.log")
+	err := os.WriteFile(walFilePath, []byte{1, 2, 3}, 0644)
+	if err != nil {
+		t.Fatalf("Error creating WAL file: %v", err)
+	}
+
+	// Existing content is kept
+	file, err := OpenWalFile(opts, walFilePath)
+	if err != nil {
+		t.Fatalf("OpenWalFile failed: %v", err)
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.Size() != 3 {
+		t.Errorf("Expected existing WAL file to keep its content")
+	}
 
-	// Verify the file exists
-	checkpointPath := filepath.Join(tempDir, "checkpoint")
-	if _, err := os.Stat(checkpointPath); os.IsNotExist(err) {
-		t.Errorf("Checkpoint file was not created at %s", checkpointPath)
+	// Files not following the WAL format are rejected
+	_, err = OpenWalFile(opts, filepath.Join(tempDir, "checkpoint"))
+	if err == nil {
+		t.Errorf("Expected OpenWalFile to reject a non WAL file")
 	}
 }
 
-func TestOpenWal(t *testing.T) {
+func TestCreateWalNewFileSameLSN(t *testing.T) {
+	tempDir := t.TempDir()
+	opts := Options{
+		DirName:         tempDir,
+		DirPerms:        0755,
+		FilePerms:       0644,
+		createFileFlags: os.O_CREATE | os.O_RDWR,
+	}
+
+	// An entry spanning several files starts all of them with the same LSN
+	expected := []string{"wal_0000000000000007.log", "wal_0000000000000007_1.log", "wal_0000000000000007_2.log"}
+	for _, name := range expected {
+		file, err := CreateWalNewFile(opts, 7)
+		if err != nil {
+			t.Fatalf("CreateWalNewFile() failed: %v", err)
+		}
+		file.Close()
+		if filepath.Base(file.Name()) != name {
+			t.Errorf("Expected %s to be created, got %s", name, file.Name())
+		}
+
+		lsn, ok := WalFileFirstLSN(file.Name())
+		if !ok || lsn != 7 {
+			t.Errorf("Expected first LSN 7 from %s, got %d, %v", name, lsn, ok)
+		}
+	}
+
+	paths, err := ListWalFiles(opts)
+	if err != nil {
+		t.Fatalf("ListWalFiles failed: %v", err)
+	}
+	for i, name := range expected {
+		if paths[i] != filepath.Join(tempDir, name) {
+			t.Errorf("Expected %s at position %d, got %s", name, i, paths[i])
+		}
+	}
+
+	// The first LSN of legacy files is unknown
+	if _, ok := WalFileFirstLSN(filepath.Join(tempDir, "wal_007.log")); ok {
+		t.Errorf("Expected no first LSN for a legacy WAL file")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
 	// Setup temporary directory for testing
 	tempDir := t.TempDir()
-	opts := &Options{
+	opts := Options{
 		DirName:         tempDir,
 		DirPerms:        0755,
 		FilePerms:       0644,
 		createFileFlags: os.O_CREATE | os.O_RDWR,
 	}
-	// Initialize the fileWalCounter to 0
-	fileWalCounter = 0
 
-	// Call OpenWal
-	walFile, checkpointFile, err := OpenWal(opts)
+	// Missing files have no content
+	data, err := ReadFile(opts, "meta")
+	if err != nil || data != nil {
+		t.Fatalf("Expected no content and no error, got %v, %v", data, err)
+	}
+
+	for _, content := range []string{"first content", "second"} {
+		err = WriteFileAtomic(opts, "meta", []byte(content))
+		if err != nil {
+			t.Fatalf("WriteFileAtomic failed: %v", err)
+		}
+		data, err = ReadFile(opts, "meta")
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if string(data) != content {
+			t.Errorf("Expected content %q, got %q", content, data)
+		}
+	}
+
+	// The temporary file is gone
+	if _, err := os.Stat(filepath.Join(tempDir, "meta.tmp")); !os.IsNotExist(err) {
+		t.Errorf("Expected temporary file to be renamed")
+	}
+}
+
+func TestDatasync(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "wal_test")
 	if err != nil {
-		t.Fatalf("OpenWal failed: %v", err)
+		t.Fatalf("Error creating temp file: %v", err)
 	}
-	defer walFile.Close()
-	defer checkpointFile.Close()
+	defer file.Close()
 
-	// Verify the WAL file exists
-	walFilePath := filepath.Join(tempDir, "wal_000.log")
-	if _, err := os.Stat(walFilePath); os.IsNotExist(err) {
-		t.Errorf("WAL file was not created at %s", walFilePath)
+	_, err = file.Write([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatalf("Error writing temp file: %v", err)
+	}
+	err = Datasync(file)
+	if err != nil {
+		t.Fatalf("Datasync failed: %v", err)
+	}
+
+	// Syncing a closed file fails
+	file.Close()
+	err = Datasync(file)
+	if err == nil {
+		t.Errorf("Expected Datasync to fail on a closed file")
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	osFile, err := os.CreateTemp(t.TempDir(), "wal_test")
+	if err != nil {
+		t.Fatalf("Error creating temp file: %v", err)
+	}
+	defer osFile.Close()
+	memFile, err := NewMemFS().OpenFile("/wal_test", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	defer memFile.Close()
+
+	for _, file := range []File{osFile, memFile} {
+		_, err = file.Write([]byte{1, 2, 3})
+		if err != nil {
+			t.Fatalf("Error writing temp file: %v", err)
+		}
+		err = Preallocate(file, 1024)
+		if err != nil {
+			t.Fatalf("Preallocate failed: %v", err)
+		}
+
+		// The content is kept, and the space added reads as zeros
+		data := make([]byte, 1024)
+		_, err = file.ReadAt(data, 0)
+		if err != nil {
+			t.Fatalf("Error reading temp file: %v", err)
+		}
+		expected := append([]byte{1, 2, 3}, make([]byte, 1021)...)
+		if !bytes.Equal(data, expected) {
+			t.Errorf("Expected the content followed by zeros, got %v", data[:8])
+		}
+
+		// A file is never shrunk
+		err = Preallocate(file, 16)
+		if err != nil {
+			t.Fatalf("Preallocate failed: %v", err)
+		}
+		info, err := file.Stat()
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		if info.Size() != 1024 {
+			t.Errorf("Expected size 1024, got %d", info.Size())
+		}
+	}
+}
+
+func TestRecycleWalFile(t *testing.T) {
+	opts := memOptions()
+	err := CreateWalFolder(opts)
+	if err != nil {
+		t.Fatalf("CreateWalFolder() failed: %v", err)
+	}
+
+	// Nothing to reuse yet
+	file, err := ReuseWalFile(opts, 1)
+	if err != nil || file != nil {
+		t.Fatalf("Expected no recycled file, got %v, %v", file, err)
+	}
+
+	for _, lsn := range []uint64{1, 5} {
+		file, err := CreateWalNewFile(opts, lsn)
+		if err != nil {
+			t.Fatalf("CreateWalNewFile() failed: %v", err)
+		}
+		file.Write([]byte{byte(lsn)})
+		file.Close()
+		err = RecycleWalFile(opts, file.Name())
+		if err != nil {
+			t.Fatalf("RecycleWalFile() failed: %v", err)
+		}
+	}
+
+	recycled, err := ListRecycledFiles(opts)
+	if err != nil {
+		t.Fatalf("ListRecycledFiles() failed: %v", err)
+	}
+	if len(recycled) != 2 || recycled[0] != "/wal/recycled_0.log" || recycled[1] != "/wal/recycled_1.log" {
+		t.Fatalf("Expected 2 recycled files, got %v", recycled)
+	}
+	// Recycled files are not WAL files
+	paths, err := ListWalFiles(opts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	if len(paths) != 0 {
+		t.Errorf("Expected no WAL files, got %v", paths)
+	}
+
+	// The oldest is reused first, keeping its content, and named like a new WAL file
+	for _, expected := range []string{"/wal/wal_0000000000000009.log", "/wal/wal_0000000000000009_1.log"} {
+		file, err := ReuseWalFile(opts, 9)
+		if err != nil {
+			t.Fatalf("ReuseWalFile() failed: %v", err)
+		}
+		if file.Name() != expected {
+			t.Errorf("Expected %s, got %s", expected, file.Name())
+		}
+		file.Close()
+	}
+	data := make([]byte, 1)
+	file, err = OpenFile(opts, "/wal/wal_0000000000000009.log")
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	file.Read(data)
+	file.Close()
+	if data[0] != 1 {
+		t.Errorf("Expected the content of the first recycled file, got %v", data)
 	}
 
-	// Verify the checkpoint file exists
-	checkpointPath := filepath.Join(tempDir, "checkpoint")
-	if _, err := os.Stat(checkpointPath); os.IsNotExist(err) {
-		t.Errorf("Checkpoint file was not created at %s", checkpointPath)
+	recycled, _ = ListRecycledFiles(opts)
+	if len(recycled) != 0 {
+		t.Errorf("Expected the recycled files to be reused, got %v", recycled)
+	}
+}
+
+func TestLockDir(t *testing.T) {
+	opts := Options{
+		DirName:         t.TempDir(),
+		DirPerms:        0755,
+		FilePerms:       0644,
+		createFileFlags: os.O_CREATE | os.O_RDWR,
+	}
+
+	lock, err := LockDir(opts)
+	if err != nil {
+		t.Fatalf("LockDir() failed: %v", err)
+	}
+
+	// The lock is held per open file, so it also works within a process
+	_, err = LockDir(opts)
+	if err != ErrLocked {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+
+	err = UnlockDir(lock)
+	if err != nil {
+		t.Fatalf("UnlockDir() failed: %v", err)
+	}
+	lock, err = LockDir(opts)
+	if err != nil {
+		t.Fatalf("LockDir() failed after UnlockDir(): %v", err)
 	}
+	UnlockDir(lock)
 }
@@ -0,0 +1,112 @@
+package file_handler
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// File is a file opened from a FS. *os.File implements it.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS is the filesystem where the WAL directory is stored. Its methods behave like
+// the functions of the os package with the same name, and return errors wrapping
+// fs.ErrNotExist or fs.ErrExist when the os package would.
+// OSFS stores it on disk, and NewMemFS() in memory.
+type FS interface {
+	// OpenFile opens a file with the given flags (os.O_RDONLY, os.O_CREATE, etc.).
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	// ReadDir returns the entries of a directory, sorted by name.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Stat(name string) (fs.FileInfo, error)
+	// SyncDir makes durable the creation, rename and deletion of the files of a directory.
+	SyncDir(name string) error
+	// Lock takes an exclusive lock on a file, creating it if needed. The lock is released
+	// by closing it. It returns ErrLocked if the lock is already held.
+	Lock(name string, perm fs.FileMode) (io.Closer, error)
+}
+
+// OSFS is the FS of the operating system, used when Options.FS is nil.
+var OSFS FS = osFS{}
+
+// osFS implements FS with the os package.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// A nil *os.File in the interface would not be nil
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) MkdirAll(path string, perm fs.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// extendFile() extends a file with zeros up to the given size, if it is smaller.
+//
+// Parameters:
+//   - file: The file to be extended.
+//   - size: The size the file must have at least.
+//
+// Returns:
+//   - An error if the file cannot be extended.
+func extendFile(file File, size int64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	return file.Truncate(size)
+}
+
+// fs() returns the FS the WAL directory is stored in.
+func (opts Options) fs() FS {
+	if opts.FS == nil {
+		return OSFS
+	}
+	return opts.FS
+}
@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package file_handler
+
+import (
+	"io"
+	"io/fs"
+)
+
+// Lock fails with ErrLockUnsupported: files cannot be locked on this platform,
+// and a Wal without the lock could write to the same folder as another one.
+func (osFS) Lock(name string, perm fs.FileMode) (io.Closer, error) {
+	return nil, ErrLockUnsupported
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package file_handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// Lock takes an exclusive advisory lock (flock) on a file, so a single Wal at a time,
+// in this or any other process, holds it. The OS releases it if the process dies.
+func (osFS) Lock(name string, perm fs.FileMode) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("failed to lock WAL folder: %w", err)
+	}
+	return flockFile{file}, nil
+}
+
+// flockFile is a file locked with flock, unlocked when closed.
+type flockFile struct {
+	*os.File
+}
+
+func (f flockFile) Close() error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	closeErr := f.File.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+//go:build windows
+
+package file_handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// Lock takes an exclusive lock (LockFileEx) on the first byte of a file, so a single Wal at a time,
+// in this or any other process, holds it. The OS releases it if the process dies.
+func (osFS) Lock(name string, perm fs.FileMode) (io.Closer, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	var overlapped syscall.Overlapped
+	r, _, err := procLockFileEx.Call(file.Fd(), lockfileExclusiveLock|lockfileFailImmediately,
+		0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		file.Close()
+		if errors.Is(err, errorLockViolation) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("failed to lock WAL folder: %w", err)
+	}
+	return lockFileExFile{file}, nil
+}
+
+// lockFileExFile is a file locked with LockFileEx, unlocked when closed.
+type lockFileExFile struct {
+	*os.File
+}
+
+func (f lockFileExFile) Close() error {
+	var overlapped syscall.Overlapped
+	var err error
+	r, _, callErr := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		err = callErr
+	}
+	closeErr := f.File.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
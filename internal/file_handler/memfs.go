@@ -0,0 +1,419 @@
+package file_handler
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memFS is a FS keeping every file in memory, e.g. for tests or to run a WAL without a disk.
+// Everything written is immediately "durable": syncing does nothing but check the file is open.
+// Open files keep working after being renamed or removed, like on POSIX systems.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode // Regular files by clean path
+	dirs  map[string]bool     // Directories by clean path
+	locks map[string]bool     // Files locked with Lock
+}
+
+// memNode is the content of a file of a memFS, shared by every File opened on it.
+type memNode struct {
+	data    []byte
+	perm    fs.FileMode
+	modTime time.Time
+}
+
+// NewMemFS() creates an empty FS stored in memory. Its root directory always exists.
+//
+// Returns:
+//   - The new FS.
+func NewMemFS() FS {
+	return &memFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]bool{"/": true, ".": true},
+		locks: make(map[string]bool),
+	}
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	node, exists := m.files[name]
+	switch {
+	case m.dirs[name]:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !exists && !m.dirs[path.Dir(name)]:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if !exists {
+		node = &memNode{perm: perm.Perm(), modTime: time.Now()}
+		m.files[name] = node
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{fs: m, name: name, node: node, flag: flag}, nil
+}
+
+func (m *memFS) MkdirAll(dir string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir = path.Clean(dir); !m.dirs[dir]; dir = path.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	for p := range m.files {
+		if path.Dir(p) == name {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	for p := range m.dirs {
+		if p != name && path.Dir(p) == name {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = path.Clean(oldpath), path.Clean(newpath)
+	node, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if m.dirs[newpath] || !m.dirs[path.Dir(newpath)] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = node
+	return nil
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	if !m.dirs[name] {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	var entries []fs.DirEntry
+	for p, node := range m.files {
+		if path.Dir(p) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(node.info(path.Base(p))))
+		}
+	}
+	for p := range m.dirs {
+		if p != name && path.Dir(p) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memDirInfo(path.Base(p))))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	if node, ok := m.files[name]; ok {
+		return node.info(path.Base(name)), nil
+	}
+	if m.dirs[name] {
+		return memDirInfo(path.Base(name)), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (m *memFS) SyncDir(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	if !m.dirs[name] {
+		return &fs.PathError{Op: "sync", Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+func (m *memFS) Lock(name string, perm fs.FileMode) (io.Closer, error) {
+	file, err := m.OpenFile(name, os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = path.Clean(name)
+	if m.locks[name] {
+		return nil, ErrLocked
+	}
+	m.locks[name] = true
+	return &memLock{fs: m, name: name}, nil
+}
+
+// info() returns the FileInfo of the node, named name. The caller must hold the lock of the memFS.
+func (n *memNode) info(name string) fs.FileInfo {
+	return memFileInfo{name: name, size: int64(len(n.data)), mode: n.perm, modTime: n.modTime}
+}
+
+// memDirInfo() returns the FileInfo of a directory of a memFS.
+func memDirInfo(name string) fs.FileInfo {
+	return memFileInfo{name: name, mode: fs.ModeDir | 0755}
+}
+
+// memLock is a lock taken by memFS.Lock.
+type memLock struct {
+	fs       *memFS
+	name     string
+	released bool
+}
+
+func (l *memLock) Close() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+
+	if l.released {
+		return fs.ErrClosed
+	}
+	l.released = true
+	delete(l.fs.locks, l.name)
+	return nil
+}
+
+// memFile is a File opened on a memFS.
+type memFile struct {
+	fs     *memFS
+	name   string // Path it was opened with
+	node   *memNode
+	flag   int
+	offset int64
+	closed bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if off < 0 {
+		return 0, f.error("readat", fs.ErrInvalid)
+	}
+	n, err := f.readAt(p, off)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// readAt() reads from the given offset. The caller must hold the lock of the memFS.
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.error("read", fs.ErrClosed)
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, f.error("read", fs.ErrPermission)
+	}
+	if off >= int64(len(f.node.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	return copy(p, f.node.data[off:]), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.node.data))
+	}
+	n, err := f.writeAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		return 0, f.error("writeat", errors.New("file opened with O_APPEND"))
+	}
+	if off < 0 {
+		return 0, f.error("writeat", fs.ErrInvalid)
+	}
+	return f.writeAt(p, off)
+}
+
+// writeAt() writes at the given offset, growing the file if needed.
+// The caller must hold the lock of the memFS.
+func (f *memFile) writeAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, f.error("write", fs.ErrClosed)
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, f.error("write", fs.ErrPermission)
+	}
+
+	end := off + int64(len(p))
+	if end > int64(len(f.node.data)) {
+		f.node.resize(end)
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, f.error("seek", fs.ErrClosed)
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, f.error("seek", fs.ErrInvalid)
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return nil, f.error("stat", fs.ErrClosed)
+	}
+	return f.node.info(path.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return f.error("sync", fs.ErrClosed)
+	}
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return f.error("truncate", fs.ErrClosed)
+	}
+	if size < 0 {
+		return f.error("truncate", fs.ErrInvalid)
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f.error("truncate", fs.ErrPermission)
+	}
+	f.node.resize(size)
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return f.error("close", fs.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+// error() wraps err in a *fs.PathError for the file.
+func (f *memFile) error(op string, err error) error {
+	return &fs.PathError{Op: op, Path: f.name, Err: err}
+}
+
+// resize() grows the content of the node with zeros, or shrinks it, to the given size.
+func (n *memNode) resize(size int64) {
+	if size <= int64(len(n.data)) {
+		n.data = n.data[:size]
+		return
+	}
+	n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+}
+
+// memFileInfo is the FileInfo of a file or directory of a memFS.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memFileInfo) Sys() any           { return nil }
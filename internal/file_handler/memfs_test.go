@@ -0,0 +1,208 @@
+package file_handler
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+// memOptions returns Options storing the WAL directory in a new memFS.
+func memOptions() Options {
+	return Options{
+		DirName:         "/wal",
+		DirPerms:        0755,
+		FilePerms:       0644,
+		FS:              NewMemFS(),
+		createFileFlags: os.O_CREATE | os.O_RDWR,
+	}
+}
+
+func TestMemFSFile(t *testing.T) {
+	memFS := NewMemFS()
+
+	// The parent directory must exist
+	_, err := memFS.OpenFile("/wal/file", os.O_CREATE|os.O_RDWR, 0644)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected fs.ErrNotExist, got %v", err)
+	}
+	err = memFS.MkdirAll("/wal", 0755)
+	if err != nil {
+		t.Fatalf("MkdirAll() failed: %v", err)
+	}
+
+	file, err := memFS.OpenFile("/wal/file", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	_, err = file.Write([]byte("Hello World!"))
+	if err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	_, err = file.WriteAt([]byte("Bye"), 14)
+	if err != nil {
+		t.Fatalf("WriteAt() failed: %v", err)
+	}
+
+	// Writing past the end fills the gap with zeros
+	data := make([]byte, 17)
+	n, err := file.ReadAt(data, 0)
+	if err != nil || n != 17 {
+		t.Fatalf("Expected to read 17 bytes, got %d, %v", n, err)
+	}
+	if string(data) != "Hello World!\x00\x00Bye" {
+		t.Errorf("Expected %q, got %q", "Hello World!\x00\x00Bye", data)
+	}
+
+	err = file.Truncate(5)
+	if err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatalf("Seek() failed: %v", err)
+	}
+	data, err = io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("ReadAll() failed: %v", err)
+	}
+	if string(data) != "Hello" {
+		t.Errorf("Expected %q, got %q", "Hello", data)
+	}
+
+	// O_EXCL fails on existing files
+	_, err = memFS.OpenFile("/wal/file", os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected fs.ErrExist, got %v", err)
+	}
+
+	// Read-only files cannot be written
+	readOnly, err := memFS.OpenFile("/wal/file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile() failed: %v", err)
+	}
+	_, err = readOnly.Write([]byte("Hello"))
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected fs.ErrPermission, got %v", err)
+	}
+	readOnly.Close()
+
+	// Open files keep working once renamed, like on disk
+	err = memFS.Rename("/wal/file", "/wal/renamed")
+	if err != nil {
+		t.Fatalf("Rename() failed: %v", err)
+	}
+	_, err = file.Write([]byte("!"))
+	if err != nil {
+		t.Fatalf("Write() failed after Rename(): %v", err)
+	}
+	info, err := memFS.Stat("/wal/renamed")
+	if err != nil {
+		t.Fatalf("Stat() failed: %v", err)
+	}
+	if info.Size() != 6 {
+		t.Errorf("Expected size 6, got %d", info.Size())
+	}
+	if _, err = memFS.Stat("/wal/file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if _, err = file.Write([]byte("!")); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Expected fs.ErrClosed, got %v", err)
+	}
+	if err = file.Sync(); !errors.Is(err, fs.ErrClosed) {
+		t.Errorf("Expected fs.ErrClosed, got %v", err)
+	}
+}
+
+func TestMemFSWalFiles(t *testing.T) {
+	opts := memOptions()
+
+	walFile, err := OpenWal(&opts, 1)
+	if err != nil {
+		t.Fatalf("OpenWal() failed: %v", err)
+	}
+	walFile.Close()
+	for _, lsn := range []uint64{42, 42} {
+		file, err := CreateWalNewFile(opts, lsn)
+		if err != nil {
+			t.Fatalf("CreateWalNewFile() failed: %v", err)
+		}
+		file.Close()
+	}
+
+	paths, err := ListWalFiles(opts)
+	if err != nil {
+		t.Fatalf("ListWalFiles() failed: %v", err)
+	}
+	expected := []string{
+		"/wal/wal_0000000000000001.log",
+		"/wal/wal_000000000000002a.log",
+		"/wal/wal_000000000000002a_1.log",
+	}
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected %d WAL files, got %v", len(expected), paths)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], paths[i])
+		}
+	}
+
+	err = RemoveWalFile(opts, paths[0])
+	if err != nil {
+		t.Fatalf("RemoveWalFile() failed: %v", err)
+	}
+	if _, err = StatFile(opts, paths[0]); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected fs.ErrNotExist, got %v", err)
+	}
+
+	err = WriteFileAtomic(opts, "meta", []byte("content"))
+	if err != nil {
+		t.Fatalf("WriteFileAtomic() failed: %v", err)
+	}
+	data, err := ReadFile(opts, "meta")
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	if string(data) != "content" {
+		t.Errorf("Expected content %q, got %q", "content", data)
+	}
+
+	// Nothing was written to disk
+	if _, err = os.Stat("/wal"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected /wal not to exist on disk, got %v", err)
+	}
+}
+
+func TestMemFSLock(t *testing.T) {
+	opts := memOptions()
+	err := CreateWalFolder(opts)
+	if err != nil {
+		t.Fatalf("CreateWalFolder() failed: %v", err)
+	}
+
+	lock, err := LockDir(opts)
+	if err != nil {
+		t.Fatalf("LockDir() failed: %v", err)
+	}
+	_, err = LockDir(opts)
+	if err != ErrLocked {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+
+	err = UnlockDir(lock)
+	if err != nil {
+		t.Fatalf("UnlockDir() failed: %v", err)
+	}
+	lock, err = LockDir(opts)
+	if err != nil {
+		t.Fatalf("LockDir() failed after UnlockDir(): %v", err)
+	}
+	UnlockDir(lock)
+}
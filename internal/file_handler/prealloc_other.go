@@ -0,0 +1,16 @@
+//go:build !linux
+
+package file_handler
+
+// Preallocate() extends a file up to the given size. fallocate is not available on this platform,
+// so the space added may not be reserved, but it reads as zeros.
+//
+// Parameters:
+//   - file: The file to be preallocated.
+//   - size: The size the file must have at least.
+//
+// Returns:
+//   - An error if the file cannot be extended.
+func Preallocate(file File, size int64) error {
+	return extendFile(file, size)
+}
@@ -0,0 +1,228 @@
+// Package record encodes and decodes the records stored in the WAL files.
+//
+// Version 0 (legacy) files have no header and are a sequence of records:
+//
+//	LSN (4 bytes) | data length (4 bytes) | data | CRC (4 bytes)
+//
+// Version 1 files start with an 8 bytes header:
+//
+//	magic "WLRG" (4 bytes) | format version (4 bytes)
+//
+// followed by a sequence of records:
+//
+//	LSN (8 bytes) | data length (4 bytes) | record type (1 byte) | data | CRC (4 bytes)
+//
+// An entry bigger than the buffer is split in several records with the same LSN: a first
+// fragment, any number of middle fragments and a last fragment, which may span segments.
+// The highest bit of the record type is the batch flag: it is set on every record of a batch
+// but the ones of its last entry, so a batch is only complete once a record without the flag is read.
+//
+// Space never written, e.g. preallocated, reads as zeros: in version 1 files, a record header
+// of zeros marks the end of the records, like the end of the file does.
+//
+// All integers are little-endian, and the CRC covers every field of the record before it.
+// New files are always written with the latest version, legacy files can still be decoded.
+//
+// The decoder never trusts the length stored in a record: records longer than MaxRecordSize
+// are rejected before allocating anything, and a record cut short by the end of the file
+// (io.ErrUnexpectedEOF) is told apart from one whose content is invalid (ErrCorrupt).
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	utils "github.com/casteloig/walrog/internal/utils"
+)
+
+const (
+	FormatVersionLegacy = 0
+	FormatVersion1      = 1
+	FormatVersionLatest = FormatVersion1
+
+	SegmentHeaderSize = 8
+	LegacyHeaderSize  = 8  // LSN and data length of a legacy record
+	HeaderSize        = 13 // LSN, data length and record type
+	CRCSize           = 4
+
+	// MaxRecordSize is the size of the biggest record that can be decoded, header and CRC included.
+	// Entries are split in fragments no bigger than this, whatever the size of the buffer.
+	MaxRecordSize = 64 << 20 // 64Mb
+)
+
+// Record types of format version 1.
+const (
+	TypeZero   byte = 0 // Never written: found in zeroed space
+	TypeFull   byte = 1 // The record holds a whole entry
+	TypeFirst  byte = 2 // The record holds the first fragment of an entry
+	TypeMiddle byte = 3 // The record holds a fragment in the middle of an entry
+	TypeLast   byte = 4 // The record holds the last fragment of an entry
+
+	FlagBatch byte = 0x80 // More records of the same batch follow this one
+)
+
+var segmentMagic = []byte("WLRG")
+
+// ErrCorrupt is returned when a record or a segment header is invalid: a CRC mismatch,
+// an unknown record type or a length that cannot be right. A record cut short by the end
+// of the file is not corrupt, io.ErrUnexpectedEOF is returned instead.
+var ErrCorrupt = errors.New("corrupted record")
+
+// ErrUnknownVersion is returned for segments written with a format version this package does not know.
+var ErrUnknownVersion = errors.New("unknown format version")
+
+// Record is a record decoded from a WAL file.
+type Record struct {
+	LSN            uint64
+	Type           byte // Record type without flags. Always TypeFull in legacy files
+	BatchContinues bool // The batch flag is set
+	Data           []byte
+}
+
+// SegmentHeader returns the header every WAL file of the latest format version starts with.
+func SegmentHeader() []byte {
+	return utils.AppendBytesToSlice(append([]byte{}, segmentMagic...), utils.Uint32ToBytes(FormatVersionLatest))
+}
+
+// ReadSegmentHeader reads the header at the beginning of a WAL file and returns its format version.
+// Files not starting with the magic bytes are legacy files, and nothing is consumed from them.
+//
+// Parameters:
+//   - reader: A bufio.Reader positioned at the beginning of the WAL file.
+//
+// Returns:
+//   - The format version of the file.
+//   - The size of the header consumed from the reader.
+//   - io.ErrUnexpectedEOF if the header is torn, ErrUnknownVersion, or an error if it cannot be read.
+func ReadSegmentHeader(reader *bufio.Reader) (int, int, error) {
+	header, err := reader.Peek(SegmentHeaderSize)
+	if err != nil {
+		if err != io.EOF {
+			return 0, 0, fmt.Errorf("error reading segment header: %w", err)
+		}
+		// A file shorter than a header, the magic bytes mean the header write was interrupted
+		if len(header) > 0 && bytes.HasPrefix(segmentMagic, header[:min(len(header), len(segmentMagic))]) {
+			return 0, 0, fmt.Errorf("error reading segment header: %w", io.ErrUnexpectedEOF)
+		}
+		return FormatVersionLegacy, 0, nil
+	}
+
+	if !bytes.Equal(header[:len(segmentMagic)], segmentMagic) {
+		return FormatVersionLegacy, 0, nil
+	}
+
+	version := utils.BytesToUint32(header[len(segmentMagic):])
+	if version != FormatVersion1 {
+		return 0, 0, fmt.Errorf("%w %d", ErrUnknownVersion, version)
+	}
+
+	_, err = reader.Discard(SegmentHeaderSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading segment header: %w", err)
+	}
+	return int(version), SegmentHeaderSize, nil
+}
+
+// Encode builds a record of the latest format version, ready to be written to a WAL file.
+//
+// Parameters:
+//   - lsn: The LSN of the entry.
+//   - recordType: The record type, including its flags.
+//   - data: A slice of bytes with the entry data.
+//
+// Returns:
+//   - A slice of bytes holding the whole record.
+//   - An error if the record would be bigger than MaxRecordSize.
+func Encode(lsn uint64, recordType byte, data []byte) ([]byte, error) {
+	if HeaderSize+len(data)+CRCSize > MaxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes is bigger than the max record size", HeaderSize+len(data)+CRCSize)
+	}
+
+	record := make([]byte, 0, HeaderSize+len(data)+CRCSize)
+	record = append(record, utils.Uint64ToBytes(lsn)...)
+	record = append(record, utils.Uint32ToBytes(uint32(len(data)))...)
+	record = append(record, recordType)
+	record = append(record, data...)
+
+	// The CRC covers everything before it
+	crc := utils.CalculateCRC(record)
+	return append(record, utils.Uint32ToBytes(crc)...), nil
+}
+
+// Decode reads the next record of a WAL file and validates its integrity using CRC.
+// Every field is read whole, so short reads of the underlying reader are not an issue.
+// Fragments are returned as they are, joining them back is up to the caller.
+//
+// Parameters:
+//   - reader: A reader positioned at the beginning of a record.
+//   - version: The format version of the WAL file.
+//
+// Returns:
+//   - The record decoded.
+//   - The size of the record in the file.
+//   - io.EOF if there are no more records, because the file or its zeroed space is reached, an error
+//     wrapping io.ErrUnexpectedEOF if the record is torn, one wrapping ErrCorrupt if it is invalid,
+//     or any error of the reader.
+func Decode(reader io.Reader, version int) (Record, int, error) {
+	headerSize := HeaderSize
+	if version == FormatVersionLegacy {
+		headerSize = LegacyHeaderSize
+	}
+
+	// Read LSN, data length and record type
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		if err == io.EOF {
+			return Record{}, 0, io.EOF
+		}
+		return Record{}, 0, fmt.Errorf("error reading record header: %w", err)
+	}
+
+	record := Record{Type: TypeFull}
+	var dataLength uint32
+	if version == FormatVersionLegacy {
+		record.LSN = uint64(utils.BytesToUint32(header[0:4]))
+		dataLength = utils.BytesToUint32(header[4:8])
+	} else {
+		if bytes.Count(header, []byte{0}) == len(header) {
+			return Record{}, 0, io.EOF
+		}
+		record.LSN = utils.BytesToUint64(header[0:8])
+		dataLength = utils.BytesToUint32(header[8:12])
+		record.Type = header[12] &^ FlagBatch
+		record.BatchContinues = header[12]&FlagBatch != 0
+		if record.Type < TypeFull || record.Type > TypeLast {
+			return Record{}, 0, fmt.Errorf("%w: unknown record type %d", ErrCorrupt, header[12])
+		}
+	}
+
+	// Check the length before allocating anything for the data
+	size := int64(headerSize) + int64(dataLength) + CRCSize
+	if size > MaxRecordSize {
+		return Record{}, 0, fmt.Errorf("%w: length of %d bytes is bigger than the max record size", ErrCorrupt, dataLength)
+	}
+
+	// Read data and CRC
+	body := make([]byte, int(dataLength)+CRCSize)
+	_, err = io.ReadFull(reader, body)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, 0, fmt.Errorf("error reading record data: %w", err)
+	}
+	record.Data = body[:dataLength]
+	crcData := utils.BytesToUint32(body[dataLength:])
+
+	// Compare CRC of the header and data with the stored one
+	calculatedCRC := utils.CalculateCRC(utils.AppendBytesToSlice(header, record.Data))
+	if crcData != calculatedCRC {
+		return Record{}, 0, fmt.Errorf("%w: CRC mismatch: read %v, calculated %v", ErrCorrupt, crcData, calculatedCRC)
+	}
+
+	return record, int(size), nil
+}
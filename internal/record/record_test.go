@@ -0,0 +1,162 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReadSegmentHeader(t *testing.T) {
+	testCases := []struct {
+		name            string
+		content         []byte
+		expectedVersion int
+		expectedSize    int
+		expectedError   bool
+	}{
+		{
+			name:            "Version 1 header",
+			content:         []byte{87, 76, 82, 71, 1, 0, 0, 0, 1, 2, 3},
+			expectedVersion: FormatVersion1,
+			expectedSize:    SegmentHeaderSize,
+		},
+		{
+			name:            "Legacy file",
+			content:         []byte{1, 0, 0, 0, 3, 0, 0, 0, 1, 2, 3, 190, 45, 28, 49},
+			expectedVersion: FormatVersionLegacy,
+			expectedSize:    0,
+		},
+		{
+			name:            "Empty file",
+			content:         []byte{},
+			expectedVersion: FormatVersionLegacy,
+			expectedSize:    0,
+		},
+		{
+			name:          "Torn header",
+			content:       []byte{87, 76, 82},
+			expectedError: true,
+		},
+		{
+			name:          "Unknown version",
+			content:       []byte{87, 76, 82, 71, 9, 0, 0, 0},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(tc.content))
+
+			version, size, err := ReadSegmentHeader(reader)
+			if tc.expectedError {
+				if err == nil {
+					t.Errorf("expected an error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, but got %v", err)
+			}
+			if version != tc.expectedVersion || size != tc.expectedSize {
+				t.Errorf("expected version %d and size %d, got %d and %d", tc.expectedVersion, tc.expectedSize, version, size)
+			}
+
+			// Only the header is consumed
+			rest, _ := io.ReadAll(reader)
+			if !bytes.Equal(rest, tc.content[size:]) {
+				t.Errorf("expected %v left in reader, got %v", tc.content[size:], rest)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	record, err := Encode(1<<40, TypeLast|FlagBatch, []byte("Hello World!"))
+	if err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+
+	// Short reads do not break the framing
+	decoded, size, err := Decode(iotest.OneByteReader(bytes.NewReader(record)), FormatVersion1)
+	if err != nil {
+		t.Fatalf("Decode() failed: %v", err)
+	}
+	if decoded.LSN != 1<<40 || decoded.Type != TypeLast || !decoded.BatchContinues || size != len(record) {
+		t.Errorf("unexpected record %+v of size %d", decoded, size)
+	}
+	if !bytes.Equal(decoded.Data, []byte("Hello World!")) {
+		t.Errorf("expected data %q, got %q", "Hello World!", decoded.Data)
+	}
+
+	// A record cut anywhere is torn, not corrupted
+	for cut := 1; cut < len(record); cut++ {
+		_, _, err := Decode(bytes.NewReader(record[:cut]), FormatVersion1)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("expected io.ErrUnexpectedEOF with %d bytes, got %v", cut, err)
+		}
+	}
+
+	_, _, err = Decode(bytes.NewReader(nil), FormatVersion1)
+	if err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	// Zeroed space ends the records like the end of the file
+	_, _, err = Decode(bytes.NewReader(make([]byte, 64)), FormatVersion1)
+	if err != io.EOF {
+		t.Errorf("expected io.EOF on zeroed space, got %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		offset int
+		value  byte
+	}{
+		{"CRC mismatch", len(record) - 1, 0},
+		{"Unknown record type", 12, 42},
+		{"Zeroed record type", 12, TypeZero},
+		// A length of 4Gb is rejected before allocating it
+		{"Length too big", 11, 0xff},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			corrupted := append([]byte{}, record...)
+			corrupted[tc.offset] = tc.value
+			_, _, err := Decode(bytes.NewReader(corrupted), FormatVersion1)
+			if !errors.Is(err, ErrCorrupt) {
+				t.Errorf("expected ErrCorrupt, got %v", err)
+			}
+		})
+	}
+
+	// Legacy records are still readable
+	legacy := []byte{1, 0, 0, 0, 3, 0, 0, 0, 1, 2, 3, 190, 45, 28, 49}
+	decoded, size, err = Decode(bytes.NewReader(legacy), FormatVersionLegacy)
+	if err != nil {
+		t.Fatalf("Decode() failed on legacy record: %v", err)
+	}
+	if decoded.LSN != 1 || decoded.Type != TypeFull || !bytes.Equal(decoded.Data, []byte{1, 2, 3}) || size != len(legacy) {
+		t.Errorf("unexpected legacy record %+v of size %d", decoded, size)
+	}
+}
+
+func TestEncodeMaxRecordSize(t *testing.T) {
+	data := make([]byte, MaxRecordSize-HeaderSize-CRCSize)
+	record, err := Encode(1, TypeFull, data)
+	if err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+	if len(record) != MaxRecordSize {
+		t.Errorf("expected a record of %d bytes, got %d", MaxRecordSize, len(record))
+	}
+
+	_, err = Encode(1, TypeFull, append(data, 0))
+	if err == nil {
+		t.Errorf("expected an error encoding a record bigger than MaxRecordSize")
+	}
+}
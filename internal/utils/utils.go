@@ -58,6 +58,30 @@ func BytesToUint32(i []byte) uint32 {
 	return binary.LittleEndian.Uint32(i)
 }
 
+// Uint64ToBytes takes a uint64 value and returns its conversion to a byte slice.
+//
+// Parameters:
+//   - i: A uint64 value to be converted to a byte slice.
+//
+// Returns:
+//   - A slice of 8 bytes representing the uint64 value in little-endian format.
+func Uint64ToBytes(i uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, i)
+	return buf
+}
+
+// BytesToUint64 takes a slice of bytes and returns its conversion to uint64.
+//
+// Parameters:
+//   - i: A slice of 8 bytes to be converted to a uint64 value.
+//
+// Returns:
+//   - A uint64 value represented by the byte slice in little-endian format.
+func BytesToUint64(i []byte) uint64 {
+	return binary.LittleEndian.Uint64(i)
+}
+
 // AppendBytesToSlice takes a slice of bytes as the first argument and another slice of bytes as the second argument.
 // It returns a single slice with the second argument appended to the first.
 //
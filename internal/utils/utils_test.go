@@ -108,6 +108,77 @@ func TestBytesToUint32(t *testing.T) {
 	}
 }
 
+func TestUint64ToBytes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    uint64
+		expected []byte
+	}{
+		{
+			name:     "Zero",
+			input:    0,
+			expected: []byte{0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:     "One",
+			input:    1,
+			expected: []byte{1, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:     "MaxUint64",
+			input:    18446744073709551615,
+			expected: []byte{255, 255, 255, 255, 255, 255, 255, 255},
+		},
+		{
+			name:     "Arbitrary number",
+			input:    1311768467463790320, // 0x123456789ABCDEF0
+			expected: []byte{240, 222, 188, 154, 120, 86, 52, 18},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := Uint64ToBytes(tc.input)
+			if !bytes.Equal(result, tc.expected) {
+				t.Errorf("Uint64ToBytes(%d) = %v; want %v", tc.input, result, tc.expected)
+			}
+		})
+	}
+}
+
+func TestBytesToUint64(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    []byte
+		expected uint64
+	}{
+		{
+			name:     "Zero",
+			input:    []byte{0, 0, 0, 0, 0, 0, 0, 0},
+			expected: 0,
+		},
+		{
+			name:     "Above MaxUint32",
+			input:    []byte{0, 0, 0, 0, 1, 0, 0, 0},
+			expected: 4294967296,
+		},
+		{
+			name:     "Arbitrary number",
+			input:    []byte{240, 222, 188, 154, 120, 86, 52, 18},
+			expected: 1311768467463790320, // 0x123456789ABCDEF0
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := BytesToUint64(tc.input)
+			if result != tc.expected {
+				t.Errorf("BytesToUint64(%d) = %v; want %v", tc.input, result, tc.expected)
+			}
+		})
+	}
+}
+
 func TestCalculateCRConBytes(t *testing.T) {
 	testCases := []struct {
 		name     string
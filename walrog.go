@@ -0,0 +1,628 @@
+package walrog
+
+import (
+	"context"
+	"io/fs"
+	"time"
+
+	"github.com/casteloig/walrog/internal/core"
+	fh "github.com/casteloig/walrog/internal/file_handler"
+)
+
+// Options defines the configuration of a Wal.
+// Fields:
+//   - DirName: The directory where the WAL files are stored.
+//   - DirPerms: The permissions to set for the WAL directory.
+//   - FilePerms: The permissions to set for the WAL files.
+//   - BufferSize: Size of the in-memory buffer, in bytes. Records that do not fit in it are
+//     split in fragments, so it does not limit the size of a record.
+//   - SegmentSize: Max size of a WAL file, in bytes. Must be multiple of BufferSize.
+//   - OnRotate: Optional function called every time the WAL moves to a new file.
+//     It runs while the Wal is locked, so it must not call any method of the Wal.
+//   - SyncMode: When the records written are synced to disk. See SyncMode.
+//   - SyncInterval: Max time between syncs with SyncInterval.
+//   - RecoveryMode: What recovery does with torn or corrupted records. See RecoveryMode.
+//   - OnCorruption: Optional function called for every part of a WAL file dropped by recovery.
+//   - ReadOnly: Open neither locks nor modifies the WAL directory, and every write returns ErrReadOnly.
+//   - FS: The filesystem where the WAL directory is stored. nil stores it on disk, and NewMemFS
+//     keeps it in memory. The WAL directory can only be shared by Wals using the same FS.
+//   - Preallocate: New WAL files take SegmentSize bytes on disk from the start (fallocate on Linux),
+//     so appending to them neither runs out of space nor grows the file on every sync.
+//   - RecycleSegments: Max number of WAL files deleted by Truncate kept to be reused as new
+//     WAL files, overwriting them instead of allocating new ones. 0 deletes them.
+//     A Reader still reading a recycled file may find it overwritten.
+//   - Retention: Limits of the old WAL files kept. The zero value keeps them until Truncate.
+//   - OnRetentionError: Optional function called when the WAL files cannot be discarded after a rotation,
+//     which does not fail the Write. It runs while the Wal is locked, so it must not call any method of the Wal.
+type Options struct {
+	DirName          string
+	DirPerms         fs.FileMode
+	FilePerms        fs.FileMode
+	BufferSize       uint32
+	SegmentSize      uint32
+	OnRotate         func(RotationEvent)
+	SyncMode         SyncMode
+	SyncInterval     time.Duration
+	RecoveryMode     RecoveryMode
+	OnCorruption     func(Corruption)
+	ReadOnly         bool
+	FS               FS
+	Preallocate      bool
+	RecycleSegments  int
+	Retention        RetentionPolicy
+	OnRetentionError func(error)
+}
+
+// FS is a filesystem where the WAL directory can be stored. Its methods behave like
+// the functions of the os package with the same name.
+type FS = fh.FS
+
+// File is a file opened from a FS. *os.File implements it.
+type File = fh.File
+
+// OSFS stores the WAL directory on disk. It is used when Options.FS is nil.
+var OSFS = fh.OSFS
+
+// NewMemFS creates an empty filesystem stored in memory, e.g. to run a WAL in tests
+// without touching the disk. Everything written to it is lost when the process exits.
+//
+// Returns:
+//   - The new FS.
+func NewMemFS() FS {
+	return fh.NewMemFS()
+}
+
+// SyncMode defines when the records written are synced to disk (using fdatasync where available).
+// Records flushed but not synced survive a crash of the process, but may be lost on power loss.
+// Close always syncs, whatever the mode. If a sync fails, the records not synced yet may be lost
+// even if a later sync succeeds, so every later write, flush or sync returns the error,
+// until the Wal is closed and opened again.
+type SyncMode = core.SyncMode
+
+const (
+	// SyncOnFlush syncs every time the buffer is flushed, by Flush or because it is full.
+	// Records are durable once Flush returns. This is the default.
+	SyncOnFlush = core.SyncOnFlush
+	// SyncOnWrite flushes and syncs on every Write. Records are durable once Write returns.
+	SyncOnWrite = core.SyncOnWrite
+	// SyncInterval flushes and syncs at most every Options.SyncInterval.
+	// The interval is checked on every Write and Flush, and in the background while nothing is written.
+	SyncInterval = core.SyncInterval
+	// SyncNever leaves syncing to the OS.
+	SyncNever = core.SyncNever
+)
+
+// RecoveryMode defines what recovery does when it finds a torn or corrupted record,
+// both when reading the WAL and when Open resumes appending to it.
+type RecoveryMode = core.RecoveryMode
+
+const (
+	// RecoverTruncateTail drops everything from the first invalid record of the last file,
+	// which is what a crash in the middle of a write leaves behind, and Open truncates it.
+	// An invalid record in any other file is an error. This is the default.
+	RecoverTruncateTail = core.RecoverTruncateTail
+	// RecoverStop stops at the first invalid record, whatever the file: every record after it
+	// is dropped, and Open truncates the WAL there.
+	RecoverStop = core.RecoverStop
+	// RecoverSkip skips invalid records and continues with the next valid one.
+	RecoverSkip = core.RecoverSkip
+	// RecoverFail fails on any invalid record, even a torn tail left by a crash.
+	RecoverFail = core.RecoverFail
+)
+
+// Corruption describes a part of a WAL file dropped by recovery.
+type Corruption struct {
+	Segment string // Name of the WAL file
+	Offset  int64  // Offset where the dropped bytes start
+	Size    int64  // Number of bytes dropped
+	Err     error  // Why they were dropped
+}
+
+// RotationEvent describes the move of the WAL to a new file once the previous one is full.
+// The previous file has been synced to disk and closed when the event is emitted.
+type RotationEvent struct {
+	PreviousFile string // Path of the file that was closed
+	NewFile      string // Path of the file records are written to from now on
+	FirstLSN     uint64 // LSN of the first record that will be written to the new file
+}
+
+// RetentionPolicy bounds the old WAL files kept. Once a limit is exceeded, the oldest files are
+// discarded with Truncate after every rotation, or when calling Wal.EnforceRetention.
+// A zero field sets no limit. Errors after a rotation go to Options.OnRetentionError.
+// The records after the last checkpoint are never discarded, so nothing is until the first one,
+// nor are the files a Reader created with NewTailReader has not read yet. The current file is always kept.
+type RetentionPolicy struct {
+	MaxBytes    int64         // Max size of the WAL files, in bytes
+	MaxAge      time.Duration // Max time since a WAL file was last written
+	MaxSegments int           // Max number of WAL files
+}
+
+// DefaultOptions provides the default configuration of a Wal.
+// Copy it and change the fields needed instead of modifying it.
+var DefaultOptions = &Options{
+	DirName:     fh.DefaultOptions.DirName,
+	DirPerms:    fh.DefaultOptions.DirPerms,
+	FilePerms:   fh.DefaultOptions.FilePerms,
+	BufferSize:  core.DefaultWalOptions.BufferSize,
+	SegmentSize: core.DefaultWalOptions.SegmentSize,
+	SyncMode:    core.DefaultWalOptions.SyncMode,
+}
+
+// ErrClosed is returned when using a Wal after calling Close.
+var ErrClosed = core.ErrClosed
+
+// ErrLocked is returned by Open when another Wal, in this or another process,
+// is writing to the same WAL directory.
+var ErrLocked = core.ErrLocked
+
+// ErrLockUnsupported is returned by Open on platforms where the WAL directory cannot be locked,
+// unless Options.ReadOnly is set.
+var ErrLockUnsupported = core.ErrLockUnsupported
+
+// ErrReadOnly is returned when writing to a Wal opened with Options.ReadOnly.
+var ErrReadOnly = core.ErrReadOnly
+
+// Entry is a record read back from the WAL.
+type Entry struct {
+	LSN  uint64
+	Data []byte
+}
+
+// Checkpoint marks the LSN up to which the records are already reflected elsewhere, e.g. in a snapshot.
+type Checkpoint struct {
+	LSN      uint64 // LSN of the last record covered by the checkpoint
+	Metadata []byte // Data stored along the checkpoint with Wal.Checkpoint
+}
+
+// Wal is a Write-Ahead Log opened with Open.
+// It is safe for concurrent use by multiple goroutines: records are written whole,
+// and LSNs follow the order in which concurrent writes are applied.
+type Wal struct {
+	wal *core.Wal
+}
+
+// Open opens the WAL stored in the directory given by the options, creating it if needed.
+// Existing records are kept: appending resumes after the last valid record, and a torn
+// record left at the tail by a crash is discarded. Only the records after the last checkpoint
+// are scanned to find them.
+// The WAL directory is locked until Close, so a single Wal at a time can write to it.
+// With Options.ReadOnly, the directory is neither locked nor modified.
+// If a nil argument is passed, it will use DefaultOptions.
+//
+// Parameters:
+//   - opts: A pointer to Options containing the configuration for the WAL.
+//
+// Returns:
+//   - A pointer to the opened Wal.
+//   - ErrLocked if another Wal is writing to the WAL directory, or an error if the WAL cannot be opened.
+func Open(opts *Options) (*Wal, error) {
+	w, err := core.OpenWal(opts.toCore())
+	if err != nil {
+		return nil, err
+	}
+	return &Wal{wal: w}, nil
+}
+
+// Write appends a record to the WAL.
+// The record is buffered and may not be on disk until Flush or Close is called,
+// unless Options.SyncMode says otherwise.
+//
+// Parameters:
+//   - data: A slice of bytes to be written to the WAL.
+//
+// Returns:
+//   - The LSN assigned to the record. LSNs start at 1 and increase by one on every record.
+//   - An error if the write operation fails.
+func (w *Wal) Write(data []byte) (uint64, error) {
+	return w.wal.WriteBuffer(data)
+}
+
+// Batch accumulates records to be written all-or-nothing with Wal.WriteBatch.
+// The zero value is an empty batch ready to use.
+type Batch struct {
+	batch core.Batch
+}
+
+// Add appends a record to the batch. The data is copied, so it can be reused right away.
+//
+// Parameters:
+//   - data: A slice of bytes to be written to the WAL.
+func (b *Batch) Add(data []byte) {
+	b.batch.Add(data)
+}
+
+// Len returns the number of records in the batch.
+func (b *Batch) Len() int {
+	return b.batch.Len()
+}
+
+// Reset empties the batch, so it can be filled again.
+func (b *Batch) Reset() {
+	b.batch.Reset()
+}
+
+// WriteBatch appends every record of the batch to the WAL, with contiguous LSNs.
+// Recovery either returns every record of the batch or none of them, even if a crash
+// tears the batch across a flush or a WAL file rotation.
+// The records are synced like the ones written with Write.
+//
+// Parameters:
+//   - b: A pointer to the Batch to be written. It is left untouched, so it can be reused with Reset.
+//
+// Returns:
+//   - The LSN assigned to the first record of the batch.
+//   - An error if the batch is empty or cannot be written. If part of the batch was already
+//     written, every later write returns the error too, until the Wal is closed and opened again.
+func (w *Wal) WriteBatch(b *Batch) (uint64, error) {
+	return w.wal.WriteBatch(&b.batch)
+}
+
+// Flush dumps the buffered records into the WAL files.
+// With SyncOnFlush (the default) and SyncOnWrite, the records are durable once it returns.
+//
+// Returns:
+//   - An error if the flush operation fails.
+func (w *Wal) Flush() error {
+	return w.wal.FlushBuffer()
+}
+
+// Sync flushes the buffered records and syncs them to disk, whatever Options.SyncMode says.
+// Every record written before calling Sync is durable once it returns.
+//
+// Returns:
+//   - An error if the flush or sync operation fails.
+func (w *Wal) Sync() error {
+	return w.wal.Sync()
+}
+
+// Truncate discards the records with an LSN lower than lsn, e.g. once they are reflected in a snapshot.
+// Recover stops returning them right away, and the WAL files holding only such records are deleted,
+// keeping disk usage bounded, or kept to be reused with Options.RecycleSegments.
+//
+// Parameters:
+//   - lsn: The LSN of the first record to keep.
+//
+// Returns:
+//   - An error if lsn has not been assigned yet, or the WAL cannot be truncated.
+func (w *Wal) Truncate(lsn uint64) error {
+	return w.wal.Truncate(lsn)
+}
+
+// EnforceRetention discards the oldest WAL files exceeding Options.Retention right away,
+// as done after every rotation, e.g. to apply RetentionPolicy.MaxAge when nothing is written.
+//
+// Returns:
+//   - An error if the WAL files cannot be read or discarded.
+func (w *Wal) EnforceRetention() error {
+	return w.wal.EnforceRetention()
+}
+
+// TruncateAfter discards every record with an LSN higher than lsn, buffered or already on disk,
+// e.g. to roll back records that were never committed. A batch cannot be cut in the middle.
+// The next record written gets lsn+1.
+//
+// Parameters:
+//   - lsn: The LSN of the last record to keep. 0 discards every record.
+//
+// Returns:
+//   - An error if records already discarded by Truncate would be reused, lsn is in the middle
+//     of a batch, or the WAL cannot be truncated. If the WAL files were already being removed,
+//     every later write returns the error too, until the Wal is closed and opened again.
+func (w *Wal) TruncateAfter(lsn uint64) error {
+	return w.wal.TruncateAfter(lsn)
+}
+
+// Checkpoint durably records that the records up to lsn are reflected elsewhere,
+// so Recover and Reader only return the records after it from now on, and Open only scans
+// the records after it to resume after a crash. The records written are synced to disk first,
+// whatever the SyncMode. The checkpoint is replaced atomically: after a crash, either the previous
+// or the new one is kept.
+//
+// Parameters:
+//   - lsn: The LSN of the last record covered by the checkpoint.
+//   - metadata: Data stored along the checkpoint, e.g. the name of the snapshot. Returned by LastCheckpoint.
+//
+// Returns:
+//   - An error if lsn has not been assigned yet, or the checkpoint cannot be written.
+func (w *Wal) Checkpoint(lsn uint64, metadata []byte) error {
+	return w.wal.Checkpoint(lsn, metadata)
+}
+
+// Close flushes the buffered records, syncs them to disk and closes the WAL files.
+// It also leaves a clean shutdown marker, so the next Open does not need to scan the WAL files,
+// and releases the lock of the WAL directory, even if the flush or the sync fail.
+// Calling Close more than once does nothing, other methods return ErrClosed after it.
+//
+// Returns:
+//   - An error if the WAL cannot be closed properly.
+func (w *Wal) Close() error {
+	return w.wal.Close()
+}
+
+// GroupCommitOptions defines how a GroupCommitter batches records.
+// Fields:
+//   - MaxBatchSize: Max number of records synced together.
+//   - MaxWait: Max time the first record of a batch waits for more records. 0 only batches
+//     the records already waiting.
+type GroupCommitOptions struct {
+	MaxBatchSize int
+	MaxWait      time.Duration
+}
+
+// DefaultGroupCommitOptions provides the default configuration of a GroupCommitter.
+var DefaultGroupCommitOptions = &GroupCommitOptions{
+	MaxBatchSize: core.DefaultGroupCommitOptions.MaxBatchSize,
+	MaxWait:      core.DefaultGroupCommitOptions.MaxWait,
+}
+
+// GroupCommitter lets many goroutines write records that must be durable before they go on,
+// sharing a single sync between the records written at the same time.
+// The Wal can still be used directly while it is running.
+// It works best with SyncOnFlush or SyncNever, as SyncOnWrite syncs every record anyway.
+type GroupCommitter struct {
+	committer *core.GroupCommitter
+}
+
+// NewGroupCommitter starts a GroupCommitter writing to w.
+// If a nil options argument is passed, it will use DefaultGroupCommitOptions.
+//
+// Parameters:
+//   - w: The Wal records are written to.
+//   - opts: A pointer to GroupCommitOptions with the batching configuration.
+//
+// Returns:
+//   - A pointer to the running GroupCommitter. It must be stopped with Close.
+func NewGroupCommitter(w *Wal, opts *GroupCommitOptions) *GroupCommitter {
+	if opts == nil {
+		opts = DefaultGroupCommitOptions
+	}
+	committer := core.NewGroupCommitter(w.wal, &core.GroupCommitOptions{
+		MaxBatchSize: opts.MaxBatchSize,
+		MaxWait:      opts.MaxWait,
+	})
+	return &GroupCommitter{committer: committer}
+}
+
+// Commit appends a record to the WAL and waits until it is synced to disk.
+// It is safe to call Commit from many goroutines at the same time.
+//
+// Parameters:
+//   - data: A slice of bytes to be written to the WAL. It must not be modified until Commit returns.
+//
+// Returns:
+//   - The LSN assigned to the record.
+//   - An error if the record cannot be written or synced, or ErrClosed after Close.
+func (g *GroupCommitter) Commit(data []byte) (uint64, error) {
+	return g.committer.Commit(data)
+}
+
+// Close stops the GroupCommitter once the records already accepted are committed.
+// The Wal is left open.
+//
+// Returns:
+//   - Always nil.
+func (g *GroupCommitter) Close() error {
+	return g.committer.Close()
+}
+
+// Recover reads back every valid record stored in the WAL directory after the last checkpoint.
+// Every WAL file is replayed in the order it was created and the CRC of each record is validated.
+// Torn or corrupted records are handled as set by Options.RecoveryMode.
+// If a nil argument is passed, it will use DefaultOptions.
+//
+// Parameters:
+//   - opts: A pointer to Options containing the configuration for the WAL.
+//
+// Returns:
+//   - A slice of Entry with the recovered records, in the order they were written.
+//   - An error if the records cannot be recovered.
+func Recover(opts *Options) ([]Entry, error) {
+	var entries []Entry
+
+	err := RecoverFunc(opts, func(entry Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// RecoverFunc works like Recover, but streams the records to fn instead of returning them,
+// so the WAL does not need to fit in memory.
+//
+// Parameters:
+//   - opts: A pointer to Options containing the configuration for the WAL.
+//   - fn: A function called for every record, in the order they were written.
+//     Returning an error stops the recovery and RecoverFunc returns it wrapped.
+//
+// Returns:
+//   - An error if the records cannot be recovered or fn fails.
+func RecoverFunc(opts *Options, fn func(Entry) error) error {
+	return core.RecoverFunc(opts.toCore(), func(r core.RecoveredEntry) error {
+		return fn(Entry{LSN: r.LSN, Data: r.Data})
+	})
+}
+
+// LastCheckpoint returns the last checkpoint stored in the WAL directory.
+// If a nil argument is passed, it will use DefaultOptions.
+//
+// Parameters:
+//   - opts: A pointer to Options containing the configuration for the WAL.
+//
+// Returns:
+//   - The last checkpoint.
+//   - false if no valid checkpoint was found. Recover then replays every record.
+//   - An error if the checkpoint cannot be read.
+func LastCheckpoint(opts *Options) (Checkpoint, bool, error) {
+	checkpoint, ok, err := core.ReadCheckpoint(opts.toCore())
+	if err != nil || !ok {
+		return Checkpoint{}, false, err
+	}
+	return Checkpoint{LSN: checkpoint.LSN, Metadata: checkpoint.Metadata}, true, nil
+}
+
+// Reader iterates over the records stored in the WAL directory, reading them from
+// the WAL files one at a time, so memory usage does not depend on the size of the WAL.
+// Like Recover, it starts after the last checkpoint. Seek moves it to any record still on disk.
+//
+//	r := walrog.NewReader(opts)
+//	defer r.Close()
+//	for r.Next() {
+//		entry := r.Entry()
+//	}
+//	if err := r.Err(); err != nil {
+//		...
+//	}
+//
+// A Reader is not safe for concurrent use, but it can read a WAL while a Wal writes to it.
+type Reader struct {
+	reader *core.Reader
+	err    error
+}
+
+// NewReader creates a Reader over the WAL stored in the directory given by the options.
+// If a nil argument is passed, it will use DefaultOptions.
+// Errors opening the WAL are reported by Reader.Err.
+//
+// Parameters:
+//   - opts: A pointer to Options containing the configuration for the WAL.
+//
+// Returns:
+//   - A pointer to the Reader, positioned before the first record.
+func NewReader(opts *Options) *Reader {
+	reader, err := core.NewReader(opts.toCore())
+	return &Reader{reader: reader, err: err}
+}
+
+// Next advances the Reader to the next record.
+// Once it returns false at the end of the WAL, it can be called again to read
+// the records flushed since then.
+//
+// Returns:
+//   - true if there is a record available through Entry.
+//   - false when there are no more records or an error happened.
+func (r *Reader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	return r.reader.Next()
+}
+
+// NewTailReader creates a Reader that follows the records appended to w, like `tail -f`:
+// at the end of the WAL, NextContext waits for w to flush new records.
+// Until it is closed, Options.Retention keeps the files it has not read yet.
+// Errors opening the WAL are reported by Reader.Err.
+//
+// Parameters:
+//   - w: The Wal to follow.
+//
+// Returns:
+//   - A pointer to the Reader, positioned before the first record.
+func NewTailReader(w *Wal) *Reader {
+	reader, err := core.NewTailReader(w.wal)
+	return &Reader{reader: reader, err: err}
+}
+
+// NextContext works like Next, but at the end of the WAL it blocks until new records are flushed,
+// following the WAL to its new files after every rotation. Records still buffered by the Wal
+// are not visible until Flush is called or the buffer fills up.
+// For a Reader created with NewReader, it works exactly like Next.
+//
+// Parameters:
+//   - ctx: A context to stop waiting for new records.
+//
+// Returns:
+//   - true if there is a record available through Entry.
+//   - false if ctx is done, or the Wal was closed and every record was read, or an error happened.
+//     Err then returns the context error or ErrClosed. NextContext can be called again after a context error.
+func (r *Reader) NextContext(ctx context.Context) bool {
+	if r.err != nil {
+		return false
+	}
+	return r.reader.NextContext(ctx)
+}
+
+// Entry returns the record the Reader is positioned at.
+// It must only be called after Next returned true.
+func (r *Reader) Entry() Entry {
+	entry := r.reader.Entry()
+	return Entry{LSN: entry.LSN, Data: entry.Data}
+}
+
+// Seek moves the Reader right before the record with the given LSN, so the next call to Next
+// returns it, e.g. to resume replication from the last record received.
+// Records covered by the last checkpoint can be read again.
+//
+// Parameters:
+//   - lsn: The LSN of the next record to read. If it has not been written yet,
+//     the Reader is moved to the end of the WAL.
+//
+// Returns:
+//   - An error if the record was discarded by Truncate, or the WAL cannot be read.
+func (r *Reader) Seek(lsn uint64) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.reader.Seek(lsn)
+}
+
+// Err returns the first error found by the Reader, if any.
+func (r *Reader) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.reader.Err()
+}
+
+// Close releases the resources held by the Reader.
+func (r *Reader) Close() error {
+	if r.reader == nil {
+		return nil
+	}
+	return r.reader.Close()
+}
+
+// toCore translates the public options into the internal ones.
+// A nil receiver returns the internal default options.
+func (o *Options) toCore() *core.WalOptions {
+	if o == nil {
+		o = DefaultOptions
+	}
+
+	fileHandlerOpts := *fh.DefaultOptions
+	fileHandlerOpts.DirName = o.DirName
+	fileHandlerOpts.DirPerms = o.DirPerms
+	fileHandlerOpts.FilePerms = o.FilePerms
+	fileHandlerOpts.FS = o.FS
+
+	coreOpts := &core.WalOptions{
+		BufferSize:       o.BufferSize,
+		SegmentSize:      o.SegmentSize,
+		FileHandlerOpts:  &fileHandlerOpts,
+		SyncMode:         o.SyncMode,
+		SyncInterval:     o.SyncInterval,
+		RecoveryMode:     o.RecoveryMode,
+		ReadOnly:         o.ReadOnly,
+		Preallocate:      o.Preallocate,
+		RecycleSegments:  o.RecycleSegments,
+		Retention:        core.RetentionPolicy(o.Retention),
+		OnRetentionError: o.OnRetentionError,
+	}
+	if o.OnRotate != nil {
+		onRotate := o.OnRotate
+		coreOpts.OnRotate = func(e core.RotationEvent) {
+			onRotate(RotationEvent(e))
+		}
+	}
+	if o.OnCorruption != nil {
+		onCorruption := o.OnCorruption
+		coreOpts.OnCorruption = func(c core.Corruption) {
+			onCorruption(Corruption(c))
+		}
+	}
+
+	return coreOpts
+}
@@ -0,0 +1,743 @@
+package walrog
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testOptions(t *testing.T) *Options {
+	opts := *DefaultOptions
+	opts.DirName = t.TempDir()
+	opts.BufferSize = 64
+	opts.SegmentSize = 1024
+	return &opts
+}
+
+func TestWriteAndRecover(t *testing.T) {
+	opts := testOptions(t)
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	records := [][]byte{[]byte("Hello World!"), []byte("Bye World!")}
+	for i, r := range records {
+		lsn, err := w.Write(r)
+		if err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		if lsn != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, lsn)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != len(records) {
+		t.Fatalf("Expected %d entries, got %d", len(records), len(entries))
+	}
+	for i, r := range records {
+		if entries[i].LSN != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, entries[i].LSN)
+		}
+		if !bytes.Equal(entries[i].Data, r) {
+			t.Errorf("Expected data %q, got %q", r, entries[i].Data)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	opts := testOptions(t)
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	r := NewReader(opts)
+	defer r.Close()
+
+	count := 0
+	for r.Next() {
+		if !bytes.Equal(r.Entry().Data, []byte{byte(count)}) {
+			t.Errorf("Expected data %v, got %v", []byte{byte(count)}, r.Entry().Data)
+		}
+		count++
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Reader failed: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("Expected 3 entries, got %d", count)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	opts := testOptions(t)
+
+	for i := 0; i < 2; i++ {
+		w, err := Open(opts)
+		if err != nil {
+			t.Fatalf("Open() failed: %v", err)
+		}
+		if _, err := w.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() failed: %v", err)
+		}
+	}
+
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected entries of both sessions, got %d entries", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.LSN != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, entry.LSN)
+		}
+		if !bytes.Equal(entry.Data, []byte{byte(i)}) {
+			t.Errorf("Expected data %v, got %v", []byte{byte(i)}, entry.Data)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	opts := testOptions(t)
+	opts.SegmentSize = 128
+
+	var events []RotationEvent
+	opts.OnRotate = func(e RotationEvent) {
+		events = append(events, e)
+	}
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	if len(events) == 0 {
+		t.Fatalf("Expected the WAL to rotate")
+	}
+
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 20 {
+		t.Fatalf("Expected 20 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.LSN != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, entry.LSN)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	opts := testOptions(t)
+	opts.SegmentSize = 128
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 20; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+
+	if err := w.Truncate(15); err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 6 || entries[0].LSN != 15 {
+		t.Fatalf("Expected LSNs 15 to 20, got %v", entries)
+	}
+}
+
+func TestTruncateAfter(t *testing.T) {
+	opts := testOptions(t)
+	opts.SegmentSize = 128
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+
+	if err := w.TruncateAfter(7); err != nil {
+		t.Fatalf("TruncateAfter() failed: %v", err)
+	}
+	lsn, err := w.Write([]byte("replaced"))
+	if err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if lsn != 8 {
+		t.Errorf("Expected LSN 8, got %d", lsn)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 8 || string(entries[7].Data) != "replaced" {
+		t.Fatalf("Expected 8 entries ending with the new one, got %v", entries)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	opts := testOptions(t)
+	opts.SegmentSize = 128
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if err := w.Checkpoint(12, []byte("snapshot-12")); err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	checkpoint, ok, err := LastCheckpoint(opts)
+	if err != nil || !ok {
+		t.Fatalf("LastCheckpoint() failed: %v, %v", ok, err)
+	}
+	if checkpoint.LSN != 12 || string(checkpoint.Metadata) != "snapshot-12" {
+		t.Errorf("Unexpected checkpoint %v", checkpoint)
+	}
+
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 8 || entries[0].LSN != 13 {
+		t.Fatalf("Expected LSNs 13 to 20, got %v", entries)
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	w, err := Open(testOptions(t))
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if _, err := w.Write([]byte("late")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Expected second Close() to do nothing, got %v", err)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	opts := testOptions(t)
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	committer := NewGroupCommitter(w, nil)
+
+	var wg sync.WaitGroup
+	lsns := make([]uint64, 10)
+	for i := range lsns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lsn, err := committer.Commit([]byte{byte(i)})
+			if err != nil {
+				t.Errorf("Commit() failed: %v", err)
+			}
+			lsns[i] = lsn
+		}(i)
+	}
+	wg.Wait()
+	committer.Close()
+
+	// Committed records are on disk before Close
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != len(lsns) {
+		t.Fatalf("Expected %d entries, got %d", len(lsns), len(entries))
+	}
+	for i, lsn := range lsns {
+		if entries[lsn-1].Data[0] != byte(i) {
+			t.Errorf("Expected data %d at LSN %d, got %d", i, lsn, entries[lsn-1].Data[0])
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+}
+
+func TestConcurrentWrite(t *testing.T) {
+	opts := testOptions(t)
+	opts.SegmentSize = 128
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if _, err := w.Write([]byte("0123456789")); err != nil {
+					t.Errorf("Write() failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 100 {
+		t.Fatalf("Expected 100 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.LSN != uint64(i+1) {
+			t.Errorf("Expected LSN %d, got %d", i+1, entry.LSN)
+		}
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	opts := testOptions(t)
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	var batch Batch
+	batch.Add([]byte("first"))
+	batch.Add([]byte("second"))
+	lsn, err := w.WriteBatch(&batch)
+	if err != nil {
+		t.Fatalf("WriteBatch() failed: %v", err)
+	}
+	if lsn != 1 {
+		t.Errorf("Expected first LSN 1, got %d", lsn)
+	}
+
+	batch.Reset()
+	batch.Add([]byte("third"))
+	lsn, err = w.WriteBatch(&batch)
+	if err != nil {
+		t.Fatalf("WriteBatch() failed: %v", err)
+	}
+	if lsn != 3 {
+		t.Errorf("Expected first LSN 3, got %d", lsn)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 3 || string(entries[2].Data) != "third" {
+		t.Fatalf("Expected the 3 entries of both batches, got %v", entries)
+	}
+}
+
+func TestLargeRecord(t *testing.T) {
+	opts := testOptions(t)
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	// Much bigger than the buffer and a WAL file
+	large := bytes.Repeat([]byte("0123456789"), 500)
+	if _, err := w.Write(large); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 1 || !bytes.Equal(entries[0].Data, large) {
+		t.Fatalf("Expected the large record back whole, got %d entries", len(entries))
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	opts := testOptions(t)
+	opts.SegmentSize = 128
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := w.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	r := NewReader(opts)
+	defer r.Close()
+	if err := r.Seek(15); err != nil {
+		t.Fatalf("Seek() failed: %v", err)
+	}
+
+	lsn := uint64(15)
+	for r.Next() {
+		if r.Entry().LSN != lsn {
+			t.Errorf("Expected LSN %d, got %d", lsn, r.Entry().LSN)
+		}
+		lsn++
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Reader failed: %v", err)
+	}
+	if lsn != 21 {
+		t.Errorf("Expected records up to LSN 20, got up to %d", lsn-1)
+	}
+}
+
+func TestTailReader(t *testing.T) {
+	opts := testOptions(t)
+	opts.SegmentSize = 128
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+
+	r := NewTailReader(w)
+	defer r.Close()
+
+	go func() {
+		for i := 0; i < 10; i++ {
+			if _, err := w.Write([]byte("0123456789")); err != nil {
+				t.Errorf("Write() failed: %v", err)
+				return
+			}
+			if err := w.Flush(); err != nil {
+				t.Errorf("Flush() failed: %v", err)
+				return
+			}
+		}
+		w.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	count := 0
+	for r.NextContext(ctx) {
+		count++
+		if r.Entry().LSN != uint64(count) {
+			t.Fatalf("Expected LSN %d, got %d", count, r.Entry().LSN)
+		}
+	}
+	if count != 10 {
+		t.Errorf("Expected 10 records, got %d", count)
+	}
+	if r.Err() != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", r.Err())
+	}
+}
+
+func TestRecoveryMode(t *testing.T) {
+	opts := testOptions(t)
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// Corrupt the CRC of the second record, every record being 27 bytes long
+	paths, err := filepath.Glob(filepath.Join(opts.DirName, "wal_*.log"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("Expected 1 WAL file, got %v: %v", paths, err)
+	}
+	content, err := os.ReadFile(paths[0])
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	offset := int64(len(content) - 2*27)
+	content[offset+26] ^= 0xff
+	if err := os.WriteFile(paths[0], content, 0644); err != nil {
+		t.Fatalf("WriteFile() failed: %v", err)
+	}
+
+	// By default, the last file is cut at the first invalid record
+	var reports []Corruption
+	opts.OnCorruption = func(c Corruption) {
+		reports = append(reports, c)
+	}
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 1 || len(reports) != 1 || reports[0].Size != 2*27 {
+		t.Errorf("Expected 1 record and 54 bytes dropped, got %+v and %+v", entries, reports)
+	}
+
+	reports = nil
+	opts.RecoveryMode = RecoverSkip
+	entries, err = Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 2 || entries[1].LSN != 3 {
+		t.Errorf("Expected the records with LSN 1 and 3, got %+v", entries)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("Expected 1 report, got %d", len(reports))
+	}
+	if reports[0].Segment != filepath.Base(paths[0]) || reports[0].Offset != offset || reports[0].Size != 27 {
+		t.Errorf("Expected 27 bytes dropped at %s:%d, got %+v", filepath.Base(paths[0]), offset, reports[0])
+	}
+}
+
+func TestLock(t *testing.T) {
+	opts := testOptions(t)
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	if _, err := w.Write([]byte("Hello World!")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+
+	if _, err := Open(opts); err != ErrLocked {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+
+	// A read-only Wal can be opened meanwhile, but not written to
+	readOnlyOpts := *opts
+	readOnlyOpts.ReadOnly = true
+	readOnly, err := Open(&readOnlyOpts)
+	if err != nil {
+		t.Fatalf("Open() failed in read-only mode: %v", err)
+	}
+	if _, err := readOnly.Write([]byte("Bye World!")); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	if err := readOnly.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	w, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed after Close(): %v", err)
+	}
+	w.Close()
+}
+
+func TestMemFS(t *testing.T) {
+	opts := *DefaultOptions
+	opts.DirName = "/wal"
+	opts.FS = NewMemFS()
+
+	w, err := Open(&opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for _, data := range []string{"first", "second"} {
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	entries, err := Recover(&opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 2 || string(entries[1].Data) != "second" {
+		t.Errorf("Expected 2 entries, got %+v", entries)
+	}
+
+	// A different FS does not see the WAL
+	other := opts
+	other.FS = NewMemFS()
+	entries, err = Recover(&other)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no entries, got %+v", entries)
+	}
+
+	if _, err := os.Stat("/wal"); !os.IsNotExist(err) {
+		t.Errorf("Expected /wal not to exist on disk, got %v", err)
+	}
+}
+
+func TestRecycleSegments(t *testing.T) {
+	opts := testOptions(t)
+	opts.SegmentSize = 128
+	opts.Preallocate = true
+	opts.RecycleSegments = 2
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if err := w.Truncate(15); err != nil {
+		t.Fatalf("Truncate() failed: %v", err)
+	}
+
+	// The files deleted by Truncate are reused by the next ones
+	before, _ := filepath.Glob(filepath.Join(opts.DirName, "*.log"))
+	for i := 0; i < 8; i++ {
+		if _, err := w.Write([]byte("abcdefghij")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	after, _ := filepath.Glob(filepath.Join(opts.DirName, "*.log"))
+	if len(after) != len(before) {
+		t.Errorf("Expected %d WAL files, got %v", len(before), after)
+	}
+
+	entries, err := Recover(opts)
+	if err != nil {
+		t.Fatalf("Recover() failed: %v", err)
+	}
+	if len(entries) != 14 || entries[0].LSN != 15 || string(entries[13].Data) != "abcdefghij" {
+		t.Fatalf("Expected LSNs 15 to 28, got %v", entries)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	opts := testOptions(t)
+	opts.SegmentSize = 128
+	opts.Retention = RetentionPolicy{MaxSegments: 3}
+
+	w, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 40; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+
+	// Nothing is discarded before the first checkpoint
+	if err := w.EnforceRetention(); err != nil {
+		t.Fatalf("EnforceRetention() failed: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(opts.DirName, "*.log"))
+	if len(files) != 10 {
+		t.Fatalf("Expected 10 WAL files, got %v", files)
+	}
+
+	// The next rotation discards the oldest files
+	if err := w.Checkpoint(40, nil); err != nil {
+		t.Fatalf("Checkpoint() failed: %v", err)
+	}
+	if _, err := w.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	files, _ = filepath.Glob(filepath.Join(opts.DirName, "*.log"))
+	if len(files) != 3 {
+		t.Errorf("Expected 3 WAL files, got %v", files)
+	}
+}